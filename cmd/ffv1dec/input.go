@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+	"github.com/dwbuiten/go-ffv1/ffv1/avi"
+	"github.com/dwbuiten/go-ffv1/ffv1/mkv"
+	"github.com/dwbuiten/go-ffv1/ffv1/mp4"
+	"github.com/dwbuiten/go-ffv1/ffv1/mxf"
+	"github.com/dwbuiten/go-ffv1/ffv1/nut"
+)
+
+// The start of the NUT file ID string.
+const nutMagic = "nut/multimedia container"
+
+// The start of the MXF header partition pack key.
+var mxfMagic = []byte{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x05, 0x01, 0x01, 0x0D, 0x01, 0x02, 0x01, 0x01, 0x02}
+
+// input is a demuxer for one of the supported containers, with a
+// decoder set up for its FFV1 track.
+type input interface {
+	// Returns the next packet of the FFV1 track, or io.EOF.
+	readPacket() ([]byte, error)
+}
+
+// Opens the container, working out which one it is from the first few
+// bytes. Only the formats that can be read front to back are supported
+// if f is a pipe.
+func openInput(f *os.File, options *ffv1.DecoderOptions) (*ffv1.Decoder, input, error) {
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(nutMagic))
+
+	// Files are rewound, and read directly, as peeking read ahead.
+	var r io.Reader = br
+	_, seekErr := f.Seek(0, io.SeekStart)
+	if seekErr == nil {
+		r = f
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		demuxer, err := mkv.NewDemuxer(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, track, err := demuxer.NewDecoder(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &mkvInput{demuxer, track.Number}, nil
+	case bytes.HasPrefix(magic, []byte(nutMagic)):
+		demuxer, err := nut.NewDemuxer(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, stream, err := demuxer.NewDecoder(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &nutInput{demuxer, stream.Index}, nil
+	case len(magic) >= len(mxfMagic) && bytes.Equal(magic[0:7], mxfMagic[0:7]) && bytes.Equal(magic[8:14], mxfMagic[8:]):
+		// The registry version byte varies between writers.
+		demuxer, err := mxf.NewDemuxer(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, _, err := demuxer.NewDecoder(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &mxfInput{demuxer}, nil
+	case len(magic) >= 12 && string(magic[0:4]) == "RIFF" && string(magic[8:12]) == "AVI ":
+		if seekErr != nil {
+			return nil, nil, fmt.Errorf("AVI input must be seekable")
+		}
+		demuxer, err := avi.NewDemuxer(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, stream, err := demuxer.NewDecoder(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &aviInput{demuxer, stream.Index}, nil
+	case len(magic) >= 8 && isMP4Box(string(magic[4:8])):
+		if seekErr != nil {
+			return nil, nil, fmt.Errorf("MP4 and QuickTime input must be seekable")
+		}
+		demuxer, err := mp4.NewDemuxer(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		d, track, err := demuxer.NewDecoder(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &mp4Input{demuxer, track.ID}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown container format")
+}
+
+// Box types ISOBMFF and QuickTime files start with.
+func isMP4Box(typ string) bool {
+	switch typ {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+type mkvInput struct {
+	demuxer *mkv.Demuxer
+	track   uint64
+}
+
+func (m *mkvInput) readPacket() ([]byte, error) {
+	for {
+		packet, err := m.demuxer.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if packet.Track == m.track {
+			return packet.Data, nil
+		}
+	}
+}
+
+type mp4Input struct {
+	demuxer *mp4.Demuxer
+	track   uint32
+}
+
+func (m *mp4Input) readPacket() ([]byte, error) {
+	for {
+		packet, err := m.demuxer.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if packet.Track == m.track {
+			return packet.Data, nil
+		}
+	}
+}
+
+type nutInput struct {
+	demuxer *nut.Demuxer
+	stream  int
+}
+
+func (n *nutInput) readPacket() ([]byte, error) {
+	for {
+		packet, err := n.demuxer.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if packet.Stream == n.stream {
+			return packet.Data, nil
+		}
+	}
+}
+
+type aviInput struct {
+	demuxer *avi.Demuxer
+	stream  int
+}
+
+func (a *aviInput) readPacket() ([]byte, error) {
+	for {
+		packet, err := a.demuxer.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if packet.Stream == a.stream {
+			return packet.Data, nil
+		}
+	}
+}
+
+type mxfInput struct {
+	demuxer *mxf.Demuxer
+}
+
+func (m *mxfInput) readPacket() ([]byte, error) {
+	packet, err := m.demuxer.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	return packet.Data, nil
+}
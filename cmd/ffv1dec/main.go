@@ -0,0 +1,119 @@
+// Command ffv1dec decodes the FFV1 track of a Matroska, MP4, QuickTime,
+// NUT, AVI or MXF file to raw planes, YUV4MPEG2, or a PNG image sequence.
+//
+// Usage:
+//
+//	ffv1dec [flags] input
+//
+// An input of '-' reads from stdin, e.g. 'ffmpeg -i in.mov -c copy -f nut - | ffv1dec -'.
+// MP4, QuickTime and AVI need to be seekable, so can not be piped.
+//
+// Raw planes are written in the order described by ffv1.Frame. It
+// exits with a non-zero status if any frame fails to decode, naming
+// the frame, and the slice, if any.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+func main() {
+	out := flag.String("o", "-", "output file, '-' for stdout, or a pattern such as frame%05d.png for image sequences")
+	format := flag.String("f", "y4m", "output format: raw, y4m, or png")
+	layout := flag.String("layout", layoutNative, "raw sample layout: native, le16, be16, or msb16")
+	start := flag.Int("start", 0, "first frame to output")
+	count := flag.Int("frames", 0, "number of frames to output, or 0 for all")
+	threads := flag.Int("threads", 0, "maximum number of slices to decode at once, or 0 for no limit")
+	conceal := flag.Bool("conceal", false, "conceal damaged slices instead of failing")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] input\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(flag.Arg(0), *out, *format, *layout, *start, *count, *threads, *conceal)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ffv1dec: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(input string, out string, format string, layout string, start int, count int, threads int, conceal bool) error {
+	f := os.Stdin
+	if input != "-" {
+		var err error
+		f, err = os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	d, in, err := openInput(f, &ffv1.DecoderOptions{
+		Conceal:        conceal,
+		MaxParallelism: threads,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %s", input, err.Error())
+	}
+
+	o, err := newOutput(format, out, layout)
+	if err != nil {
+		return err
+	}
+
+	// Every frame has to be decoded, even the ones we skip, as inter
+	// frames depend on the ones before them.
+	// An empty packet is a dropped frame, as AVI stores them, which
+	// repeats the last one.
+	pool := ffv1.NewFramePool(4)
+	var last *ffv1.Frame
+	for n := 0; count == 0 || n < start+count; {
+		packet, err := in.readPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("frame %d: couldn't read packet: %s", n, err.Error())
+		}
+
+		frame := last
+		if len(packet) != 0 || last == nil {
+			frame = pool.Get()
+			err = d.DecodeFrameInto(packet, frame)
+			var sliceErr *ffv1.SliceError
+			if errors.As(err, &sliceErr) {
+				return fmt.Errorf("frame %d: %s, at %v (use -conceal to carry on past damaged slices)", n, err.Error(), sliceErr.Rect)
+			} else if err != nil {
+				return fmt.Errorf("frame %d: %s", n, err.Error())
+			}
+			for _, rect := range frame.Concealed {
+				fmt.Fprintf(os.Stderr, "ffv1dec: frame %d: concealed %v\n", n, rect)
+			}
+		}
+
+		if n >= start {
+			err = o.writeFrame(n, frame)
+			if err != nil {
+				return fmt.Errorf("frame %d: couldn't write: %s", n, err.Error())
+			}
+		}
+		if last != nil && last != frame {
+			pool.Release(last)
+		}
+		last = frame
+		n++
+	}
+
+	return o.close()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/internal/ffv1test"
+)
+
+// The test binary runs main instead of the tests when this is set, so
+// that the command can be run as a whole, exit status and all.
+const mainEnv = "FFV1DEC_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		os.Args = append([]string{os.Args[0]}, strings.Fields(os.Getenv(mainEnv))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Runs ffv1dec with the given arguments, returning its output, and
+// its exit status.
+func ffv1dec(t *testing.T, args string) ([]byte, string, int) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainEnv+"="+args)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.Bytes(), stderr.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("couldn't run ffv1dec: %s", err.Error())
+	}
+	return stdout.Bytes(), stderr.String(), 0
+}
+
+// The testdata files hold the first two frames of ffv1test.Essence's
+// stream, with slice CRCs. The second frame of broken.mkv fails its
+// slice CRC.
+func TestY4M(t *testing.T) {
+	want := []byte("YUV4MPEG2 W16 H8 F25:1 Ip A0:0 C420jpeg\n")
+	for n := 0; n < 2; n++ {
+		want = append(want, "FRAME\n"...)
+		for _, plane := range ffv1test.Frame(ffv1test.Options, n).Buf {
+			want = append(want, plane...)
+		}
+	}
+
+	out, stderr, status := ffv1dec(t, "-f y4m testdata/sample.mkv")
+	if status != 0 {
+		t.Fatalf("exited with status %d: %s", status, stderr)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("wrote %d bytes, which differ from the %d expected", len(out), len(want))
+	}
+}
+
+func TestBrokenSlice(t *testing.T) {
+	_, stderr, status := ffv1dec(t, "-f y4m testdata/broken.mkv")
+	if status == 0 {
+		t.Fatalf("exited with status 0")
+	}
+	if !strings.Contains(stderr, "frame 1: slice 0 failed") {
+		t.Errorf("unexpected error: %s", stderr)
+	}
+
+	// With concealment, it carries on.
+	out, stderr, status := ffv1dec(t, "-conceal -f raw testdata/broken.mkv")
+	if status != 0 {
+		t.Fatalf("exited with status %d with -conceal: %s", status, stderr)
+	}
+	if len(out) != 2*(ffv1test.Width*ffv1test.Height*3/2) {
+		t.Errorf("wrote %d bytes with -conceal", len(out))
+	}
+	if !strings.Contains(stderr, "frame 1: concealed") {
+		t.Errorf("concealment not reported: %s", stderr)
+	}
+}
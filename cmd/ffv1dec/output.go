@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+	"github.com/dwbuiten/go-ffv1/ffv1/y4m"
+)
+
+// Output is where decoded frames go.
+type output interface {
+	writeFrame(n int, frame *ffv1.Frame) error
+	close() error
+}
+
+// Raw sample layouts.
+const (
+	layoutNative = "native" // 8-bit as bytes, higher as 16-bit little endian
+	layoutLE16   = "le16"   // Everything as 16-bit little endian
+	layoutBE16   = "be16"   // Everything as 16-bit big endian
+	layoutMSB16  = "msb16"  // Everything as 16-bit little endian, MSB aligned
+)
+
+func newOutput(format string, path string, layout string) (output, error) {
+	switch format {
+	case "raw":
+		switch layout {
+		case layoutNative, layoutLE16, layoutBE16, layoutMSB16:
+		default:
+			return nil, fmt.Errorf("unknown layout: %s", layout)
+		}
+		w, err := openOutput(path)
+		if err != nil {
+			return nil, err
+		}
+		return &rawOutput{w: w, buf: bufio.NewWriter(w), layout: layout}, nil
+	case "y4m":
+		w, err := openOutput(path)
+		if err != nil {
+			return nil, err
+		}
+		buf := bufio.NewWriter(w)
+		return &y4mOutput{w: w, buf: buf, y4m: y4m.NewWriter(buf, nil)}, nil
+	case "png":
+		if !strings.Contains(path, "%") {
+			return nil, fmt.Errorf("image sequences need an output pattern such as frame%%05d.png")
+		}
+		return &pngOutput{pattern: path}, nil
+	}
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+type rawOutput struct {
+	w      io.WriteCloser
+	buf    *bufio.Writer
+	layout string
+}
+
+func (o *rawOutput) writeFrame(n int, frame *ffv1.Frame) error {
+	if frame.BitDepth == 8 && !frame.Float {
+		for _, plane := range frame.Buf {
+			if o.layout == layoutNative {
+				_, err := o.buf.Write(plane)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			for _, v := range plane {
+				err := o.writeSample(uint16(v), 8)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	planes := frame.Buf16
+	bits := frame.BitDepth
+	if frame.Float {
+		// There is nothing to align.
+		planes = frame.BufFloat16
+		bits = 16
+	}
+	for _, plane := range planes {
+		for _, v := range plane {
+			err := o.writeSample(v, bits)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *rawOutput) writeSample(v uint16, bits uint8) error {
+	var b [2]byte
+	switch o.layout {
+	case layoutBE16:
+		binary.BigEndian.PutUint16(b[:], v)
+	case layoutMSB16:
+		binary.LittleEndian.PutUint16(b[:], v<<(16-bits))
+	default:
+		binary.LittleEndian.PutUint16(b[:], v)
+	}
+	_, err := o.buf.Write(b[:])
+	return err
+}
+
+func (o *rawOutput) close() error {
+	err := o.buf.Flush()
+	if err != nil {
+		return err
+	}
+	return o.w.Close()
+}
+
+type y4mOutput struct {
+	w   io.WriteCloser
+	buf *bufio.Writer
+	y4m *y4m.Writer
+}
+
+func (o *y4mOutput) writeFrame(n int, frame *ffv1.Frame) error {
+	return o.y4m.WriteFrame(frame)
+}
+
+func (o *y4mOutput) close() error {
+	err := o.buf.Flush()
+	if err != nil {
+		return err
+	}
+	return o.w.Close()
+}
+
+type pngOutput struct {
+	pattern string
+}
+
+func (o *pngOutput) writeFrame(n int, frame *ffv1.Frame) error {
+	img, err := frame.Image()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(fmt.Sprintf(o.pattern, n))
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(f, img)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (o *pngOutput) close() error {
+	return nil
+}
@@ -1,10 +1,10 @@
-// Package ffv1 implements an FFV1 Version 3 decoder based off of
-// draft-ietf-cellar-ffv1.
+// Package ffv1 implements an FFV1 decoder, for versions 0 to 4, and
+// a version 3 encoder, based off of draft-ietf-cellar-ffv1.
 package ffv1
 
 import (
 	"fmt"
-	"sync"
+	"image"
 )
 
 // Decoder is a FFV1 decoder instance.
@@ -15,31 +15,76 @@ type Decoder struct {
 	state_transition [256]uint8
 	initial_states   [][][]uint8
 	current_frame    internalFrame
+	options          DecoderOptions
+	prev_frame       *Frame
+	slice_rects      []image.Rectangle
+	scratch16        [][]uint16
+	scratch32        [][]uint32
+}
+
+// DecoderOptions contains optional decoder behaviour.
+type DecoderOptions struct {
+	// Conceal slices which fail to decode, e.g. because of a CRC
+	// mismatch or a non-zero error_status, instead of failing the
+	// whole frame. Concealed slices are filled from the same area of
+	// the previous frame, or with a neutral value if there is none,
+	// and are listed in Frame.Concealed.
+	//
+	// A concealed slice stays concealed until its contexts are next
+	// reset, usually at the next keyframe, as its contexts are lost.
+	Conceal bool
+	// The maximum number of slices to decode at once. Zero means no
+	// limit, and one means slices are decoded serially, in the calling
+	// goroutine.
+	MaxParallelism int
+	// Executor to run slice decoding on. If nil, new goroutines are
+	// used. Ignored if MaxParallelism is one.
+	Executor Executor
+
+	// Limits for untrusted streams. Each is checked before anything is
+	// allocated for what it limits, and going over one gives an error
+	// wrapping ErrLimitExceeded. Zero means no limit.
+
+	// The maximum number of pixels in a frame, i.e. width times height.
+	MaxPixels uint64
+	// The maximum number of slices in a frame.
+	MaxSlices int
+	// The maximum number of bytes needed to decode a frame: its
+	// planes, any scratch space, the copy of it kept for concealment,
+	// and the contexts of its slices.
+	MaxFrameBytes uint64
+	// The maximum number of contexts in a quantization table set.
+	MaxContextCount int
 }
 
 // Frame contains a decoded FFV1 frame and relevant
 // data about the frame.
 //
 // If BitDepth is 8, image data is in Buf. If it is anything else,
-// image data is in Buf16.
+// image data is in Buf16, unless Float is true, in which case it is
+// in BufFloat16.
 //
 // Image data consists of up to four contiguous planes, as follows:
 //   - If ColorSpace is YCbCr:
 //     - Plane 0 is Luma (always present)
-//     - If HasChroma is true, the next two planes are Cr and Cr, subsampled by
-//       ChromaSubsampleV and ChromaSubsampleH.
+//     - If HasChroma is true, the next two planes are Cb and Cr, subsampled by
+//       ChromaSubsampleV and ChromaSubsampleH, rounding up.
 //     - If HasAlpha is true, the next plane is alpha.
 //  - If ColorSpace is RGB:
 //    - Plane 0 is Green
 //    - Plane 1 is Blue
 //    - Plane 2 is Red
-//    - If HasAlpha is true, plane 4 is alpha.
+//    - If HasAlpha is true, plane 3 is alpha.
 type Frame struct {
 	// Image data. Valid only when BitDepth is 8.
 	Buf [][]byte
-	// Image data. Valid only when BitDepth is greater than 8.
+	// Image data. Valid only when BitDepth is greater than 8, and
+	// Float is false.
 	Buf16 [][]uint16
-	// Unexported 32-bit scratch buffer for 16-bit JPEG2000-RCT RGB
+	// Image data, as IEEE 754 half-precision bit patterns. Valid only
+	// when Float is true. See also PlaneFloat32.
+	BufFloat16 [][]uint16
+	// Unexported 32-bit scratch buffer for JPEG2000-RCT RGB. See usesScratch32.
 	buf32 [][]uint32
 	// Width of the frame, in pixels.
 	Width uint32
@@ -57,6 +102,26 @@ type Frame struct {
 	ChromaSubsampleV uint8
 	// The log2 horizontal chroma subsampling value.
 	ChromaSubsampleH uint8
+	// Whether or not the samples are 16-bit floats.
+	Float bool
+	// The areas, in luma pixels, of any slices which were concealed.
+	// See DecoderOptions.Conceal.
+	Concealed []image.Rectangle
+}
+
+// PlaneFloat32 converts plane p of a float frame to float32 values.
+// It returns nil if the frame is not a float frame.
+func (f *Frame) PlaneFloat32(p int) []float32 {
+	if !f.Float || p >= len(f.BufFloat16) {
+		return nil
+	}
+
+	ret := make([]float32, len(f.BufFloat16[p]))
+	for i, v := range f.BufFloat16[p] {
+		ret[i] = halfToFloat32(v)
+	}
+
+	return ret
 }
 
 // NewDecoder creates a new FFV1 decoder instance.
@@ -65,25 +130,44 @@ type Frame struct {
 // Matroska, this is what is in CodecPrivate (adjusted for e.g. VFW
 // data that may be before it). For ISOBMFF, this is the 'glbl' box.
 //
+// FFV1 versions 0 and 1 have no configuration record, and instead
+// carry their parameters in each keyframe, so 'record' should be
+// empty for them. Decoding must then start at a keyframe.
+//
 // 'width' and 'height' are the frame width and height provided by
 // the container.
 func NewDecoder(record []byte, width uint32, height uint32) (*Decoder, error) {
+	return NewDecoderWithOptions(record, width, height, nil)
+}
+
+// NewDecoderWithOptions creates a new FFV1 decoder instance, the same
+// as NewDecoder, with the given options. If 'options' is nil, the
+// defaults are used.
+func NewDecoderWithOptions(record []byte, width uint32, height uint32, options *DecoderOptions) (*Decoder, error) {
 	ret := new(Decoder)
 
 	if width == 0 || height == 0 {
 		return nil, fmt.Errorf("invalid dimensions: %dx%d", width, height)
 	}
 
-	if len(record) == 0 {
-		return nil, fmt.Errorf("invalid record with length zero")
-	}
-
 	ret.width = width
 	ret.height = height
+	if options != nil {
+		ret.options = *options
+	}
+
+	if ret.options.MaxPixels != 0 && uint64(width)*uint64(height) > ret.options.MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d is more than %d pixels", ErrLimitExceeded, width, height, ret.options.MaxPixels)
+	}
 
-	err := parseConfigRecord(record, &ret.record)
+	// Versions 0 and 1; the parameters are read from the first keyframe.
+	if len(record) == 0 {
+		return ret, nil
+	}
+
+	err := parseConfigRecord(record, &ret.record, ret.options.MaxContextCount)
 	if err != nil {
-		return nil, fmt.Errorf("invalid v3 configuration record: %s", err.Error())
+		return nil, fmt.Errorf("invalid configuration record: %w", err)
 	}
 
 	ret.initializeStates()
@@ -94,114 +178,329 @@ func NewDecoder(record []byte, width uint32, height uint32) (*Decoder, error) {
 // DecodeFrame takes a packet and decodes it to a ffv1.Frame.
 //
 // Slice threading is used by default, with one goroutine per
-// slice.
+// slice. See DecoderOptions for how to limit it.
+//
+// If the slices of the frame do not cover it exactly once, a
+// *GeometryError is returned, even if DecoderOptions.Conceal is set.
 func (d *Decoder) DecodeFrame(frame []byte) (*Frame, error) {
-
-	// Allocate and fill frame info
 	ret := new(Frame)
+
+	err := d.DecodeFrameInto(frame, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// DecodeFrameInto takes a packet and decodes it into dst, the same as
+// DecodeFrame, but reusing the image data of dst where possible, so
+// frames can be recycled, e.g. with a FramePool. Planes that are too
+// small are reallocated, and those that are not needed are dropped.
+//
+// If an error is returned, the contents of dst are undefined.
+func (d *Decoder) DecodeFrameInto(frame []byte, dst *Frame) error {
+	// We parse the frame's keyframe info outside the slice decoding
+	// loop so we know ahead of time if each slice has to refresh its
+	// states or not. This allows easy slice threading.
+	d.current_frame.keyframe = isKeyframe(frame)
+
+	// Versions 0 and 1 carry their parameters in each keyframe, and
+	// we need them before we can allocate anything. Version 2 carries
+	// the slice layout there instead.
+	d.current_frame.header_coder = nil
+	if d.record.version < 3 {
+		err := d.parseFrameHeader(frame, &d.current_frame)
+		if err != nil {
+			return fmt.Errorf("invalid frame header: %w", err)
+		}
+	}
+
+	// We parse all the footers ahead of time too, as that allows us
+	// to know all the slice positions and sizes, for slice threading,
+	// and how much memory the frame needs, before allocating any of it.
+	//
+	// See: 9.1.1. Multi-threading Support and Independence of Slices
+	err := d.parseFooters(frame, &d.current_frame)
+	if err != nil {
+		return fmt.Errorf("invalid frame footer: %w", err)
+	}
+
+	if d.options.MaxFrameBytes != 0 {
+		size := frameBytes(&d.record, d.width, d.height, len(d.current_frame.slice_info), d.options.Conceal)
+		if size > d.options.MaxFrameBytes {
+			return fmt.Errorf("%w: frame needs %d bytes, more than %d", ErrLimitExceeded, size, d.options.MaxFrameBytes)
+		}
+	}
+
+	// Keep hold of the planes we may reuse, before we start
+	// overwriting things.
+	buf, buf16, bufFloat16 := dst.Buf, dst.Buf16, dst.BufFloat16
+
+	// Fill frame info
+	ret := dst
 	ret.Width = d.width
 	ret.Height = d.height
 	ret.BitDepth = d.record.bits_per_raw_sample
 	ret.ColorSpace = int(d.record.colorspace_type)
 	ret.HasChroma = d.record.chroma_planes
 	ret.HasAlpha = d.record.extra_plane
+	ret.Float = d.record.flt
+	ret.ChromaSubsampleV = 0
+	ret.ChromaSubsampleH = 0
 	if ret.HasChroma {
 		ret.ChromaSubsampleV = d.record.log2_v_chroma_subsample
 		ret.ChromaSubsampleH = d.record.log2_h_chroma_subsample
 	}
+	ret.Concealed = ret.Concealed[:0]
 
-	numPlanes := 1
-	if d.record.chroma_planes {
-		numPlanes += 2
-	}
-	if d.record.extra_plane {
-		numPlanes++
-	}
+	sizes := planeSizes(&d.record, d.width, d.height)
 
 	// Hideous and temporary.
+	ret.Buf = nil
 	if d.record.bits_per_raw_sample == 8 {
-		ret.Buf = make([][]byte, numPlanes)
-		ret.Buf[0] = make([]byte, int(d.width*d.height))
-		if d.record.chroma_planes {
-			chromaWidth := d.width >> d.record.log2_h_chroma_subsample
-			chromaHeight := d.height >> d.record.log2_v_chroma_subsample
-			ret.Buf[1] = make([]byte, int(chromaWidth*chromaHeight))
-			ret.Buf[2] = make([]byte, int(chromaWidth*chromaHeight))
-		}
-		if d.record.extra_plane {
-			ret.Buf[3] = make([]byte, int(d.width*d.height))
-		}
+		ret.Buf = reusePlanes8(buf, sizes)
 	}
 
-	// We allocate *both* if it's 8bit RGB since I'm a terrible person and
-	// I wanted to use it as a scratch space, since JPEG2000-RCT is very
-	// annoyingly coded as n+1 bits, and I wanted the implementation
-	// to be straightforward... RIP.
-	if d.record.bits_per_raw_sample > 8 || d.record.colorspace_type == 1 {
-		ret.Buf16 = make([][]uint16, numPlanes)
-		ret.Buf16[0] = make([]uint16, int(d.width*d.height))
-		if d.record.chroma_planes {
-			chromaWidth := d.width >> d.record.log2_h_chroma_subsample
-			chromaHeight := d.height >> d.record.log2_v_chroma_subsample
-			ret.Buf16[1] = make([]uint16, int(chromaWidth*chromaHeight))
-			ret.Buf16[2] = make([]uint16, int(chromaWidth*chromaHeight))
-		}
-		if d.record.extra_plane {
-			ret.Buf16[3] = make([]uint16, int(d.width*d.height))
-		}
+	// We use Buf16 as scratch space if it's 8bit RGB since I'm a terrible
+	// person, since JPEG2000-RCT is very annoyingly coded as n+1 bits, and
+	// I wanted the implementation to be straightforward... RIP.
+	//
+	// Float frames are decoded as remapped integers in it too, and then
+	// mapped back to their float values.
+	//
+	// Scratch space belongs to the decoder, so it can be reused, and so
+	// it does not make it into the caller's frame.
+	if usesScratch16(&d.record) {
+		d.scratch16 = reusePlanes16(d.scratch16, sizes)
+		ret.Buf16 = d.scratch16
+	} else if d.record.bits_per_raw_sample > 8 {
+		ret.Buf16 = reusePlanes16(buf16, sizes)
+	} else {
+		ret.Buf16 = nil
 	}
 
 	// For 16-bit RGB we need a 32-bit scratch space beause we need to predict
 	// based on 17-bit values in the JPEG2000-RCT space, so just allocate a
 	// whole frame, because I am lazy. Is it slow? Yes.
-	if d.record.bits_per_raw_sample == 16 && d.record.colorspace_type == 1 {
-		ret.buf32 = make([][]uint32, numPlanes)
-		ret.buf32[0] = make([]uint32, int(d.width*d.height))
-		ret.buf32[1] = make([]uint32, int(d.width*d.height))
-		ret.buf32[2] = make([]uint32, int(d.width*d.height))
-		if d.record.extra_plane {
-			ret.buf32[3] = make([]uint32, int(d.width*d.height))
+	ret.buf32 = nil
+	if usesScratch32(&d.record) {
+		full := make([]int, len(sizes))
+		for p := range full {
+			full[p] = int(d.width) * int(d.height)
 		}
+		d.scratch32 = reusePlanes32(d.scratch32, full)
+		ret.buf32 = d.scratch32
 	}
 
-	// We parse the frame's keyframe info outside the slice decoding
-	// loop so we know ahead of time if each slice has to refresh its
-	// states or not. This allows easy slice threading.
-	d.current_frame.keyframe = isKeyframe(frame)
-
-	// We parse all the footers ahead of time too, for the same reason.
-	// It allows us to know all the slice positions and sizes.
-	//
-	// See: 9.1.1. Multi-threading Support and Independence of Slices
-	err := d.parseFooters(frame, &d.current_frame)
-	if err != nil {
-		return nil, fmt.Errorf("invalid frame footer: %s", err.Error())
+	ret.BufFloat16 = nil
+	if d.record.flt {
+		ret.BufFloat16 = reusePlanes16(bufFloat16, sizes)
 	}
 
 	// Slice threading lazymode
+	//
+	// All slice headers are parsed before any slice is decoded, so the
+	// slice geometry can be checked, as overlapping slices would race
+	// to write the same pixels.
 	errs := make([]error, len(d.current_frame.slices))
-	wg := new(sync.WaitGroup)
-	for i := 0; i < len(d.current_frame.slices); i++ {
-		wg.Add(1)
-		go func(wg *sync.WaitGroup, errs []error, n int) {
-			errs[n] = d.decodeSlice(frame, &d.current_frame, n, ret)
-			wg.Done()
-		}(wg, errs, i)
-	}
-	wg.Wait()
+	d.runSlices(len(d.current_frame.slices), func(n int) {
+		errs[n] = d.startSlice(frame, &d.current_frame, n)
+	})
+	err = checkSliceGeometry(&d.record, d.current_frame.slices)
+	if err != nil {
+		// None of the contexts were updated for this frame.
+		for i := range d.current_frame.slices {
+			d.current_frame.slices[i].damaged = true
+			d.current_frame.slices[i].coder = nil
+			d.current_frame.slices[i].golomb_coder = nil
+		}
+		d.dropScratch(ret)
+		return err
+	}
+	d.runSlices(len(d.current_frame.slices), func(n int) {
+		if errs[n] == nil {
+			errs[n] = d.decodeSlice(&d.current_frame, n, ret)
+		}
+	})
 	for i, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("slice %d failed: %s", i, err.Error())
+			// Its contexts can't be trusted anymore.
+			d.current_frame.slices[i].damaged = true
+		} else {
+			d.rememberSliceRect(i)
+		}
+	}
+	d.dropScratch(ret)
+	if !d.options.Conceal {
+		for i, err := range errs {
+			if err != nil {
+				return &SliceError{Index: i, Rect: d.sliceRect(i), Cause: err}
+			}
 		}
 	}
 
-	// Delete the scratch buffer, if needed, as per above.
-	if d.record.bits_per_raw_sample == 8 && d.record.colorspace_type == 1 {
-		ret.Buf16 = nil
+	if d.options.Conceal {
+		for i, err := range errs {
+			if err != nil {
+				rect := d.concealSlice(ret, i)
+				if !rect.Empty() {
+					ret.Concealed = append(ret.Concealed, rect)
+				}
+			}
+		}
+		d.prev_frame = copyFrameInto(d.prev_frame, ret)
 	}
 
-	// We'll never need this again.
-	ret.buf32 = nil
+	return nil
+}
 
-	return ret, nil
+// Whether or not Buf16 is used as scratch space, as per DecodeFrameInto.
+func usesScratch16(record *configRecord) bool {
+	return (record.bits_per_raw_sample == 8 && record.colorspace_type == 1) || record.flt
+}
+
+// Reports whether RGB samples are decoded into the 32-bit scratch
+// buffer, before JPEG2000-RCT. This is the case for 16-bit, and for
+// 9 to 15-bit with alpha, which rctMid does not handle.
+func usesScratch32(record *configRecord) bool {
+	if record.colorspace_type != 1 {
+		return false
+	}
+	return record.bits_per_raw_sample == 16 || (record.bits_per_raw_sample > 8 && record.extra_plane)
+}
+
+// Drops the decoder's scratch buffers from a frame, so the caller
+// never gets hold of them, even when there is an error, and they
+// are not overwritten by the next frame behind the caller's back.
+func (d *Decoder) dropScratch(f *Frame) {
+	if usesScratch16(&d.record) {
+		f.Buf16 = nil
+	}
+	f.buf32 = nil
+}
+
+// Calculates the size of each plane of a frame.
+func planeSizes(record *configRecord, width uint32, height uint32) []int {
+	sizes := []int{int(width) * int(height)}
+	if record.chroma_planes {
+		chromaWidth, chromaHeight := chromaSize(record, width, height)
+		sizes = append(sizes, int(chromaWidth)*int(chromaHeight), int(chromaWidth)*int(chromaHeight))
+	}
+	if record.extra_plane {
+		sizes = append(sizes, int(width)*int(height))
+	}
+	return sizes
+}
+
+// Works out how many bytes are needed to decode a frame with the
+// given number of slices, as per DecoderOptions.MaxFrameBytes. Slice
+// headers have not been parsed yet, so every slice is assumed to use
+// the quantization table set with the most contexts.
+func frameBytes(record *configRecord, width uint32, height uint32, slice_count int, conceal bool) uint64 {
+	pixels := uint64(width) * uint64(height)
+	samples := pixels
+	planes := uint64(1)
+	if record.chroma_planes {
+		chromaWidth, chromaHeight := chromaSize(record, width, height)
+		samples += 2 * uint64(chromaWidth) * uint64(chromaHeight)
+		planes += 2
+	}
+	if record.extra_plane {
+		samples += pixels
+		planes++
+	}
+
+	// The frame itself, as in DecodeFrameInto.
+	sample_bytes := uint64(2)
+	if record.bits_per_raw_sample == 8 {
+		sample_bytes = 1
+	}
+	total := samples * sample_bytes
+	if usesScratch16(record) {
+		total += samples * 2
+	}
+	if record.flt {
+		total += samples * 2
+	}
+	if usesScratch32(record) {
+		total += pixels * planes * 4
+	}
+	if conceal {
+		total += samples * sample_bytes
+	}
+
+	// Contexts, and their Golomb-Rice states, which are four int32s.
+	max_context_count := uint64(0)
+	for i := 0; i < int(record.quant_table_set_count); i++ {
+		if uint64(record.context_count[i]) > max_context_count {
+			max_context_count = uint64(record.context_count[i])
+		}
+	}
+	context_bytes := uint64(contextSize)
+	if record.coder_type == 0 {
+		context_bytes += 16
+	}
+	total += uint64(slice_count) * uint64(quantTableSetIndexCount(record)) * max_context_count * context_bytes
+
+	return total
+}
+
+// Reuses planes if they are large enough, or allocates new ones.
+func reusePlanes8(planes [][]byte, sizes []int) [][]byte {
+	if len(planes) != len(sizes) {
+		tmp := make([][]byte, len(sizes))
+		copy(tmp, planes)
+		planes = tmp
+	}
+	for p, size := range sizes {
+		if cap(planes[p]) >= size {
+			planes[p] = planes[p][:size]
+		} else {
+			planes[p] = make([]byte, size)
+		}
+	}
+	return planes
+}
+
+// Reuses planes if they are large enough, or allocates new ones.
+func reusePlanes16(planes [][]uint16, sizes []int) [][]uint16 {
+	if len(planes) != len(sizes) {
+		tmp := make([][]uint16, len(sizes))
+		copy(tmp, planes)
+		planes = tmp
+	}
+	for p, size := range sizes {
+		if cap(planes[p]) >= size {
+			planes[p] = planes[p][:size]
+		} else {
+			planes[p] = make([]uint16, size)
+		}
+	}
+	return planes
+}
+
+// Reuses planes if they are large enough, or allocates new ones.
+func reusePlanes32(planes [][]uint32, sizes []int) [][]uint32 {
+	if len(planes) != len(sizes) {
+		tmp := make([][]uint32, len(sizes))
+		copy(tmp, planes)
+		planes = tmp
+	}
+	for p, size := range sizes {
+		if cap(planes[p]) >= size {
+			planes[p] = planes[p][:size]
+		} else {
+			planes[p] = make([]uint32, size)
+		}
+	}
+	return planes
+}
+
+// Calculates the dimensions of a chroma plane, rounding up, as
+// per 4.6.2. plane_pixel_height and 4.7.1. plane_pixel_width.
+func chromaSize(record *configRecord, width uint32, height uint32) (uint32, uint32) {
+	chromaWidth := (width + (1 << record.log2_h_chroma_subsample) - 1) >> record.log2_h_chroma_subsample
+	chromaHeight := (height + (1 << record.log2_v_chroma_subsample) - 1) >> record.log2_v_chroma_subsample
+	return chromaWidth, chromaHeight
 }
@@ -0,0 +1,523 @@
+// Package avi implements a minimal AVI demuxer, just enough to find an
+// FFV1 stream, set up a decoder for it, and read its packets.
+//
+// Packets are found using the OpenDML indexes, if present, which cover
+// the whole of files over 1 GB, or the idx1 index if not. Files with
+// neither, such as captures that were cut short, are scanned instead.
+package avi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+// Largest chunk that will be read into memory.
+const maxChunkSize = 1 << 30
+
+// Size of a BITMAPINFOHEADER, which the FFV1 configuration record
+// follows in a video stream's format chunk.
+const bitmapInfoHeaderSize = 40
+
+// idx1 flags.
+const idx1KeyFrame = 0x10
+
+// OpenDML index types.
+const (
+	indexOfIndexes = 0x00
+	indexOfChunks  = 0x01
+)
+
+// In OpenDML standard index entries, the top bit of the size is set for
+// frames that are not keyframes.
+const deltaFrame = 0x80000000
+
+// Stream describes a stream in the file.
+type Stream struct {
+	// Index of the stream, as used by Packet.Stream.
+	Index int
+	// Type of the stream, e.g. "vids" or "auds".
+	Type string
+	// Handler FourCC, from the stream header.
+	Handler string
+	// Compression FourCC of a video stream, e.g. "FFV1".
+	Compression string
+	// Width of the video, in pixels, or zero if not a video stream.
+	Width uint32
+	// Height of the video, in pixels, or zero if not a video stream.
+	Height uint32
+	// Rate and Scale give the frame rate of a video stream, as
+	// Rate / Scale.
+	Rate  uint32
+	Scale uint32
+	// Format is the stream format chunk, e.g. a BITMAPINFOHEADER.
+	Format []byte
+	// Extradata is what follows the BITMAPINFOHEADER in the format of
+	// a video stream. For FFV1, this is the configuration record.
+	Extradata []byte
+
+	// The OpenDML super index, if any.
+	superIndex []byte
+}
+
+// Packet is a chunk of stream data read from the file.
+type Packet struct {
+	// Index of the stream the packet belongs to.
+	Stream int
+	// Data is the frame itself. Empty video frames are dropped frames,
+	// which repeat the frame before them.
+	Data []byte
+	// Timestamp of the frame, for video streams, worked out from its
+	// position in the stream and the frame rate.
+	Timestamp time.Duration
+	// Whether or not the frame is a keyframe, according to the index.
+	// Without an index, all frames are marked as keyframes.
+	Keyframe bool
+}
+
+type sample struct {
+	stream   int
+	offset   int64
+	size     uint32
+	time     time.Duration
+	keyframe bool
+}
+
+// A movi list, and where its data starts and ends. idx1 offsets are
+// relative to base, the position of its list type.
+type movi struct {
+	base  int64
+	start int64
+	end   int64
+}
+
+// Demuxer is an AVI demuxer instance.
+type Demuxer struct {
+	r        io.ReadSeeker
+	fileSize int64
+	streams  []Stream
+	// Samples of all streams, in file order.
+	samples []sample
+	next    int
+}
+
+// NewDemuxer reads the headers of an AVI file, including those of any
+// OpenDML extended RIFF chunks, and its index.
+func NewDemuxer(r io.ReadSeeker) (*Demuxer, error) {
+	ret := &Demuxer{r: r}
+
+	var err error
+	ret.fileSize, err = r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var movis []movi
+	var idx1 []byte
+	for pos, form := int64(0), "AVI "; pos+12 <= ret.fileSize; form = "AVIX" {
+		id, size, err := ret.readChunkHeaderAt(pos)
+		if err != nil {
+			return nil, err
+		}
+		typ, err := ret.readAt(pos+chunkHeaderSize, 4)
+		if err != nil {
+			return nil, err
+		}
+		if id != "RIFF" || string(typ) != form {
+			if form == "AVI " {
+				return nil, fmt.Errorf("not an AVI file")
+			}
+			// Trailing junk.
+			break
+		}
+		end := pos + chunkHeaderSize + padded(size)
+		if end > ret.fileSize {
+			end = ret.fileSize
+		}
+
+		for pos += 12; pos+chunkHeaderSize <= end; {
+			id, size, err := ret.readChunkHeaderAt(pos)
+			if err != nil {
+				return nil, err
+			}
+			data := pos + chunkHeaderSize
+			chunkEnd := data + size
+			if chunkEnd > end {
+				chunkEnd = end
+			}
+
+			switch id {
+			case "LIST":
+				if size < 4 {
+					return nil, fmt.Errorf("truncated list")
+				}
+				typ, err := ret.readAt(data, 4)
+				if err != nil {
+					return nil, err
+				}
+				switch string(typ) {
+				case "hdrl":
+					// Sizes are clamped to the file, so that a broken
+					// one doesn't cause a huge allocation.
+					hdrl, err := ret.readAt(data+4, chunkEnd-data-4)
+					if err != nil {
+						return nil, fmt.Errorf("couldn't read hdrl: %s", err.Error())
+					}
+					err = ret.parseHdrl(hdrl)
+					if err != nil {
+						return nil, fmt.Errorf("invalid hdrl: %s", err.Error())
+					}
+				case "movi":
+					movis = append(movis, movi{base: data, start: data + 4, end: chunkEnd})
+				}
+			case "idx1":
+				if form == "AVI " {
+					idx1, err = ret.readAt(data, chunkEnd-data)
+					if err != nil {
+						return nil, fmt.Errorf("couldn't read idx1: %s", err.Error())
+					}
+				}
+			}
+
+			pos = data + padded(size)
+		}
+		pos = end
+	}
+	if ret.streams == nil {
+		return nil, fmt.Errorf("no streams found")
+	}
+	if movis == nil {
+		return nil, fmt.Errorf("no movi list found")
+	}
+
+	openDML := false
+	for i := range ret.streams {
+		if ret.streams[i].superIndex != nil {
+			openDML = true
+		}
+	}
+	switch {
+	case openDML:
+		err = ret.readOpenDMLIndexes()
+	case idx1 != nil:
+		err = ret.parseIdx1(idx1, movis[0])
+	default:
+		err = ret.scanMovi(movis)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret.setTimestamps()
+
+	sort.SliceStable(ret.samples, func(i, j int) bool {
+		return ret.samples[i].offset < ret.samples[j].offset
+	})
+
+	return ret, nil
+}
+
+// Streams returns the streams in the file.
+func (d *Demuxer) Streams() []Stream {
+	return d.streams
+}
+
+// FFV1Stream returns the first FFV1 video stream in the file.
+func (d *Demuxer) FFV1Stream() (*Stream, error) {
+	for i := range d.streams {
+		if d.streams[i].Type == "vids" && d.streams[i].Compression == "FFV1" {
+			return &d.streams[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no FFV1 stream found")
+}
+
+// NewDecoder creates an FFV1 decoder for the first FFV1 stream in the
+// file, with the given options, which may be nil, and returns it along
+// with the stream. Packets for other streams should be skipped.
+func (d *Demuxer) NewDecoder(options *ffv1.DecoderOptions) (*ffv1.Decoder, *Stream, error) {
+	s, err := d.FFV1Stream()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec, err := ffv1.NewDecoderWithOptions(s.Extradata, s.Width, s.Height, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dec, s, nil
+}
+
+// ReadPacket returns the next packet, of any stream, in file order. It
+// returns io.EOF after the last packet.
+func (d *Demuxer) ReadPacket() (*Packet, error) {
+	if d.next >= len(d.samples) {
+		return nil, io.EOF
+	}
+	s := d.samples[d.next]
+	d.next++
+
+	data, err := d.readAt(s.offset, int64(s.size))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read packet: %s", err.Error())
+	}
+
+	return &Packet{
+		Stream:    s.stream,
+		Data:      data,
+		Timestamp: s.time,
+		Keyframe:  s.keyframe,
+	}, nil
+}
+
+func (d *Demuxer) readAt(pos int64, size int64) ([]byte, error) {
+	if size > maxChunkSize {
+		return nil, fmt.Errorf("chunk too large: %d bytes", size)
+	}
+	if pos < 0 || size < 0 || pos > d.fileSize || size > d.fileSize-pos {
+		return nil, fmt.Errorf("chunk overruns the file")
+	}
+	_, err := d.r.Seek(pos, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(d.r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+func (d *Demuxer) readChunkHeaderAt(pos int64) (string, int64, error) {
+	_, err := d.r.Seek(pos, io.SeekStart)
+	if err != nil {
+		return "", 0, err
+	}
+	id, size, err := readChunkHeader(d.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return id, size, err
+}
+
+// Parses the stream lists in the hdrl list.
+func (d *Demuxer) parseHdrl(data []byte) error {
+	return walkChunks(data, func(id string, list bool, data []byte) error {
+		if !list || id != "strl" {
+			return nil
+		}
+
+		s := Stream{Index: len(d.streams)}
+		err := walkChunks(data, func(id string, list bool, data []byte) error {
+			if list {
+				return nil
+			}
+			switch id {
+			case "strh":
+				if len(data) < 36 {
+					return fmt.Errorf("truncated stream header")
+				}
+				s.Type = string(data[0:4])
+				s.Handler = string(data[4:8])
+				s.Scale = binary.LittleEndian.Uint32(data[20:])
+				s.Rate = binary.LittleEndian.Uint32(data[24:])
+			case "strf":
+				s.Format = data
+			case "indx":
+				s.superIndex = data
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if s.Type == "vids" {
+			if len(s.Format) < bitmapInfoHeaderSize {
+				return fmt.Errorf("truncated BITMAPINFOHEADER")
+			}
+			// biHeight is negative for top-down images.
+			s.Width = binary.LittleEndian.Uint32(s.Format[4:])
+			h := int32(binary.LittleEndian.Uint32(s.Format[8:]))
+			if h < 0 {
+				h = -h
+			}
+			s.Height = uint32(h)
+			s.Compression = string(s.Format[16:20])
+			s.Extradata = s.Format[bitmapInfoHeaderSize:]
+		}
+
+		d.streams = append(d.streams, s)
+		return nil
+	})
+}
+
+// Reads the OpenDML standard indexes each super index points to.
+func (d *Demuxer) readOpenDMLIndexes() error {
+	for i := range d.streams {
+		super := d.streams[i].superIndex
+		if super == nil {
+			continue
+		}
+
+		entries, stride, err := indexEntries(super, indexOfIndexes, 24, 4)
+		if err != nil {
+			return fmt.Errorf("invalid super index: %s", err.Error())
+		}
+		for ; len(entries) >= 16; entries = entries[stride:] {
+			offset := int64(binary.LittleEndian.Uint64(entries[0:]))
+			id, size, err := d.readChunkHeaderAt(offset)
+			if err != nil {
+				return fmt.Errorf("couldn't read standard index: %s", err.Error())
+			}
+			if id[0:2] != "ix" && id != "indx" {
+				return fmt.Errorf("super index points to a '%s' chunk", id)
+			}
+			if size > d.fileSize-offset-chunkHeaderSize {
+				size = d.fileSize - offset - chunkHeaderSize
+			}
+			data, err := d.readAt(offset+chunkHeaderSize, size)
+			if err != nil {
+				return fmt.Errorf("couldn't read standard index: %s", err.Error())
+			}
+			err = d.parseStandardIndex(data, i)
+			if err != nil {
+				return fmt.Errorf("invalid standard index: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Parses an OpenDML standard index, whose entries hold the offsets of
+// chunk data relative to a base offset, and their sizes.
+func (d *Demuxer) parseStandardIndex(data []byte, stream int) error {
+	entries, stride, err := indexEntries(data, indexOfChunks, 24, 2)
+	if err != nil {
+		return err
+	}
+	base := int64(binary.LittleEndian.Uint64(data[12:]))
+
+	for ; len(entries) >= 8; entries = entries[stride:] {
+		offset := binary.LittleEndian.Uint32(entries[0:])
+		size := binary.LittleEndian.Uint32(entries[4:])
+		d.samples = append(d.samples, sample{
+			stream:   stream,
+			offset:   base + int64(offset),
+			size:     size &^ deltaFrame,
+			keyframe: size&deltaFrame == 0,
+		})
+	}
+	return nil
+}
+
+// Checks an OpenDML index's type, and returns its entries, and the size
+// of each entry, which must be at least minLongs 32-bit words.
+func indexEntries(data []byte, indexType byte, headerSize int, minLongs int) ([]byte, int, error) {
+	if len(data) < headerSize {
+		return nil, 0, fmt.Errorf("truncated index")
+	}
+	longs := int(binary.LittleEndian.Uint16(data[0:]))
+	if data[3] != indexType {
+		return nil, 0, fmt.Errorf("unexpected index type: %d", data[3])
+	}
+	if longs < minLongs {
+		return nil, 0, fmt.Errorf("invalid index entry size: %d", longs)
+	}
+	count := uint64(binary.LittleEndian.Uint32(data[4:]))
+	stride := longs * 4
+	if count*uint64(stride) > uint64(len(data)-headerSize) {
+		return nil, 0, fmt.Errorf("truncated index")
+	}
+	return data[headerSize : headerSize+int(count)*stride], stride, nil
+}
+
+// Parses an idx1 index. Its offsets point to chunk headers, and are
+// usually relative to the movi list, but some writers made them
+// absolute, which is checked against the first entry.
+func (d *Demuxer) parseIdx1(data []byte, m movi) error {
+	base := int64(-1)
+	for ; len(data) >= 16; data = data[16:] {
+		id := string(data[0:4])
+		stream, ok := streamNumber(id)
+		if !ok {
+			continue
+		}
+		if stream >= len(d.streams) {
+			return fmt.Errorf("index entry for unknown stream: %d", stream)
+		}
+		flags := binary.LittleEndian.Uint32(data[4:])
+		offset := int64(binary.LittleEndian.Uint32(data[8:]))
+		size := binary.LittleEndian.Uint32(data[12:])
+
+		if base == -1 {
+			base = m.base
+			hdr, err := d.readAt(base+offset, 4)
+			if err != nil || string(hdr) != id {
+				base = 0
+			}
+		}
+
+		d.samples = append(d.samples, sample{
+			stream:   stream,
+			offset:   base + offset + chunkHeaderSize,
+			size:     size,
+			keyframe: flags&idx1KeyFrame != 0,
+		})
+	}
+	return nil
+}
+
+// Finds the data chunks by walking the movi lists, for files without
+// an index.
+func (d *Demuxer) scanMovi(movis []movi) error {
+	for _, m := range movis {
+		for pos := m.start; pos+chunkHeaderSize <= m.end; {
+			id, size, err := d.readChunkHeaderAt(pos)
+			if err != nil {
+				return err
+			}
+
+			// Descend into rec lists.
+			if id == "LIST" {
+				pos += 12
+				continue
+			}
+
+			stream, ok := streamNumber(id)
+			if ok && stream < len(d.streams) && pos+chunkHeaderSize+size <= m.end {
+				d.samples = append(d.samples, sample{
+					stream:   stream,
+					offset:   pos + chunkHeaderSize,
+					size:     uint32(size),
+					keyframe: true,
+				})
+			}
+			pos += chunkHeaderSize + padded(size)
+		}
+	}
+	return nil
+}
+
+// Sets the timestamps of video frames from their positions in their
+// streams, which the samples are in order of.
+func (d *Demuxer) setTimestamps() {
+	frames := make([]uint64, len(d.streams))
+	for i := range d.samples {
+		s := &d.samples[i]
+		st := &d.streams[s.stream]
+		if st.Type == "vids" && st.Rate != 0 {
+			n := frames[s.stream]
+			rate := uint64(st.Rate)
+			scale := uint64(st.Scale)
+			s.time = time.Duration(n*scale/rate)*time.Second + time.Duration((n*scale%rate)*uint64(time.Second)/rate)
+		}
+		frames[s.stream]++
+	}
+}
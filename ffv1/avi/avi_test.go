@@ -0,0 +1,402 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/internal/ffv1test"
+)
+
+func le32(v ...uint32) []byte {
+	var buf []byte
+	for _, x := range v {
+		buf = append(buf, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+	}
+	return buf
+}
+
+func le64(v uint64) []byte {
+	return append(le32(uint32(v)), le32(uint32(v>>32))...)
+}
+
+func chunk(id string, data ...[]byte) []byte {
+	buf := append([]byte(id), le32(0)...)
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-chunkHeaderSize))
+	if len(buf)&1 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func list(typ string, chunks ...[]byte) []byte {
+	return chunk("LIST", append([][]byte{[]byte(typ)}, chunks...)...)
+}
+
+// Makes a stream header with a rate of 25 frames per second.
+func strh(typ string, handler string) []byte {
+	data := make([]byte, 56)
+	copy(data[0:], typ)
+	copy(data[4:], handler)
+	binary.LittleEndian.PutUint32(data[20:], 1)
+	binary.LittleEndian.PutUint32(data[24:], 25)
+	return chunk("strh", data)
+}
+
+// Makes the hdrl list of an FFV1 video stream, with the given super
+// index if not nil, and an audio stream.
+func hdrl(record []byte, indx []byte) []byte {
+	bih := make([]byte, bitmapInfoHeaderSize)
+	binary.LittleEndian.PutUint32(bih[0:], uint32(bitmapInfoHeaderSize+len(record)))
+	binary.LittleEndian.PutUint32(bih[4:], ffv1test.Width)
+	binary.LittleEndian.PutUint32(bih[8:], ffv1test.Height)
+	binary.LittleEndian.PutUint16(bih[12:], 1)
+	binary.LittleEndian.PutUint16(bih[14:], 24)
+	copy(bih[16:], "FFV1")
+
+	video := [][]byte{strh("vids", "FFV1"), chunk("strf", bih, record)}
+	if indx != nil {
+		video = append(video, chunk("indx", indx))
+	}
+	return list("hdrl",
+		chunk("avih", make([]byte, 56)),
+		list("strl", video...),
+		list("strl", strh("auds", ""), chunk("strf", make([]byte, 16))),
+	)
+}
+
+// How buildAVI indexes the file.
+const (
+	// No index, with each frame in a rec list with an audio chunk.
+	indexNone = iota
+	// An idx1 with offsets relative to the movi list.
+	indexRelative
+	// An idx1 with offsets from the start of the file.
+	indexAbsolute
+)
+
+// Builds an AVI file with an FFV1 stream and an audio stream, whose
+// chunks are interleaved.
+func buildAVI(record []byte, frames [][]byte, index int) []byte {
+	header := hdrl(record, nil)
+	// The position of the movi list type, after the RIFF header and
+	// the list header.
+	moviBase := int64(12 + len(header) + chunkHeaderSize)
+
+	movi := []byte("movi")
+	var idx1 []byte
+	add := func(id string, flags uint32, data []byte) {
+		offset := int64(len(movi))
+		if index == indexAbsolute {
+			offset += moviBase
+		}
+		idx1 = append(idx1, id...)
+		idx1 = append(idx1, le32(flags, uint32(offset), uint32(len(data)))...)
+		movi = append(movi, chunk(id, data)...)
+	}
+	for i, frame := range frames {
+		if index == indexNone {
+			movi = append(movi, list("rec ", chunk("00dc", frame), chunk("01wb", make([]byte, 7)))...)
+			continue
+		}
+		flags := uint32(0)
+		if i%2 == 0 {
+			flags = idx1KeyFrame
+		}
+		add("00dc", flags, frame)
+		add("01wb", idx1KeyFrame, make([]byte, 7))
+	}
+
+	riff := [][]byte{[]byte("AVI "), header, chunk("LIST", movi)}
+	if index != indexNone {
+		riff = append(riff, chunk("idx1", idx1))
+	}
+	return chunk("RIFF", riff...)
+}
+
+// A part of a sparse file.
+type segment struct {
+	offset int64
+	data   []byte
+}
+
+// Makes a RIFF chunk of an OpenDML file, at pos, with a movi list of
+// the given frames, starting with the first'th, followed by their
+// standard index, and a JUNK chunk of junk bytes, whose data is left
+// out. Returns the chunk and the position of the standard index.
+func openDMLRIFF(form string, pos int64, header []byte, frames [][]byte, first int, junk int64) ([]byte, int64) {
+	content := append([]byte(form), header...)
+	moviBase := pos + 12 + int64(len(header)) + chunkHeaderSize
+
+	movi := []byte("movi")
+	var entries []byte
+	for i, frame := range frames {
+		offset := moviBase + int64(len(movi)) + chunkHeaderSize
+		size := uint32(len(frame))
+		if (first+i)%2 != 0 {
+			size |= deltaFrame
+		}
+		entries = append(entries, le32(uint32(offset-moviBase), size)...)
+		movi = append(movi, chunk("00dc", frame)...)
+	}
+	ixPos := moviBase + int64(len(movi))
+
+	ix := []byte{2, 0, 0, indexOfChunks}
+	ix = append(ix, le32(uint32(len(frames)))...)
+	ix = append(ix, "00dc"...)
+	ix = append(ix, le64(uint64(moviBase))...)
+	ix = append(ix, le32(0)...)
+	ix = append(ix, entries...)
+	movi = append(movi, chunk("ix00", ix)...)
+	content = append(content, chunk("LIST", movi)...)
+
+	size := uint32(len(content))
+	if junk > 0 {
+		content = append(content, "JUNK"...)
+		content = append(content, le32(uint32(junk))...)
+		size = uint32(int64(len(content)) + junk)
+	}
+	return append(append([]byte("RIFF"), le32(size)...), content...), ixPos
+}
+
+// Builds an OpenDML file, with half of the frames in its AVI RIFF, and
+// the rest in an AVIX RIFF after gap bytes of JUNK, which must be even.
+// The super index points to the standard index of each.
+func buildOpenDML(record []byte, frames [][]byte, gap int64) ([]segment, int64) {
+	super := func(ix1 int64, ix2 int64) []byte {
+		indx := []byte{4, 0, 0, indexOfIndexes}
+		indx = append(indx, le32(2)...)
+		indx = append(indx, "00dc"...)
+		indx = append(indx, make([]byte, 12)...)
+		indx = append(indx, le64(uint64(ix1))...)
+		indx = append(indx, le32(0, 0)...)
+		indx = append(indx, le64(uint64(ix2))...)
+		indx = append(indx, le32(0, 0)...)
+		return indx
+	}
+
+	half := len(frames) / 2
+	// The header's size doesn't depend on the offsets in it.
+	riff1, ix1 := openDMLRIFF("AVI ", 0, hdrl(record, super(0, 0)), frames[:half], 0, gap)
+	pos2 := int64(len(riff1)) + gap
+	riff2, ix2 := openDMLRIFF("AVIX", pos2, nil, frames[half:], half, 0)
+	riff1, _ = openDMLRIFF("AVI ", 0, hdrl(record, super(ix1, ix2)), frames[:half], 0, gap)
+
+	return []segment{{0, riff1}, {pos2, riff2}}, pos2 + int64(len(riff2))
+}
+
+// A file of the given segments, and zeros between them.
+type sparseFile struct {
+	segments []segment
+	size     int64
+	pos      int64
+}
+
+func (f *sparseFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	end := f.size
+	for _, s := range f.segments {
+		if f.pos >= s.offset && f.pos < s.offset+int64(len(s.data)) {
+			n := copy(p, s.data[f.pos-s.offset:])
+			f.pos += int64(n)
+			return n, nil
+		}
+		if s.offset > f.pos && s.offset < end {
+			end = s.offset
+		}
+	}
+	if int64(len(p)) > end-f.pos {
+		p = p[:end-f.pos]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *sparseFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Demuxes and decodes every FFV1 frame of a file.
+func demux(t *testing.T, r io.ReadSeeker) []*Packet {
+	d, err := NewDemuxer(r)
+	if err != nil {
+		t.Fatalf("couldn't open file: %s", err.Error())
+	}
+	dec, s, err := d.NewDecoder(nil)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+	if s.Width != ffv1test.Width || s.Height != ffv1test.Height {
+		t.Errorf("stream is %dx%d, not %dx%d", s.Width, s.Height, ffv1test.Width, ffv1test.Height)
+	}
+
+	var packets []*Packet
+	for {
+		packet, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("couldn't read packet %d: %s", len(packets), err.Error())
+		}
+		if packet.Stream != s.Index {
+			continue
+		}
+		_, err = dec.DecodeFrame(packet.Data)
+		if err != nil {
+			t.Fatalf("couldn't decode packet %d: %s", len(packets), err.Error())
+		}
+		packets = append(packets, packet)
+	}
+
+	return packets
+}
+
+func checkPackets(t *testing.T, name string, packets []*Packet, frames [][]byte, keyframes bool) {
+	if len(packets) != len(frames) {
+		t.Errorf("%s: got %d packets, not %d", name, len(packets), len(frames))
+		return
+	}
+	for i, packet := range packets {
+		if !bytes.Equal(packet.Data, frames[i]) {
+			t.Errorf("%s: packet %d differs", name, i)
+		}
+		if want := time.Duration(i) * 40 * time.Millisecond; packet.Timestamp != want {
+			t.Errorf("%s: packet %d has timestamp %s, not %s", name, i, packet.Timestamp, want)
+		}
+		if want := !keyframes || i%2 == 0; packet.Keyframe != want {
+			t.Errorf("%s: packet %d has keyframe %t", name, i, packet.Keyframe)
+		}
+	}
+}
+
+func TestDemuxer(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 3)
+
+	tests := []struct {
+		name  string
+		index int
+	}{
+		{"relative idx1", indexRelative},
+		{"absolute idx1", indexAbsolute},
+		// Without an index, every frame is a keyframe.
+		{"scanned", indexNone},
+	}
+
+	for _, test := range tests {
+		packets := demux(t, bytes.NewReader(buildAVI(record, frames, test.index)))
+		checkPackets(t, test.name, packets, frames, test.index != indexNone)
+	}
+}
+
+func TestOpenDML(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 4)
+
+	segments, size := buildOpenDML(record, frames, 1<<30+1<<20)
+	if segments[1].offset <= 1<<30 {
+		t.Fatalf("AVIX is at %d", segments[1].offset)
+	}
+	packets := demux(t, &sparseFile{segments: segments, size: size})
+	checkPackets(t, "OpenDML", packets, frames, true)
+}
+
+// Chunk sizes in broken files must not be trusted for allocations.
+func TestLargeSize(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 2)
+
+	big := le32(1 << 29)
+
+	hdrlFile := chunk("RIFF", []byte("AVI "))
+	hdrlFile = append(hdrlFile, "LIST"...)
+	hdrlFile = append(hdrlFile, big...)
+	hdrlFile = append(hdrlFile, "hdrl"...)
+	binary.LittleEndian.PutUint32(hdrlFile[4:], uint32(len(hdrlFile)-chunkHeaderSize))
+
+	idx1File := buildAVI(record, frames, indexNone)
+	idx1File = append(idx1File, "idx1"...)
+	idx1File = append(idx1File, big...)
+	idx1File = append(idx1File, "00dc"...)
+	binary.LittleEndian.PutUint32(idx1File[4:], uint32(len(idx1File)-chunkHeaderSize))
+
+	packetFile := buildAVI(record, frames, indexRelative)
+	i := bytes.LastIndex(packetFile, []byte("00dc"))
+	copy(packetFile[i+12:], big)
+
+	segments, _ := buildOpenDML(record, frames, 0)
+	ixFile := append(append([]byte{}, segments[0].data...), segments[1].data...)
+	i = bytes.Index(ixFile, []byte("ix00"))
+	copy(ixFile[i+4:], big)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// A hdrl list which says it is 512 MiB.
+		{"hdrl", hdrlFile},
+		// An idx1 which says it is 512 MiB, but is cut off.
+		{"idx1", idx1File},
+		// An idx1 entry for a 512 MiB frame.
+		{"packet", packetFile},
+		// A standard index which says it is 512 MiB.
+		{"ix00", ixFile},
+	}
+
+	for _, test := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		d, err := NewDemuxer(bytes.NewReader(test.data))
+		for err == nil {
+			_, err = d.ReadPacket()
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+}
+
+// FuzzDemuxer demuxes arbitrary data, which must not panic, hang, or
+// allocate beyond what the data holds.
+func FuzzDemuxer(f *testing.F) {
+	record, frames := ffv1test.Essence(f, 2)
+	f.Add(buildAVI(record, frames, indexRelative))
+	f.Add(buildAVI(record, frames, indexNone))
+	segments, _ := buildOpenDML(record, frames, 0)
+	f.Add(append(append([]byte{}, segments[0].data...), segments[1].data...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := NewDemuxer(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		d.NewDecoder(nil)
+		for {
+			packet, err := d.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(packet.Data) > len(data) {
+				t.Fatalf("packet of %d bytes from %d bytes of data", len(packet.Data), len(data))
+			}
+		}
+	})
+}
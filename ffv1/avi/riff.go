@@ -0,0 +1,68 @@
+package avi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Size of a chunk header: its FourCC, and its size.
+const chunkHeaderSize = 8
+
+// Reads a chunk header from r.
+func readChunkHeader(r io.Reader) (string, int64, error) {
+	var hdr [chunkHeaderSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return "", 0, err
+	}
+	return string(hdr[0:4]), int64(binary.LittleEndian.Uint32(hdr[4:])), nil
+}
+
+// Chunks are padded to an even size.
+func padded(size int64) int64 {
+	return size + size&1
+}
+
+// Walks the chunks in a list's data. For lists, id is the list type, and
+// list is true.
+func walkChunks(data []byte, fn func(id string, list bool, data []byte) error) error {
+	for len(data) >= chunkHeaderSize {
+		id := string(data[0:4])
+		size := uint64(binary.LittleEndian.Uint32(data[4:]))
+		data = data[chunkHeaderSize:]
+		if size > uint64(len(data)) {
+			return fmt.Errorf("chunk '%s' overruns its parent", id)
+		}
+		chunk := data[:size]
+		if size&1 != 0 && size < uint64(len(data)) {
+			size++
+		}
+		data = data[size:]
+
+		list := false
+		if id == "LIST" {
+			if len(chunk) < 4 {
+				return fmt.Errorf("truncated list")
+			}
+			id = string(chunk[0:4])
+			chunk = chunk[4:]
+			list = true
+		}
+
+		err := fn(id, list, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Works out the stream number of a data chunk from its FourCC, e.g.
+// 1 for '01dc'. Other chunks, such as index chunks, return false.
+func streamNumber(id string) (int, bool) {
+	if len(id) != 4 || id[0] < '0' || id[0] > '9' || id[1] < '0' || id[1] > '9' {
+		return 0, false
+	}
+	return int(id[0]-'0')*10 + int(id[1]-'0'), true
+}
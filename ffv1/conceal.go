@@ -0,0 +1,224 @@
+package ffv1
+
+import (
+	"image"
+)
+
+// Conceals a slice that failed to decode, by copying the co-located
+// area from the previous frame, or filling it with a neutral value if
+// there is no usable previous frame, and returns the area concealed.
+func (d *Decoder) concealSlice(frame *Frame, slicenum int) image.Rectangle {
+	rect := d.sliceRect(slicenum)
+	if rect.Empty() {
+		return rect
+	}
+
+	prev := d.prev_frame
+	if prev != nil && !sameFormat(prev, frame) {
+		prev = nil
+	}
+
+	for p := 0; p < numFramePlanes(frame); p++ {
+		r, stride := planeRect(frame, rect, p)
+
+		alpha := frame.HasAlpha && p == numFramePlanes(frame)-1
+		if frame.Buf != nil {
+			if prev != nil {
+				copyRect8(frame.Buf[p], prev.Buf[p], r, stride)
+			} else {
+				neutral := byte(128)
+				if alpha {
+					neutral = 255
+				}
+				fillRect8(frame.Buf[p], neutral, r, stride)
+			}
+		}
+		if frame.Buf16 != nil {
+			if prev != nil {
+				copyRect16(frame.Buf16[p], prev.Buf16[p], r, stride)
+			} else {
+				neutral := uint16(1) << (frame.BitDepth - 1)
+				if alpha {
+					neutral = uint16((uint32(1) << frame.BitDepth) - 1)
+				}
+				fillRect16(frame.Buf16[p], neutral, r, stride)
+			}
+		}
+		if frame.BufFloat16 != nil {
+			if prev != nil {
+				copyRect16(frame.BufFloat16[p], prev.BufFloat16[p], r, stride)
+			} else {
+				// 0.5 and 1.0, as half-precision floats.
+				neutral := uint16(0x3800)
+				if alpha {
+					neutral = 0x3C00
+				}
+				fillRect16(frame.BufFloat16[p], neutral, r, stride)
+			}
+		}
+	}
+
+	return rect
+}
+
+// Works out the area covered by a slice that failed to decode. The
+// slice header is used if it was parsed before the failure. If not,
+// the last area the slice decoded successfully to is used, and failing
+// that, its position on the slice grid, assuming raster order.
+func (d *Decoder) sliceRect(slicenum int) image.Rectangle {
+	frameRect := image.Rect(0, 0, int(d.width), int(d.height))
+
+	s := &d.current_frame.slices[slicenum]
+	if s.width != 0 && s.height != 0 {
+		return sliceToRect(s).Intersect(frameRect)
+	}
+
+	if slicenum < len(d.slice_rects) && !d.slice_rects[slicenum].Empty() {
+		return d.slice_rects[slicenum]
+	}
+
+	num_h_slices := int(d.record.num_h_slices_minus1) + 1
+	num_v_slices := int(d.record.num_v_slices_minus1) + 1
+	if slicenum >= num_h_slices*num_v_slices {
+		return image.Rectangle{}
+	}
+
+	var grid slice
+	grid.header.slice_x = uint32(slicenum % num_h_slices)
+	grid.header.slice_y = uint32(slicenum / num_h_slices)
+	sliceBounds(&d.record, d.width, d.height, &grid)
+
+	return sliceToRect(&grid).Intersect(frameRect)
+}
+
+// Remembers the area a slice decoded to, for concealing it later.
+func (d *Decoder) rememberSliceRect(slicenum int) {
+	for len(d.slice_rects) <= slicenum {
+		d.slice_rects = append(d.slice_rects, image.Rectangle{})
+	}
+
+	frameRect := image.Rect(0, 0, int(d.width), int(d.height))
+	d.slice_rects[slicenum] = sliceToRect(&d.current_frame.slices[slicenum]).Intersect(frameRect)
+}
+
+func sliceToRect(s *slice) image.Rectangle {
+	return image.Rect(int(s.start_x), int(s.start_y), int(s.start_x+s.width), int(s.start_y+s.height))
+}
+
+// Scales a luma area to plane p, as planeOwnedSize does: rounding
+// down, except at the edges of the plane.
+func planeRect(frame *Frame, rect image.Rectangle, p int) (image.Rectangle, int) {
+	if !frame.HasChroma || (p != 1 && p != 2) {
+		return rect, int(frame.Width)
+	}
+
+	h := uint(frame.ChromaSubsampleH)
+	v := uint(frame.ChromaSubsampleV)
+	ceil := func(x int, shift uint) int {
+		return (x + (1 << shift) - 1) >> shift
+	}
+
+	r := image.Rect(rect.Min.X>>h, rect.Min.Y>>v, rect.Max.X>>h, rect.Max.Y>>v)
+	if rect.Max.X >= int(frame.Width) {
+		r.Max.X = ceil(int(frame.Width), h)
+	}
+	if rect.Max.Y >= int(frame.Height) {
+		r.Max.Y = ceil(int(frame.Height), v)
+	}
+
+	return r, ceil(int(frame.Width), h)
+}
+
+func numFramePlanes(frame *Frame) int {
+	numPlanes := 1
+	if frame.HasChroma {
+		numPlanes += 2
+	}
+	if frame.HasAlpha {
+		numPlanes++
+	}
+	return numPlanes
+}
+
+func sameFormat(a *Frame, b *Frame) bool {
+	return a.Width == b.Width && a.Height == b.Height && a.BitDepth == b.BitDepth &&
+		a.ColorSpace == b.ColorSpace && a.HasChroma == b.HasChroma && a.HasAlpha == b.HasAlpha &&
+		a.ChromaSubsampleH == b.ChromaSubsampleH && a.ChromaSubsampleV == b.ChromaSubsampleV &&
+		a.Float == b.Float
+}
+
+func copyRect8(dst []byte, src []byte, r image.Rectangle, stride int) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(dst[y*stride+r.Min.X:y*stride+r.Max.X], src[y*stride+r.Min.X:y*stride+r.Max.X])
+	}
+}
+
+func copyRect16(dst []uint16, src []uint16, r image.Rectangle, stride int) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(dst[y*stride+r.Min.X:y*stride+r.Max.X], src[y*stride+r.Min.X:y*stride+r.Max.X])
+	}
+}
+
+func fillRect8(dst []byte, v byte, r image.Rectangle, stride int) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst[y*stride+x] = v
+		}
+	}
+}
+
+func fillRect16(dst []uint16, v uint16, r image.Rectangle, stride int) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst[y*stride+x] = v
+		}
+	}
+}
+
+// Makes a deep copy of a frame's image data, to conceal from later,
+// reusing the planes of dst, if any.
+func copyFrameInto(dst *Frame, src *Frame) *Frame {
+	if dst == nil {
+		dst = new(Frame)
+	}
+	buf, buf16, bufFloat16 := dst.Buf, dst.Buf16, dst.BufFloat16
+	*dst = *src
+	dst.Buf, dst.Buf16, dst.BufFloat16, dst.Concealed = nil, nil, nil, nil
+
+	if src.Buf != nil {
+		dst.Buf = reusePlanes8(buf, planeLens8(src.Buf))
+		for p := range src.Buf {
+			copy(dst.Buf[p], src.Buf[p])
+		}
+	}
+	if src.Buf16 != nil {
+		dst.Buf16 = reusePlanes16(buf16, planeLens16(src.Buf16))
+		for p := range src.Buf16 {
+			copy(dst.Buf16[p], src.Buf16[p])
+		}
+	}
+	if src.BufFloat16 != nil {
+		dst.BufFloat16 = reusePlanes16(bufFloat16, planeLens16(src.BufFloat16))
+		for p := range src.BufFloat16 {
+			copy(dst.BufFloat16[p], src.BufFloat16[p])
+		}
+	}
+
+	return dst
+}
+
+func planeLens8(planes [][]byte) []int {
+	sizes := make([]int, len(planes))
+	for p := range planes {
+		sizes[p] = len(planes[p])
+	}
+	return sizes
+}
+
+func planeLens16(planes [][]uint16) []int {
+	sizes := make([]int, len(planes))
+	for p := range planes {
+		sizes[p] = len(planes[p])
+	}
+	return sizes
+}
@@ -0,0 +1,107 @@
+package ffv1
+
+import (
+	"image"
+	"testing"
+)
+
+func TestConceal(t *testing.T) {
+	tests := []struct {
+		name  string
+		alpha bool
+		// The frame with a broken slice.
+		broken int
+		// The number of slices concealed in each frame.
+		concealed []int
+	}{
+		{"previous frame", false, 1, []int{0, 1, 0}},
+		// The slice's contexts are lost until the next keyframe.
+		{"no previous frame", false, 0, []int{1, 1, 0}},
+		{"alpha", true, 0, []int{1, 1, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := EncoderOptions{
+				Width:            32,
+				Height:           32,
+				HasChroma:        true,
+				HasAlpha:         test.alpha,
+				ChromaSubsampleH: 1,
+				ChromaSubsampleV: 1,
+				SlicesH:          2,
+				SlicesV:          2,
+				GOPSize:          2,
+				EC:               true,
+			}
+			e, err := NewEncoder(opts)
+			if err != nil {
+				t.Fatalf("couldn't create encoder: %s", err.Error())
+			}
+			d, err := NewDecoderWithOptions(e.Record(), opts.Width, opts.Height, &DecoderOptions{Conceal: true})
+			if err != nil {
+				t.Fatalf("couldn't create decoder: %s", err.Error())
+			}
+
+			var prev *Frame
+			for n := range test.concealed {
+				in := testFrame(opts, n)
+				packet, err := e.EncodeFrame(in)
+				if err != nil {
+					t.Fatalf("frame %d: couldn't encode: %s", n, err.Error())
+				}
+				if n == test.broken {
+					// Past the start of the range coder, which holds
+					// the keyframe flag, but within the first slice.
+					packet[3] ^= 0xFF
+				}
+
+				out, err := d.DecodeFrame(packet)
+				if err != nil {
+					t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+				}
+				if len(out.Concealed) != test.concealed[n] {
+					t.Fatalf("frame %d: %d slices concealed, not %d", n, len(out.Concealed), test.concealed[n])
+				}
+				checkConcealed(t, n, in, out, prev)
+				prev = out
+			}
+		})
+	}
+}
+
+// Checks that the concealed areas of out are copied from prev, or are
+// neutral if there is none, and that the rest is unchanged from in.
+func checkConcealed(t *testing.T, n int, in *Frame, out *Frame, prev *Frame) {
+	t.Helper()
+
+	for p := range in.Buf {
+		var rects []image.Rectangle
+		stride := 0
+		for _, rect := range out.Concealed {
+			var r image.Rectangle
+			r, stride = planeRect(out, rect, p)
+			rects = append(rects, r)
+		}
+
+		for i := range in.Buf[p] {
+			want := in.Buf[p][i]
+			for _, r := range rects {
+				if !image.Pt(i%stride, i/stride).In(r) {
+					continue
+				}
+				switch {
+				case prev != nil:
+					want = prev.Buf[p][i]
+				case p == 3:
+					want = 255
+				default:
+					want = 128
+				}
+			}
+			if out.Buf[p][i] != want {
+				t.Fatalf("frame %d: plane %d sample %d is %d, not %d", n, p, i, out.Buf[p][i], want)
+			}
+		}
+	}
+}
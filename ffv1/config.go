@@ -0,0 +1,317 @@
+package ffv1
+
+import (
+	"fmt"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// ConfigRecord contains the parameters of an FFV1 stream, as coded in
+// its configuration record, or, for versions 0 and 1, in its keyframes.
+//
+// See: * 4.1. Parameters
+//      * 4.2. Configuration Record
+type ConfigRecord struct {
+	// The FFV1 version (0-4).
+	Version uint8
+	// The minor version. Zero for versions before 3.
+	MicroVersion uint8
+	// The coder type: 0 for Golomb-Rice, 1 for the range coder with the
+	// default state transition table, and 2 for the range coder with a
+	// custom one.
+	CoderType uint8
+	// The deltas from the default state transition table. Only used if
+	// CoderType is 2. Element zero is unused.
+	StateTransitionDelta [256]int16
+	// The colorspace. See the ColorSpace constants.
+	ColorSpace int
+	// Bits per sample (8-16).
+	BitsPerRawSample uint8
+	// Whether or not chroma planes are present.
+	ChromaPlanes bool
+	// The log2 horizontal chroma subsampling value.
+	Log2HChromaSubsample uint8
+	// The log2 vertical chroma subampling value.
+	Log2VChromaSubsample uint8
+	// Whether or not an alpha plane is present.
+	ExtraPlane bool
+	// The number of slices horizontally and vertically. For version 2,
+	// the slice layout is in each keyframe instead.
+	NumHSlices int
+	NumVSlices int
+	// The quantization table sets, each with one table per context
+	// input.
+	QuantTables [][maxContextInputs][256]int16
+	// The number of contexts of each quantization table set.
+	ContextCount []int32
+	// The initial context state deltas of each quantization table set,
+	// indexed by set, context, and state. All zero if the states are
+	// not coded. See InitialStates.
+	InitialStateDelta [][][]int16
+	// Whether or not slices have CRCs and error_status. Zero for
+	// versions before 3.
+	EC uint8
+	// Whether or not every frame is a keyframe. Zero for versions
+	// before 3.
+	Intra uint8
+	// Whether or not the samples are 16-bit floats.
+	Float bool
+}
+
+// ParseConfigRecord parses an FFV1 configuration record, such as the
+// codec private data passed to NewDecoder, without creating a decoder.
+//
+// It can be used to check a stream's parameters before decoding any
+// frames. Versions 0 and 1 have no configuration record.
+func ParseConfigRecord(record []byte) (*ConfigRecord, error) {
+	var r configRecord
+	err := parseConfigRecord(record, &r, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration record: %w", err)
+	}
+	return exportConfigRecord(&r), nil
+}
+
+// Probe returns the parameters of a stream without creating a decoder,
+// from its configuration record, or if there is none, as for versions
+// 0 and 1, from the first packet, which must be a keyframe. The packet
+// is not used if there is a configuration record, and may be nil.
+//
+// See: 4.3. Frame
+func Probe(record []byte, packet []byte) (*ConfigRecord, error) {
+	if len(record) != 0 {
+		return ParseConfigRecord(record)
+	}
+
+	c := rangecoder.NewCoder(packet)
+
+	// 4. Bitstream
+	state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		state[i] = 128
+	}
+
+	if !c.BR(state) {
+		return nil, fmt.Errorf("first packet is not a keyframe")
+	}
+	var r configRecord
+	err := parseKeyframeHeader(c, &r, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyframe header: %w", err)
+	}
+	return exportConfigRecord(&r), nil
+}
+
+// Config returns the parameters of the stream being decoded.
+//
+// For versions 0 and 1, they are read from each keyframe, so this
+// returns nil until the first keyframe is decoded, and may change at
+// every keyframe after it. Use Probe to read them beforehand.
+func (d *Decoder) Config() *ConfigRecord {
+	if d.record.quant_table_set_count == 0 {
+		return nil
+	}
+	return exportConfigRecord(&d.record)
+}
+
+// InitialStates returns the initial context states of each quantization
+// table set, derived from InitialStateDelta.
+//
+// See: 4.1.15. initial_state_delta
+func (r *ConfigRecord) InitialStates() [][][]uint8 {
+	record := configRecord{initial_state_delta: r.InitialStateDelta}
+	_, initial_states := initialStates(&record)
+	return initial_states
+}
+
+// Copies an internal configuration record into a ConfigRecord.
+func exportConfigRecord(record *configRecord) *ConfigRecord {
+	ret := &ConfigRecord{
+		Version:              record.version,
+		MicroVersion:         record.micro_version,
+		CoderType:            record.coder_type,
+		StateTransitionDelta: record.state_transition_delta,
+		ColorSpace:           int(record.colorspace_type),
+		BitsPerRawSample:     record.bits_per_raw_sample,
+		ChromaPlanes:         record.chroma_planes,
+		Log2HChromaSubsample: record.log2_h_chroma_subsample,
+		Log2VChromaSubsample: record.log2_v_chroma_subsample,
+		ExtraPlane:           record.extra_plane,
+		NumHSlices:           int(record.num_h_slices_minus1) + 1,
+		NumVSlices:           int(record.num_v_slices_minus1) + 1,
+		EC:                   record.ec,
+		Intra:                record.intra,
+		Float:                record.flt,
+	}
+
+	count := int(record.quant_table_set_count)
+	ret.QuantTables = make([][maxContextInputs][256]int16, count)
+	copy(ret.QuantTables, record.quant_tables[:count])
+	ret.ContextCount = make([]int32, count)
+	copy(ret.ContextCount, record.context_count[:count])
+
+	ret.InitialStateDelta = make([][][]int16, len(record.initial_state_delta))
+	for i := range record.initial_state_delta {
+		ret.InitialStateDelta[i] = make([][]int16, len(record.initial_state_delta[i]))
+		for j := range record.initial_state_delta[i] {
+			ret.InitialStateDelta[i][j] = append([]int16(nil), record.initial_state_delta[i][j]...)
+		}
+	}
+
+	return ret
+}
+
+// MarshalBinary writes the configuration record, range coded in the
+// same order ParseConfigRecord reads it, followed by its CRC parity for
+// versions 3 and up. It implements encoding.BinaryMarshaler.
+//
+// Initial states are only coded for quantization table sets which have
+// non-zero deltas. Versions 0 and 1 have no configuration record.
+//
+// See: 4.2. Configuration Record
+func (r *ConfigRecord) MarshalBinary() ([]byte, error) {
+	var record configRecord
+	err := importConfigRecord(r, &record)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration record: %w", err)
+	}
+	buf := writeConfigRecord(&record)
+
+	// Catch any parameters the parser would refuse, such as subsampled
+	// RGB, rather than checking them all twice.
+	var check configRecord
+	err = parseConfigRecord(buf, &check, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration record: %w", err)
+	}
+
+	return buf, nil
+}
+
+// Copies a ConfigRecord into an internal configuration record, checking
+// that it can be coded.
+func importConfigRecord(r *ConfigRecord, record *configRecord) error {
+	if r.Version < 2 || r.Version > 4 {
+		return fmt.Errorf("FFV1 version %d has no configuration record", r.Version)
+	}
+	if r.Version >= 3 && r.MicroVersion < 1 {
+		return fmt.Errorf("%w: micro_version %d", ErrUnsupportedVersion, r.MicroVersion)
+	}
+	if r.CoderType > 2 {
+		return fmt.Errorf("invalid coder_type: %d", r.CoderType)
+	}
+	if r.ColorSpace != YCbCr && r.ColorSpace != RGB {
+		return fmt.Errorf("invalid colorspace_type: %d", r.ColorSpace)
+	}
+	if r.NumHSlices < 1 || r.NumHSlices > 256 || r.NumVSlices < 1 || r.NumVSlices > 256 {
+		return fmt.Errorf("invalid slice count: %dx%d", r.NumHSlices, r.NumVSlices)
+	}
+
+	count := len(r.QuantTables)
+	if count == 0 {
+		return fmt.Errorf("quant_table_set_count may not be zero")
+	} else if count > maxQuantTables {
+		return fmt.Errorf("too many quant tables: %d > %d", count, maxQuantTables)
+	}
+	if len(r.ContextCount) != count {
+		return fmt.Errorf("%d context counts for %d quant table sets", len(r.ContextCount), count)
+	}
+	if len(r.InitialStateDelta) != 0 && len(r.InitialStateDelta) != count {
+		return fmt.Errorf("%d initial state sets for %d quant table sets", len(r.InitialStateDelta), count)
+	}
+	for i := 0; i < count; i++ {
+		context_count, err := quantTableSetContextCount(&r.QuantTables[i])
+		if err != nil {
+			return err
+		}
+		if context_count != r.ContextCount[i] {
+			return fmt.Errorf("context count %d does not match quant table set %d, which has %d", r.ContextCount[i], i, context_count)
+		}
+		if len(r.InitialStateDelta) == 0 {
+			continue
+		}
+		if len(r.InitialStateDelta[i]) != int(context_count) {
+			return fmt.Errorf("%d initial states for %d contexts", len(r.InitialStateDelta[i]), context_count)
+		}
+		for j := range r.InitialStateDelta[i] {
+			if len(r.InitialStateDelta[i][j]) != contextSize {
+				return fmt.Errorf("initial states must have %d entries", contextSize)
+			}
+		}
+	}
+
+	*record = configRecord{
+		version:                 r.Version,
+		micro_version:           r.MicroVersion,
+		coder_type:              r.CoderType,
+		state_transition_delta:  r.StateTransitionDelta,
+		colorspace_type:         uint8(r.ColorSpace),
+		bits_per_raw_sample:     r.BitsPerRawSample,
+		chroma_planes:           r.ChromaPlanes,
+		log2_h_chroma_subsample: r.Log2HChromaSubsample,
+		log2_v_chroma_subsample: r.Log2VChromaSubsample,
+		extra_plane:             r.ExtraPlane,
+		num_h_slices_minus1:     uint8(r.NumHSlices - 1),
+		num_v_slices_minus1:     uint8(r.NumVSlices - 1),
+		quant_table_set_count:   uint8(count),
+		ec:                      r.EC,
+		intra:                   r.Intra,
+		flt:                     r.Float,
+	}
+	if r.Version < 3 {
+		record.micro_version = 0
+		record.ec = 0
+		record.intra = 0
+	}
+	// Neither would be coded, so would silently be lost.
+	if r.CoderType < 2 && r.StateTransitionDelta != [256]int16{} {
+		return fmt.Errorf("state_transition_delta requires coder_type 2, not %d", r.CoderType)
+	}
+	if r.Float && !hasRemap(record) {
+		return fmt.Errorf("float samples require version 4.4 or later, not %d.%d", record.version, record.micro_version)
+	}
+	copy(record.quant_tables[:], r.QuantTables)
+	copy(record.context_count[:], r.ContextCount)
+	if len(r.InitialStateDelta) != 0 {
+		record.initial_state_delta = r.InitialStateDelta
+	} else {
+		allocateInitialStateDelta(record)
+	}
+
+	return nil
+}
+
+// Works out the context count of a quantization table set, as
+// parseQuantTableSet does, checking that each table is one it could
+// have read: non-decreasing steps of one level, times the product of
+// the level counts of the tables before it, mirrored for negative
+// differences.
+//
+// See: 4.9.  Quantization Table Set
+func quantTableSetContextCount(tables *[maxContextInputs][256]int16) (int32, error) {
+	scale := 1
+	for j := 0; j < maxContextInputs; j++ {
+		table := &tables[j]
+		if table[0] != 0 {
+			return 0, fmt.Errorf("quant table %d does not start at zero", j)
+		}
+		v := 1
+		for k := 1; k < 128; k++ {
+			if int(table[k]) == scale*v {
+				v++
+			} else if int(table[k]) != scale*(v-1) {
+				return 0, fmt.Errorf("quant table %d cannot be coded", j)
+			}
+		}
+		for k := 1; k < 128; k++ {
+			if table[256-k] != -table[k] {
+				return 0, fmt.Errorf("quant table %d is not symmetric", j)
+			}
+		}
+		if table[128] != -table[127] {
+			return 0, fmt.Errorf("quant table %d is not symmetric", j)
+		}
+		scale *= 2*v - 1
+	}
+	return int32((scale + 1) / 2), nil
+}
@@ -2,9 +2,11 @@ package ffv1
 
 // Internal constants.
 const (
-	maxQuantTables   = 8  // Only defined in FFmpeg?
-	maxContextInputs = 5  // 4.9. Quantization Table Set
-	contextSize      = 32 // 4.1. Parameters
+	maxQuantTables     = 8     // Only defined in FFmpeg?
+	maxContextInputs   = 5     // 4.9. Quantization Table Set
+	contextSize        = 32    // 4.1. Parameters
+	maxContextCount    = 16384 // Per quantization table set, as in FFmpeg
+	maxChromaSubsample = 4     // Larger values make no sense in practice
 )
 
 // API constants.
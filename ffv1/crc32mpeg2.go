@@ -58,3 +58,13 @@ var crc32table = &crc32.Table{
 func crc32MPEG2(buf []byte) uint32 {
 	return ^crc32.Update(^uint32(0), crc32table, buf)
 }
+
+// Appends the CRC parity for buf, such that crc32MPEG2 of the
+// returned buffer is zero.
+//
+// See: * 4.2.2. configuration_record_crc_parity
+//      * 4.8.3. slice_crc_parity
+func appendCRCParity(buf []byte) []byte {
+	crc := crc32MPEG2(buf)
+	return append(buf, byte(crc), byte(crc>>8), byte(crc>>16), byte(crc>>24))
+}
@@ -0,0 +1,314 @@
+package ffv1
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// Encoder is a FFV1 encoder instance.
+type Encoder struct {
+	width            uint32
+	height           uint32
+	gop_size         int
+	frame_number     int
+	record           configRecord
+	state_transition [256]uint8
+	initial_states   [][][]uint8
+	slices           []slice
+	extradata        []byte
+}
+
+// EncoderOptions contains the parameters of a stream to be encoded.
+//
+// Currently, only 8-bit YCbCr is supported.
+type EncoderOptions struct {
+	// Width of the frames, in pixels.
+	Width uint32
+	// Height of the frames, in pixels.
+	Height uint32
+	// BitDepth of the frames. Must be 8, or zero for the default of 8.
+	BitDepth uint8
+	// ColorSpace of the frames. See the ColorSpace constants.
+	ColorSpace int
+	// Whether or not chroma planes are present.
+	HasChroma bool
+	// Whether or not an alpha plane is present. Requires HasChroma.
+	HasAlpha bool
+	// The log2 vertical chroma subampling value.
+	ChromaSubsampleV uint8
+	// The log2 horizontal chroma subsampling value.
+	ChromaSubsampleH uint8
+	// Number of horizontal slices. Zero means one.
+	SlicesH int
+	// Number of vertical slices. Zero means one.
+	SlicesV int
+	// Keyframe interval. Zero or one means every frame is a keyframe.
+	GOPSize int
+	// Whether or not slices carry a CRC and error status.
+	//
+	// See: 4.1.16. ec
+	EC bool
+	// Whether or not to use Golomb-Rice coding for the sample
+	// differences instead of the range coder.
+	//
+	// See: 3.8.2. Golomb Rice Mode
+	GolombRice bool
+	// Custom state transition table for the range coder. If nil, the
+	// default table is used. May not be used with GolombRice.
+	//
+	// See: * 3.8.1.4. State Transition Table
+	//      * 4.1.4. state_transition_delta
+	StateTransition *[256]uint8
+}
+
+// Run lengths for the first half of the default quantization table.
+//
+// This gives 11 levels, much like the tables FFmpeg uses.
+var defaultQuantRuns = []int{1, 1, 3, 7, 16, 100}
+
+// NewEncoder creates a new FFV1 version 3 encoder instance.
+//
+// With chroma subsampling, slice grids whose last slice starts part
+// way through a chroma sample, and would so leave the last chroma row
+// or column uncoded, are refused.
+//
+// The configuration record, to be stored by the container, is
+// available from Record.
+func NewEncoder(opts EncoderOptions) (*Encoder, error) {
+	ret := new(Encoder)
+
+	if opts.Width == 0 || opts.Height == 0 {
+		return nil, fmt.Errorf("invalid dimensions: %dx%d", opts.Width, opts.Height)
+	}
+	if opts.BitDepth == 0 {
+		opts.BitDepth = 8
+	}
+	if opts.BitDepth != 8 {
+		return nil, fmt.Errorf("unsupported bit depth: %d", opts.BitDepth)
+	}
+	if opts.ColorSpace != YCbCr {
+		return nil, fmt.Errorf("unsupported colorspace: %d", opts.ColorSpace)
+	}
+	if opts.HasAlpha && !opts.HasChroma {
+		return nil, fmt.Errorf("alpha requires chroma planes")
+	}
+	if opts.ChromaSubsampleH > 4 || opts.ChromaSubsampleV > 4 {
+		return nil, fmt.Errorf("invalid chroma subsampling: %d, %d", opts.ChromaSubsampleH, opts.ChromaSubsampleV)
+	}
+	if opts.GolombRice && opts.StateTransition != nil {
+		return nil, fmt.Errorf("golomb-rice mode cannot have a custom state transition table")
+	}
+	if opts.SlicesH == 0 {
+		opts.SlicesH = 1
+	}
+	if opts.SlicesV == 0 {
+		opts.SlicesV = 1
+	}
+	if opts.SlicesH < 0 || opts.SlicesH > 256 || uint32(opts.SlicesH) > opts.Width ||
+		opts.SlicesV < 0 || opts.SlicesV > 256 || uint32(opts.SlicesV) > opts.Height {
+		return nil, fmt.Errorf("invalid slice count: %dx%d", opts.SlicesH, opts.SlicesV)
+	}
+	if opts.HasChroma && (!chromaSlicesCover(opts.Width, opts.SlicesH, opts.ChromaSubsampleH) ||
+		!chromaSlicesCover(opts.Height, opts.SlicesV, opts.ChromaSubsampleV)) {
+		return nil, fmt.Errorf("%dx%d slices cannot code every chroma sample of a %dx%d frame", opts.SlicesH, opts.SlicesV, opts.Width, opts.Height)
+	}
+
+	ret.width = opts.Width
+	ret.height = opts.Height
+	ret.gop_size = opts.GOPSize
+
+	// 4.1. Parameters
+	ret.record.version = 3
+	ret.record.micro_version = 4
+	ret.record.coder_type = 1
+	if opts.GolombRice {
+		ret.record.coder_type = 0
+	} else if opts.StateTransition != nil {
+		ret.record.coder_type = 2
+		for i := 1; i < 256; i++ {
+			ret.record.state_transition_delta[i] = int16(opts.StateTransition[i]) - int16(rangecoder.DefaultStateTransition[i])
+		}
+	}
+	ret.record.colorspace_type = uint8(opts.ColorSpace)
+	ret.record.bits_per_raw_sample = opts.BitDepth
+	ret.record.chroma_planes = opts.HasChroma
+	if opts.HasChroma {
+		ret.record.log2_h_chroma_subsample = opts.ChromaSubsampleH
+		ret.record.log2_v_chroma_subsample = opts.ChromaSubsampleV
+	}
+	ret.record.extra_plane = opts.HasAlpha
+	ret.record.num_h_slices_minus1 = uint8(opts.SlicesH - 1)
+	ret.record.num_v_slices_minus1 = uint8(opts.SlicesV - 1)
+	if opts.EC {
+		ret.record.ec = 1
+	}
+	if opts.GOPSize <= 1 {
+		ret.record.intra = 1
+	}
+
+	// One quantization table set per quant_table_set_index, so that
+	// each index matches the plane it is used for.
+	//
+	// See: 4.9. Quantization Table Set
+	ret.record.quant_table_set_count = uint8(quantTableSetIndexCount(&ret.record))
+	for i := 0; i < int(ret.record.quant_table_set_count); i++ {
+		scale := 1
+		for j := 0; j < 3; j++ {
+			levels := makeQuantTable(&ret.record.quant_tables[i][j], defaultQuantRuns, scale)
+			scale *= levels
+		}
+		ret.record.context_count[i] = int32((scale + 1) / 2)
+	}
+
+	allocateInitialStateDelta(&ret.record)
+
+	ret.state_transition, ret.initial_states = initialStates(&ret.record)
+
+	ret.extradata = writeConfigRecord(&ret.record)
+
+	// Slices are laid out in raster order on the slice grid.
+	ret.slices = make([]slice, opts.SlicesH*opts.SlicesV)
+	for i := 0; i < len(ret.slices); i++ {
+		s := &ret.slices[i]
+		s.header.slice_x = uint32(i % opts.SlicesH)
+		s.header.slice_y = uint32(i / opts.SlicesH)
+		s.header.quant_table_set_index = make([]uint8, quantTableSetIndexCount(&ret.record))
+		for j := 0; j < len(s.header.quant_table_set_index); j++ {
+			s.header.quant_table_set_index[j] = uint8(j)
+		}
+		// Progressive
+		s.header.picture_structure = 3
+		sliceBounds(&ret.record, ret.width, ret.height, s)
+	}
+
+	return ret, nil
+}
+
+// Checks that the last slice along a dimension codes the last chroma
+// sample along it. Chroma positions are rounded down, and sizes up, as
+// per planeLayout, so a slice which starts at an odd luma position, for
+// example, can code one sample fewer than is left.
+func chromaSlicesCover(size uint32, slices int, shift uint8) bool {
+	start := uint32(slices-1) * size / uint32(slices)
+	ceil := func(x uint32) uint32 {
+		return (x + (1 << shift) - 1) >> shift
+	}
+	return start>>shift+ceil(size-start) >= ceil(size)
+}
+
+// Expands the run lengths of the first half of a quantization table,
+// in the same way parseConfigRecord does, and returns the number of
+// levels in the table.
+//
+// See: 4.9. Quantization Table Set
+func makeQuantTable(table *[256]int16, runs []int, scale int) int {
+	v := 0
+	k := 0
+	for _, run := range runs {
+		for a := 0; a < run; a++ {
+			table[k] = int16(scale * v)
+			k++
+		}
+		v++
+	}
+	for k := 1; k < 128; k++ {
+		table[256-k] = -table[k]
+	}
+	table[128] = -table[127]
+	return 2*v - 1
+}
+
+// Record returns the configuration record for the stream, to be
+// stored by the container as codec private data.
+func (e *Encoder) Record() []byte {
+	ret := make([]byte, len(e.extradata))
+	copy(ret, e.extradata)
+	return ret
+}
+
+// EncodeFrame encodes a ffv1.Frame into a packet.
+//
+// The frame must use the same plane layout DecodeFrame returns,
+// and match the parameters given to NewEncoder.
+//
+// Slice threading is used by default, with one goroutine per
+// slice.
+func (e *Encoder) EncodeFrame(frame *Frame) ([]byte, error) {
+	err := e.checkFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	keyframe := e.gop_size <= 1 || e.frame_number%e.gop_size == 0
+	e.frame_number++
+
+	// Slice threading lazymode
+	bufs := make([][]byte, len(e.slices))
+	errs := make([]error, len(e.slices))
+	wg := new(sync.WaitGroup)
+	for i := 0; i < len(e.slices); i++ {
+		wg.Add(1)
+		go func(wg *sync.WaitGroup, bufs [][]byte, errs []error, n int) {
+			bufs[n], errs[n] = e.encodeSlice(frame, keyframe, n)
+			wg.Done()
+		}(wg, bufs, errs, i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("slice %d failed: %s", i, err.Error())
+		}
+	}
+
+	size := 0
+	for _, buf := range bufs {
+		size += len(buf)
+	}
+	ret := make([]byte, 0, size)
+	for _, buf := range bufs {
+		ret = append(ret, buf...)
+	}
+
+	return ret, nil
+}
+
+// Checks that a frame matches the stream parameters.
+func (e *Encoder) checkFrame(frame *Frame) error {
+	if frame.Width != e.width || frame.Height != e.height {
+		return fmt.Errorf("frame dimensions %dx%d do not match stream dimensions %dx%d", frame.Width, frame.Height, e.width, e.height)
+	}
+	if frame.BitDepth != e.record.bits_per_raw_sample || frame.ColorSpace != int(e.record.colorspace_type) ||
+		frame.HasChroma != e.record.chroma_planes || frame.HasAlpha != e.record.extra_plane {
+		return fmt.Errorf("frame format does not match stream format")
+	}
+	if frame.HasChroma && (frame.ChromaSubsampleH != e.record.log2_h_chroma_subsample ||
+		frame.ChromaSubsampleV != e.record.log2_v_chroma_subsample) {
+		return fmt.Errorf("frame chroma subsampling does not match stream chroma subsampling")
+	}
+
+	numPlanes := 1
+	if e.record.chroma_planes {
+		numPlanes += 2
+	}
+	if e.record.extra_plane {
+		numPlanes++
+	}
+	if len(frame.Buf) < numPlanes {
+		return fmt.Errorf("frame has %d planes, expected %d", len(frame.Buf), numPlanes)
+	}
+
+	chromaWidth, chromaHeight := chromaSize(&e.record, e.width, e.height)
+	for p := 0; p < numPlanes; p++ {
+		size := int(e.width * e.height)
+		if p == 1 || p == 2 {
+			size = int(chromaWidth * chromaHeight)
+		}
+		if len(frame.Buf[p]) < size {
+			return fmt.Errorf("plane %d is too small: %d < %d", p, len(frame.Buf[p]), size)
+		}
+	}
+
+	return nil
+}
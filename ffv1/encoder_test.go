@@ -0,0 +1,79 @@
+package ffv1
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+func TestEncoderRoundTrip(t *testing.T) {
+	subsamplings := [][2]uint8{{0, 0}, {1, 0}, {1, 1}, {2, 0}, {2, 2}}
+	grids := [][2]int{{1, 1}, {2, 2}, {3, 1}, {1, 3}, {4, 3}}
+
+	for _, sub := range subsamplings {
+		for _, grid := range grids {
+			for _, golomb := range []bool{false, true} {
+				opts := EncoderOptions{
+					Width:            48,
+					Height:           32,
+					BitDepth:         8,
+					HasChroma:        true,
+					HasAlpha:         grid[0] == 2,
+					ChromaSubsampleH: sub[0],
+					ChromaSubsampleV: sub[1],
+					SlicesH:          grid[0],
+					SlicesV:          grid[1],
+					GOPSize:          2,
+					EC:               grid[1] == 3,
+					GolombRice:       golomb,
+				}
+				name := fmt.Sprintf("%d%d %dx%d golomb=%v", sub[0], sub[1], grid[0], grid[1], golomb)
+				t.Run(name, func(t *testing.T) {
+					testRoundTrip(t, opts, 3)
+				})
+			}
+		}
+	}
+
+	t.Run("luma only", func(t *testing.T) {
+		testRoundTrip(t, EncoderOptions{Width: 31, Height: 17, SlicesH: 3, GOPSize: 3}, 3)
+	})
+
+	t.Run("custom state transitions", func(t *testing.T) {
+		transition := rangecoder.DefaultStateTransition
+		for i := 1; i < 255; i++ {
+			transition[i] = uint8(255 - i)
+		}
+		testRoundTrip(t, EncoderOptions{Width: 32, Height: 16, HasChroma: true, SlicesV: 2, GOPSize: 2, StateTransition: &transition}, 3)
+	})
+}
+
+func TestNewEncoderOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts EncoderOptions
+		ok   bool
+	}{
+		{"8-bit", EncoderOptions{Width: 16, Height: 16, BitDepth: 8}, true},
+		{"10-bit", EncoderOptions{Width: 16, Height: 16, BitDepth: 10}, false},
+		{"16-bit", EncoderOptions{Width: 16, Height: 16, BitDepth: 16}, false},
+		{"RGB", EncoderOptions{Width: 16, Height: 16, ColorSpace: RGB, HasChroma: true}, false},
+		{"alpha without chroma", EncoderOptions{Width: 16, Height: 16, HasAlpha: true}, false},
+		{"golomb-rice with custom transitions", EncoderOptions{Width: 16, Height: 16, GolombRice: true, StateTransition: &rangecoder.DefaultStateTransition}, false},
+		{"more slices than rows", EncoderOptions{Width: 16, Height: 2, SlicesV: 3}, false},
+		// The last column of slices starts at 33, and codes chroma
+		// columns 16 to 32, leaving column 33 out.
+		{"uncoded chroma column", EncoderOptions{Width: 67, Height: 32, HasChroma: true, ChromaSubsampleH: 1, SlicesH: 2}, false},
+		{"even chroma column", EncoderOptions{Width: 66, Height: 32, HasChroma: true, ChromaSubsampleH: 1, SlicesH: 2}, true},
+		{"uncoded chroma row", EncoderOptions{Width: 32, Height: 35, HasChroma: true, ChromaSubsampleV: 1, SlicesV: 2}, false},
+		{"odd column without chroma", EncoderOptions{Width: 67, Height: 32, SlicesH: 2}, true},
+	}
+
+	for _, test := range tests {
+		_, err := NewEncoder(test.opts)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package ffv1
+
+import (
+	"fmt"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/golomb"
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// Writes a slice's header.
+//
+// See: 4.5. Slice Header
+func (e *Encoder) writeSliceHeader(c *rangecoder.Encoder, s *slice) {
+	// 4. Bitstream
+	slice_state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		slice_state[i] = 128
+	}
+
+	// 4.5.1. slice_x
+	c.PutUR(slice_state, s.header.slice_x)
+	// 4.5.2. slice_y
+	c.PutUR(slice_state, s.header.slice_y)
+	// 4.5.3 slice_width
+	c.PutUR(slice_state, s.header.slice_width_minus1)
+	// 4.5.4 slice_height
+	c.PutUR(slice_state, s.header.slice_height_minus1)
+
+	// 4.5.6. quant_table_set_index
+	for i := 0; i < len(s.header.quant_table_set_index); i++ {
+		c.PutUR(slice_state, uint32(s.header.quant_table_set_index[i]))
+	}
+
+	// 4.5.7. picture_structure
+	c.PutUR(slice_state, uint32(s.header.picture_structure))
+
+	// See: * 4.5.8. sar_num
+	//      * 4.5.9. sar_den
+	c.PutUR(slice_state, s.header.sar_num)
+	c.PutUR(slice_state, s.header.sar_den)
+}
+
+// Line encoding.
+//
+// This mirrors decodeLine exactly, except that the sample
+// differences are calculated from the source frame, rather
+// than added to the prediction.
+//
+// See: 4.7. Line
+func (e *Encoder) encodeLine(c *rangecoder.Encoder, gc *golomb.Encoder, s *slice, frame *Frame, w int, h int, stride int, offset int, y int, p int, qt int) {
+	// Runs are horizontal and thus cannot run more than a line.
+	//
+	// See: 3.8.2.2.1. Run Length Coding
+	if gc != nil {
+		gc.NewLine()
+	}
+
+	buf := frame.Buf[p][offset:]
+
+	// 3.8. Coding of the Sample Difference
+	shift := e.record.bits_per_raw_sample
+
+	// 4.7.4. sample_difference
+	for x := 0; x < w; x++ {
+		// Derive neighbours
+		//
+		// See pred.go for details.
+		T, L, t, l, tr, tl := deriveBorders(buf, x, y, w, h, stride)
+
+		// See also: * 3.4. Context
+		//           * 3.6. Quantization Table Set Indexes
+		context := getContext(e.record.quant_tables[s.header.quant_table_set_index[qt]], T, L, t, l, tr, tl)
+
+		// 3.3. Median Predictor
+		diff := int32(buf[(y*stride)+x]) - int32(getMedian(l, t, l+t-tl))
+
+		// Fold the difference into the signed range of the sample,
+		// since the decoder will wrap it back around.
+		//
+		// See: 3.8. Coding of the Sample Difference
+		diff = ((diff + (1 << (shift - 1))) & ((1 << shift) - 1)) - (1 << (shift - 1))
+
+		// 3.4. Context
+		if context < 0 {
+			context = -context
+			diff = -diff
+		}
+
+		if gc != nil {
+			gc.PutSG(context, &s.golomb_state[qt][context], diff, uint(shift))
+		} else {
+			c.PutSR(s.state[qt][context], diff)
+		}
+	}
+}
+
+// Encoding happens here.
+//
+// See: * 4.6. Slice Content
+func (e *Encoder) encodeSliceContent(c *rangecoder.Encoder, gc *golomb.Encoder, s *slice, frame *Frame) {
+	// 4.6.1. primary_color_count
+	primary_color_count := 1
+	if e.record.chroma_planes {
+		primary_color_count += 2
+	}
+	if e.record.extra_plane {
+		primary_color_count++
+	}
+
+	// YCbCr Mode
+	//
+	// Planes are independent.
+	//
+	// See: 3.7.1. YCbCr
+	for p := 0; p < primary_color_count; p++ {
+		plane_pixel_width, plane_pixel_height, plane_pixel_stride, start_x, start_y, quant_table := planeLayout(&e.record, e.width, s, p)
+
+		// 3.8.2.2.1. Run Length Coding
+		if gc != nil {
+			gc.NewPlane(uint32(plane_pixel_width))
+		}
+
+		for y := 0; y < plane_pixel_height; y++ {
+			offset := start_y*plane_pixel_stride + start_x
+			e.encodeLine(c, gc, s, frame, plane_pixel_width, plane_pixel_height, plane_pixel_stride, offset, y, p, quant_table)
+		}
+	}
+}
+
+// Encodes a slice, including its footer.
+//
+// See: * 4.4. Slice
+//      * 4.8. Slice Footer
+func (e *Encoder) encodeSlice(frame *Frame, keyframe bool, slicenum int) ([]byte, error) {
+	s := &e.slices[slicenum]
+
+	// If this is a keyframe, refresh states.
+	//
+	// See: * 3.8.1.3. Initial Values for the Context Model
+	//      * 3.8.2.4. Initial Values for the VLC context state
+	if keyframe {
+		resetSliceStates(s, &e.record, e.initial_states)
+	}
+
+	c := rangecoder.NewEncoder()
+
+	// 4. Bitstream
+	state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		state[i] = 128
+	}
+
+	// The keyframe bit is coded at the start of slice 0.
+	//
+	// See: 4.3. Frame
+	if slicenum == 0 {
+		c.PutBR(state, keyframe)
+	}
+
+	if e.record.coder_type == 2 { // Custom state transition table
+		c.SetTable(e.state_transition)
+	}
+
+	e.writeSliceHeader(c, s)
+
+	// Sentinal mode allows the decoder to find the end of the range
+	// coded data without knowing the slice size, which is also where
+	// the Golomb-Rice coded data starts.
+	//
+	// See: 3.8.1.1.1. Termination
+	var buf []byte
+	if e.record.coder_type == 0 {
+		buf = c.SentinalEnd()
+		gc := golomb.NewEncoder()
+		e.encodeSliceContent(nil, gc, s, frame)
+		buf = append(buf, gc.Finish()...)
+	} else {
+		e.encodeSliceContent(c, nil, s, frame)
+		buf = c.SentinalEnd()
+	}
+
+	// 4.8.1. slice_size
+	size := len(buf)
+	if size >= 1<<24 {
+		return nil, fmt.Errorf("slice too large: %d bytes", size)
+	}
+	buf = append(buf, byte(size>>16), byte(size>>8), byte(size))
+
+	if e.record.ec != 0 {
+		// 4.8.2. error_status
+		buf = append(buf, 0)
+		// 4.8.3. slice_crc_parity
+		buf = appendCRCParity(buf)
+	}
+
+	return buf, nil
+}
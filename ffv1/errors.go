@@ -0,0 +1,107 @@
+package ffv1
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// Errors returned by the decoder, which may be wrapped, and should be
+// checked for with errors.Is.
+var (
+	// ErrUnsupportedVersion is returned for FFV1 versions or micro
+	// versions which are not supported.
+	//
+	// See: * 4.1.1. version
+	//      * 4.1.2. micro_version
+	ErrUnsupportedVersion = errors.New("unsupported FFV1 version")
+	// ErrRecordCRC is returned if the configuration record fails its
+	// CRC check.
+	//
+	// See: 4.2.2. configuration_record_crc_parity
+	ErrRecordCRC = errors.New("failed CRC check for configuration record")
+	// ErrSliceCRC is returned, in a *SliceError, if a slice fails its
+	// CRC check.
+	//
+	// See: 4.8.3. slice_crc_parity
+	ErrSliceCRC = errors.New("CRC mismatch")
+	// ErrTruncated is returned if a frame or slice ends before all of
+	// it has been read.
+	ErrTruncated = errors.New("truncated")
+	// ErrStateMismatch is returned if an inter frame does not fit the
+	// contexts carried over from the frames before it, e.g. because it
+	// has a different number of slices than the preceding keyframe.
+	//
+	// See: 9.1.1. Multi-threading Support and Independence of Slices
+	ErrStateMismatch = errors.New("context state mismatch")
+	// ErrLimitExceeded is returned if a stream goes over one of the
+	// limits set in DecoderOptions.
+	ErrLimitExceeded = errors.New("decoder limit exceeded")
+)
+
+// ErrSliceErrorStatus is returned, in a *SliceError, if a slice has a
+// non-zero error_status, meaning the encoder has marked it as damaged.
+//
+// See: 4.8.2. error_status
+type ErrSliceErrorStatus struct {
+	// The error_status of the slice.
+	Value uint8
+}
+
+func (e ErrSliceErrorStatus) Error() string {
+	return fmt.Sprintf("error_status is non-zero: %d", e.Value)
+}
+
+// SliceError is returned by DecodeFrame if a slice fails to decode,
+// and DecoderOptions.Conceal is not set.
+type SliceError struct {
+	// The index of the slice within the frame.
+	Index int
+	// The area of the frame, in luma pixels, the slice covers, or its
+	// best guess if its header could not be parsed. See Frame.Concealed.
+	Rect image.Rectangle
+	// Why the slice failed to decode.
+	Cause error
+}
+
+func (e *SliceError) Error() string {
+	return fmt.Sprintf("slice %d failed: %s", e.Index, e.Cause.Error())
+}
+
+// Unwrap returns the cause of the error.
+func (e *SliceError) Unwrap() error {
+	return e.Cause
+}
+
+// GeometryError is returned by DecodeFrame if the slices of a frame do
+// not cover it exactly once: if a slice lies outside of the frame, if
+// two slices overlap, or if part of the frame is not covered by any
+// slice.
+//
+// Positions and sizes are on the slice grid of the configuration
+// record, not in pixels.
+//
+// See: 4.5. Slice Header
+type GeometryError struct {
+	// The index of the slice at fault, or -1 if part of the frame is
+	// not covered by any slice.
+	Index int
+	// The slice's position and size, or the position which is not
+	// covered, with a size of 1x1.
+	X      int
+	Y      int
+	Width  int
+	Height int
+	// The index of the slice it overlaps, or -1.
+	Overlaps int
+}
+
+func (e *GeometryError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("slice grid position %d,%d is not covered by any slice", e.X, e.Y)
+	}
+	if e.Overlaps >= 0 {
+		return fmt.Sprintf("slice %d at %d,%d (%dx%d) overlaps slice %d", e.Index, e.X, e.Y, e.Width, e.Height, e.Overlaps)
+	}
+	return fmt.Sprintf("slice %d at %d,%d (%dx%d) is outside of the slice grid", e.Index, e.X, e.Y, e.Width, e.Height)
+}
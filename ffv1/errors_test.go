@@ -0,0 +1,105 @@
+package ffv1
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeErrors(t *testing.T) {
+	ec := EncoderOptions{Width: 32, Height: 16, HasChroma: true, EC: true}
+	golomb := EncoderOptions{Width: 32, Height: 16, HasChroma: true, GolombRice: true}
+
+	tests := []struct {
+		name   string
+		opts   EncoderOptions
+		modify func(packet []byte) []byte
+		// The sentinel the error must wrap, if any.
+		is error
+		// Whether or not it must be in a *SliceError.
+		slice bool
+		// The error_status of an ErrSliceErrorStatus, if one is expected.
+		status uint8
+	}{
+		{"slice CRC", ec, func(packet []byte) []byte {
+			packet[len(packet)/2] ^= 0xFF
+			return packet
+		}, ErrSliceCRC, true, 0},
+		{"error_status", ec, func(packet []byte) []byte {
+			// The footer is slice_size, error_status and the CRC,
+			// which covers the rest.
+			packet[len(packet)-5] = 3
+			return appendCRCParity(packet[:len(packet)-4])
+		}, nil, true, 3},
+		{"truncated footer", ec, func(packet []byte) []byte {
+			return packet[:2]
+		}, ErrTruncated, false, 0},
+		{"truncated slice", golomb, func(packet []byte) []byte {
+			// Cut the slice in half, with a footer to match.
+			size := (len(packet) - 3) / 2
+			packet = append(packet[:size:size], byte(size>>16), byte(size>>8), byte(size))
+			return packet
+		}, ErrTruncated, true, 0},
+	}
+
+	for _, test := range tests {
+		record, packets := encodeSequence(t, test.opts, 1)
+		packet := packets[0]
+		packet = test.modify(packet)
+
+		d, err := NewDecoder(record, test.opts.Width, test.opts.Height)
+		if err != nil {
+			t.Fatalf("%s: couldn't create decoder: %s", test.name, err.Error())
+		}
+		_, err = d.DecodeFrame(packet)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+
+		if test.is != nil && !errors.Is(err, test.is) {
+			t.Errorf("%s: got error %v, not one wrapping %v", test.name, err, test.is)
+		}
+		var sliceErr *SliceError
+		if errors.As(err, &sliceErr) != test.slice {
+			t.Errorf("%s: got error %v, which is a *SliceError: %t", test.name, err, !test.slice)
+		} else if test.slice && (sliceErr.Index != 0 || sliceErr.Rect.Dx() != 32 || sliceErr.Rect.Dy() != 16) {
+			t.Errorf("%s: got slice %d, at %v", test.name, sliceErr.Index, sliceErr.Rect)
+		}
+		var statusErr ErrSliceErrorStatus
+		if errors.As(err, &statusErr) != (test.status != 0) || statusErr.Value != test.status {
+			t.Errorf("%s: got error %v, not an error_status of %d", test.name, err, test.status)
+		}
+	}
+}
+
+func TestRecordErrors(t *testing.T) {
+	record, _ := encodeSequence(t, EncoderOptions{Width: 32, Height: 16, HasChroma: true}, 0)
+
+	broken := append([]byte{}, record...)
+	broken[len(broken)/2] ^= 0xFF
+	_, err := NewDecoder(broken, 32, 16)
+	if !errors.Is(err, ErrRecordCRC) {
+		t.Errorf("got error %v, not one wrapping ErrRecordCRC", err)
+	}
+}
+
+// An inter frame must have as many slices as the keyframe before it.
+func TestStateMismatch(t *testing.T) {
+	opts := EncoderOptions{Width: 32, Height: 16, HasChroma: true, GOPSize: 2}
+	_, single := encodeSequence(t, opts, 2)
+	opts.SlicesH = 2
+	record, double := encodeSequence(t, opts, 2)
+
+	d, err := NewDecoder(record, opts.Width, opts.Height)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+	_, err = d.DecodeFrame(double[0])
+	if err != nil {
+		t.Fatalf("couldn't decode keyframe: %s", err.Error())
+	}
+	_, err = d.DecodeFrame(single[1])
+	if !errors.Is(err, ErrStateMismatch) {
+		t.Errorf("got error %v, not one wrapping ErrStateMismatch", err)
+	}
+}
@@ -0,0 +1,109 @@
+package ffv1
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Executor runs slice decoding tasks. It allows several decoders to
+// share a bounded set of goroutines. See WorkerPool for an
+// implementation.
+type Executor interface {
+	// Execute runs task, usually in another goroutine. It may block
+	// until there is room to run it, but must not wait for it to
+	// finish, or for any other task to finish.
+	Execute(task func())
+}
+
+// Runs tasks in new goroutines, which is the default.
+type goroutineExecutor struct{}
+
+func (goroutineExecutor) Execute(task func()) {
+	go task()
+}
+
+// WorkerPool is an Executor with a fixed number of worker goroutines,
+// which may be shared between decoders.
+type WorkerPool struct {
+	tasks chan func()
+	wg    sync.WaitGroup
+}
+
+// NewWorkerPool starts a new pool of 'workers' worker goroutines.
+// Close must be called to stop them.
+func NewWorkerPool(workers int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ret := new(WorkerPool)
+	ret.tasks = make(chan func())
+	ret.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range ret.tasks {
+				task()
+			}
+			ret.wg.Done()
+		}()
+	}
+
+	return ret
+}
+
+// Execute runs task on the next free worker, blocking until one
+// is free.
+func (p *WorkerPool) Execute(task func()) {
+	p.tasks <- task
+}
+
+// Close stops the workers, once they are done with any running tasks.
+// The pool must not be used afterwards.
+func (p *WorkerPool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
+
+// Runs 'task' for each slice, as per the decoder's threading options,
+// and waits for them all to finish.
+//
+// Rather than one task per slice, at most MaxParallelism tasks are
+// submitted, which each take the next slice to be done until there are
+// none left.
+//
+// See: 9.1.1. Multi-threading Support and Independence of Slices
+func (d *Decoder) runSlices(count int, task func(n int)) {
+	if d.options.MaxParallelism == 1 || count == 1 {
+		for i := 0; i < count; i++ {
+			task(i)
+		}
+		return
+	}
+
+	workers := d.options.MaxParallelism
+	if workers <= 0 || workers > count {
+		workers = count
+	}
+
+	var exec Executor = goroutineExecutor{}
+	if d.options.Executor != nil {
+		exec = d.options.Executor
+	}
+
+	next := int32(-1)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		exec.Execute(func() {
+			for {
+				n := int(atomic.AddInt32(&next, 1))
+				if n >= count {
+					break
+				}
+				task(n)
+			}
+			wg.Done()
+		})
+	}
+	wg.Wait()
+}
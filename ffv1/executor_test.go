@@ -0,0 +1,136 @@
+package ffv1
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunSlices(t *testing.T) {
+	pool := NewWorkerPool(2)
+	defer pool.Close()
+
+	tests := []struct {
+		name     string
+		parallel int
+		exec     Executor
+		limit    int32
+	}{
+		{"serial", 1, nil, 1},
+		{"unlimited", 0, nil, 9},
+		{"limited", 3, nil, 3},
+		{"worker pool", 0, pool, 2},
+		{"limited worker pool", 1, pool, 1},
+	}
+
+	for _, test := range tests {
+		d := &Decoder{options: DecoderOptions{MaxParallelism: test.parallel, Executor: test.exec}}
+
+		var running, most int32
+		var lock sync.Mutex
+		var order []int
+		d.runSlices(9, func(n int) {
+			now := atomic.AddInt32(&running, 1)
+			lock.Lock()
+			if now > most {
+				most = now
+			}
+			order = append(order, n)
+			lock.Unlock()
+			atomic.AddInt32(&running, -1)
+		})
+
+		if len(order) != 9 {
+			t.Errorf("%s: ran %d tasks, not 9", test.name, len(order))
+			continue
+		}
+		done := make([]bool, 9)
+		for _, n := range order {
+			if done[n] {
+				t.Errorf("%s: slice %d ran twice", test.name, n)
+			}
+			done[n] = true
+		}
+		if most > test.limit {
+			t.Errorf("%s: %d tasks ran at once, more than %d", test.name, most, test.limit)
+		}
+		// Serial decoding is in order.
+		if test.limit == 1 {
+			for i, n := range order {
+				if n != i {
+					t.Errorf("%s: ran slices in the order %v", test.name, order)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Decoders sharing a worker pool must put every slice in its place,
+// and report the right slice when one fails.
+func TestWorkerPoolDecode(t *testing.T) {
+	opts := EncoderOptions{
+		Width:            48,
+		Height:           32,
+		HasChroma:        true,
+		ChromaSubsampleH: 1,
+		ChromaSubsampleV: 1,
+		SlicesH:          3,
+		SlicesV:          2,
+		EC:               true,
+	}
+	e, err := NewEncoder(opts)
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+	in := testFrame(opts, 0)
+	packet, err := e.EncodeFrame(in)
+	if err != nil {
+		t.Fatalf("couldn't encode: %s", err.Error())
+	}
+	broken := append([]byte{}, packet...)
+	broken[len(broken)-32] ^= 0xFF
+
+	pool := NewWorkerPool(2)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, err := NewDecoderWithOptions(e.Record(), opts.Width, opts.Height, &DecoderOptions{Executor: pool, MaxParallelism: 1 + i})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for n := 0; n < 4; n++ {
+				out, err := d.DecodeFrame(packet)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				for p := range in.Buf {
+					if !bytes.Equal(out.Buf[p], in.Buf[p]) {
+						errs[i] = errors.New("decoded frame differs")
+						return
+					}
+				}
+			}
+			_, errs[i] = d.DecodeFrame(broken)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		var sliceErr *SliceError
+		if !errors.As(err, &sliceErr) {
+			t.Errorf("decoder %d: got error %v, not a *SliceError", i, err)
+		} else if sliceErr.Index != 5 {
+			t.Errorf("decoder %d: slice %d failed, not the last one", i, sliceErr.Index)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ffv1
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Dimensions of the streams the seed corpora are made from, and that
+// the decoder is fuzzed with. Small, so each input is quick to decode.
+const (
+	fuzzWidth  = 48
+	fuzzHeight = 32
+)
+
+// Most memory the decoder fuzz target lets a frame ask for. Large
+// allocations are legal, but not what fuzzing is looking for.
+const fuzzMaxFrameBytes = 64 << 20
+
+// Most slices a frame can have, with a 256x256 slice grid.
+const fuzzMaxSlices = 256 * 256
+
+// Encoder settings for the seed corpora, covering both coders, slice
+// CRCs, subsampling with slice boundaries which are not a multiple of
+// it, alpha, and a custom state transition table.
+func fuzzEncoderOptions() []EncoderOptions {
+	var transition [256]uint8
+	for i := range transition {
+		transition[i] = uint8(i)
+	}
+	transition[200] = 190
+
+	return []EncoderOptions{
+		{Width: fuzzWidth, Height: fuzzHeight, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1, SlicesH: 2, SlicesV: 2, GOPSize: 2, EC: true},
+		{Width: fuzzWidth, Height: fuzzHeight, HasChroma: true, SlicesH: 2, GOPSize: 2, GolombRice: true},
+		{Width: fuzzWidth, Height: fuzzHeight, HasChroma: true, HasAlpha: true, GOPSize: 2, StateTransition: &transition},
+		{Width: fuzzWidth, Height: fuzzHeight, SlicesV: 3, EC: true},
+		{Width: fuzzWidth, Height: fuzzHeight, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1, SlicesV: 3, GOPSize: 2},
+		{Width: fuzzWidth, Height: fuzzHeight, HasChroma: true, ChromaSubsampleH: 1, SlicesH: 5, SlicesV: 3, GOPSize: 2, GolombRice: true},
+	}
+}
+
+func FuzzParseConfigRecord(f *testing.F) {
+	for _, opts := range fuzzEncoderOptions() {
+		record, _ := encodeSequence(f, opts, 0)
+		f.Add(record)
+
+		// Other versions, and coded initial states.
+		config, err := ParseConfigRecord(record)
+		if err != nil {
+			f.Fatalf("couldn't parse seed record: %s", err.Error())
+		}
+		config.InitialStateDelta[0][1][2] = -3
+		for _, version := range []uint8{2, 4} {
+			config.Version = version
+			buf, err := config.MarshalBinary()
+			if err != nil {
+				f.Fatalf("couldn't write seed record: %s", err.Error())
+			}
+			f.Add(buf)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, record []byte) {
+		config, err := ParseConfigRecord(record)
+		if err != nil {
+			return
+		}
+
+		// Anything parsed must be written back out the same.
+		buf, err := config.MarshalBinary()
+		if err != nil {
+			t.Fatalf("couldn't write parsed record: %s", err.Error())
+		}
+		again, err := ParseConfigRecord(buf)
+		if err != nil {
+			t.Fatalf("couldn't parse written record: %s", err.Error())
+		}
+		if !reflect.DeepEqual(config, again) {
+			t.Fatalf("record changed when written out")
+		}
+	})
+}
+
+func FuzzCountSlices(f *testing.F) {
+	for _, opts := range fuzzEncoderOptions() {
+		_, frames := encodeSequence(f, opts, 1)
+		f.Add(frames[0], opts.EC)
+	}
+	f.Add([]byte{}, false)
+	f.Add([]byte{0x00, 0x00, 0x01}, false)
+
+	f.Fuzz(func(t *testing.T, buf []byte, ec bool) {
+		var header internalFrame
+		err := countSlices(buf, &header, ec, fuzzMaxSlices)
+		if err != nil {
+			return
+		}
+		if len(header.slice_info) > fuzzMaxSlices {
+			t.Fatalf("%d slices, more than %d", len(header.slice_info), fuzzMaxSlices)
+		}
+
+		// The slices and their footers must fill the frame, in order.
+		footerSize := 3
+		if ec {
+			footerSize += 5
+		}
+		pos := 0
+		for i, info := range header.slice_info {
+			if info.pos != pos {
+				t.Fatalf("slice %d is at %d, not %d", i, info.pos, pos)
+			}
+			pos += int(info.size) + footerSize
+		}
+		if pos != len(buf) {
+			t.Fatalf("slices end at %d, not %d", pos, len(buf))
+		}
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, opts := range fuzzEncoderOptions() {
+		record, frames := encodeSequence(f, opts, 2)
+		f.Add(record, frames[0], frames[1], false)
+		f.Add(record, frames[0], frames[1], true)
+		// Inter frames first.
+		f.Add(record, frames[1], frames[0], true)
+		// Versions 0 and 1, which have no record.
+		f.Add([]byte{}, frames[0], frames[1], false)
+	}
+
+	f.Fuzz(func(t *testing.T, record []byte, frame0 []byte, frame1 []byte, conceal bool) {
+		options := &DecoderOptions{
+			Conceal:        conceal,
+			MaxParallelism: 1,
+			MaxFrameBytes:  fuzzMaxFrameBytes,
+		}
+		d, err := NewDecoderWithOptions(record, fuzzWidth, fuzzHeight, options)
+		if err != nil {
+			return
+		}
+		// The same, decoding slices in parallel, which must give the
+		// same output, so no two slices may write the same samples.
+		parallel := *options
+		parallel.MaxParallelism = 0
+		pd, err := NewDecoderWithOptions(record, fuzzWidth, fuzzHeight, &parallel)
+		if err != nil {
+			t.Fatalf("couldn't create parallel decoder: %s", err.Error())
+		}
+
+		for _, frame := range [][]byte{frame0, frame1} {
+			out, err := d.DecodeFrame(frame)
+			pout, perr := pd.DecodeFrame(frame)
+			if (err == nil) != (perr == nil) {
+				t.Fatalf("serial error %v, parallel error %v", err, perr)
+			}
+			if err != nil {
+				continue
+			}
+			if out.Width != fuzzWidth || out.Height != fuzzHeight {
+				t.Fatalf("decoded frame is %dx%d, not %dx%d", out.Width, out.Height, fuzzWidth, fuzzHeight)
+			}
+			if !reflect.DeepEqual(out, pout) {
+				t.Fatalf("serial and parallel decoding differ")
+			}
+		}
+	})
+}
+
+// FuzzRoundTrip encodes synthetic frames with arbitrary dimensions,
+// subsampling and slice grids, and checks that they decode back the
+// same, with slices in parallel.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add(uint8(48), uint8(32), uint8(0x11), uint8(0x13), false)
+	f.Add(uint8(49), uint8(33), uint8(0x11), uint8(0x33), true)
+	f.Add(uint8(50), uint8(16), uint8(0x10), uint8(0x32), false)
+	f.Add(uint8(40), uint8(44), uint8(0x22), uint8(0x25), true)
+
+	f.Fuzz(func(t *testing.T, width uint8, height uint8, subsampling uint8, grid uint8, golomb bool) {
+		opts := EncoderOptions{
+			Width:            uint32(width%64) + 1,
+			Height:           uint32(height%64) + 1,
+			HasChroma:        true,
+			ChromaSubsampleH: (subsampling >> 4) % 3,
+			ChromaSubsampleV: (subsampling & 0xF) % 3,
+			SlicesH:          int(grid>>4)%6 + 1,
+			SlicesV:          int(grid&0xF)%6 + 1,
+			GOPSize:          2,
+			GolombRice:       golomb,
+		}
+		e, err := NewEncoder(opts)
+		if err != nil {
+			return
+		}
+		d, err := NewDecoder(e.Record(), opts.Width, opts.Height)
+		if err != nil {
+			t.Fatalf("couldn't create decoder: %s", err.Error())
+		}
+
+		for n := 0; n < 2; n++ {
+			in := testFrame(opts, n)
+			packet, err := e.EncodeFrame(in)
+			if err != nil {
+				t.Fatalf("frame %d: couldn't encode: %s", n, err.Error())
+			}
+			out, err := d.DecodeFrame(packet)
+			if err != nil {
+				t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+			}
+			if !reflect.DeepEqual(out.Buf, in.Buf) {
+				t.Fatalf("frame %d: decoded frame differs", n)
+			}
+		}
+	})
+}
@@ -1,10 +1,20 @@
 package golomb
 
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTruncated is returned by Coder.Err if the coded data ran out
+// before decoding was done.
+var ErrTruncated = errors.New("read past the end of the Golomb-Rice coded data")
+
 type bitReader struct {
 	buf       []byte
 	pos       int
 	bitBuf    uint32
 	bitsInBuf uint32
+	err       error
 }
 
 // Creates a new bitreader.
@@ -17,11 +27,20 @@ func newBitReader(buf []byte) (r *bitReader) {
 // Reads 'count' bits, up to 32.
 func (r *bitReader) u(count uint32) (result uint32) {
 	if count > 32 {
-		panic("WTF more than 32 bits")
+		if r.err == nil {
+			r.err = fmt.Errorf("cannot read %d bits at once", count)
+		}
+		return 0
 	}
 	for count > r.bitsInBuf {
+		// Reading past the end gives zeroes, so callers only need to
+		// check the error once they are done.
 		r.bitBuf <<= 8
-		r.bitBuf |= uint32(r.buf[r.pos])
+		if r.pos < len(r.buf) {
+			r.bitBuf |= uint32(r.buf[r.pos])
+		} else if r.err == nil {
+			r.err = ErrTruncated
+		}
 		r.bitsInBuf += 8
 		r.pos++
 
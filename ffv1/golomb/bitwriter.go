@@ -0,0 +1,37 @@
+package golomb
+
+type bitWriter struct {
+	buf       []byte
+	bitBuf    uint64
+	bitsInBuf uint32
+}
+
+// Creates a new bitwriter.
+func newBitWriter() (w *bitWriter) {
+	ret := new(bitWriter)
+	return ret
+}
+
+// Writes the low 'count' bits of 'value', up to 32.
+func (w *bitWriter) put(count uint32, value uint32) {
+	if count > 32 {
+		panic("WTF more than 32 bits")
+	}
+	if count == 0 {
+		return
+	}
+	w.bitBuf = w.bitBuf<<count | uint64(value)&((uint64(1)<<count)-1)
+	w.bitsInBuf += count
+	for w.bitsInBuf >= 8 {
+		w.bitsInBuf -= 8
+		w.buf = append(w.buf, byte(w.bitBuf>>w.bitsInBuf))
+	}
+}
+
+// Pads the last byte with zero bits and returns the written bytes.
+func (w *bitWriter) flush() []byte {
+	if w.bitsInBuf > 0 {
+		w.put(8-w.bitsInBuf, 0)
+	}
+	return w.buf
+}
@@ -0,0 +1,164 @@
+package golomb
+
+// Encoder is an instance of a Golomb-Rice encoder, the counterpart to Coder.
+type Encoder struct {
+	wr        *bitWriter
+	run_mode  int
+	run_count int
+	run_index int
+}
+
+// NewEncoder creates a new Golomb-Rice encoder.
+func NewEncoder() *Encoder {
+	ret := new(Encoder)
+	ret.wr = newBitWriter()
+	return ret
+}
+
+// NewPlane should be called on a given Encoder as each new Plane is
+// processed. It ends any run left over from the previous line and
+// resets the run index.
+//
+// The width is not needed to encode, and is only taken to mirror
+// Coder.NewPlane.
+//
+// See: 3.8.2.2.1. Run Length Coding
+func (c *Encoder) NewPlane(width uint32) {
+	c.endRun()
+	c.run_index = 0
+}
+
+// NewLine ends any run left over from the previous line and starts
+// a new run, since runs can only be per-line.
+func (c *Encoder) NewLine() {
+	c.endRun()
+}
+
+// Starts a new run.
+func (c *Encoder) newRun() {
+	c.run_mode = 0
+	c.run_count = 0
+}
+
+// Writes out a run which reaches the end of the line. Any remainder
+// shorter than the current run length is coded as a full run, which
+// the decoder clips to the line.
+//
+// See: 3.8.2.2.1. Run Length Coding
+func (c *Encoder) endRun() {
+	if c.run_mode != 0 {
+		for c.run_count >= 1<<log2_run[c.run_index] {
+			c.run_count -= 1 << log2_run[c.run_index]
+			c.run_index++
+			c.wr.put(1, 1)
+		}
+		if c.run_count != 0 {
+			c.wr.put(1, 1)
+		}
+	}
+	c.newRun()
+}
+
+// PutSG puts a Golomb-Rice coded signed scalar symbol.
+//
+// See: * 3.8.2. Golomb Rice Mode
+//      * 4. Bitstream
+func (c *Encoder) PutSG(context int32, state *State, v int32, bits uint) {
+	// Section 3.8.2.2. Run Mode
+	if context == 0 && c.run_mode == 0 {
+		c.run_mode = 1
+	}
+
+	if c.run_mode == 0 {
+		// We aren't in run mode; put a new symbol.
+		c.put_vlc_symbol(state, v, bits)
+		return
+	}
+
+	// The run is still going.
+	if v == 0 {
+		c.run_count++
+		return
+	}
+
+	// Section 3.8.2.2.1. Run Length Coding
+	for c.run_count >= 1<<log2_run[c.run_index] {
+		c.run_count -= 1 << log2_run[c.run_index]
+		c.run_index++
+		c.wr.put(1, 1)
+	}
+	c.wr.put(1, 0)
+	c.wr.put(uint32(log2_run[c.run_index]), uint32(c.run_count))
+	if c.run_index != 0 {
+		c.run_index--
+	}
+	c.newRun()
+
+	// 3.8.2.2.2. Level Coding
+	if v > 0 {
+		v--
+	}
+	c.put_vlc_symbol(state, v, bits)
+}
+
+// Finish ends any pending run and returns the coded bytes, padded
+// to a whole number of bytes.
+func (c *Encoder) Finish() []byte {
+	c.endRun()
+	return c.wr.flush()
+}
+
+// Puts a Golomb-Rice coded symbol.
+//
+// See: 3.8.2.3. Scalar Mode
+func (c *Encoder) put_vlc_symbol(state *State, v int32, bits uint) {
+	v = sign_extend(v-state.bias, bits)
+
+	i := state.count
+	k := uint32(0)
+
+	for i < state.error_sum {
+		k++
+		i += i
+	}
+	// As get_vlc_symbol does, so both agree on damaged states.
+	if k > uint32(bits) {
+		k = uint32(bits)
+	}
+
+	code := v
+	if 2*state.drift < -state.count {
+		code = -1 - v
+	}
+
+	c.put_sr_golomb(code, k, bits)
+
+	state.update(v)
+}
+
+// Puts a signed Golomb-Rice code
+//
+// See: 3.8.2.1. Signed Golomb Rice Codes
+func (c *Encoder) put_sr_golomb(v int32, k uint32, bits uint) {
+	if v < 0 {
+		c.put_ur_golomb(-2*v-1, k, bits)
+	} else {
+		c.put_ur_golomb(2*v, k, bits)
+	}
+}
+
+// Puts an unsigned Golomb-Rice code, escaping values with too
+// long a prefix.
+//
+// See: 3.8.2.1. Signed Golomb Rice Codes
+func (c *Encoder) put_ur_golomb(v int32, k uint32, bits uint) {
+	prefix := v >> k
+	if prefix < 12 {
+		c.wr.put(uint32(prefix), 0)
+		c.wr.put(1, 1)
+		c.wr.put(k, uint32(v))
+	} else {
+		c.wr.put(12, 0)
+		c.wr.put(uint32(bits), uint32(v-11))
+	}
+}
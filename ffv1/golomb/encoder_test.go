@@ -0,0 +1,118 @@
+package golomb
+
+import (
+	"testing"
+)
+
+// A plane of samples for TestEncoderSymmetry, each in a context.
+type testPlane struct {
+	width    uint32
+	bits     uint
+	contexts []int32
+	values   []int32
+}
+
+// Appends a line to the plane, coding fn(x) in context ctx(x).
+func (p *testPlane) line(ctx func(x int) int32, fn func(x int) int32) {
+	for x := 0; x < int(p.width); x++ {
+		p.contexts = append(p.contexts, ctx(x))
+		p.values = append(p.values, fn(x))
+	}
+}
+
+// Symbols put with an Encoder must read back the same from a Coder,
+// across runs which reach the end of the line, escaped values, and the
+// resets of NewPlane and NewLine.
+func TestEncoderSymmetry(t *testing.T) {
+	zero := func(x int) int32 { return 0 }
+	one := func(x int) int32 { return 1 }
+
+	// Long runs push the run index up, which NewPlane must reset.
+	wide := &testPlane{width: 200, bits: 8}
+	wide.line(zero, zero)
+	wide.line(zero, zero)
+	wide.line(zero, func(x int) int32 {
+		if x == 150 {
+			return -3
+		}
+		return 0
+	})
+	// Runs broken up after every run length, up to the largest.
+	wide.line(zero, func(x int) int32 {
+		if x == 1 || x == 3 || x == 7 || x == 15 || x == 31 || x == 63 || x == 127 {
+			return 1
+		}
+		return 0
+	})
+	// Values too large for a Rice code, which are escaped, and the
+	// extremes of the sample range.
+	wide.line(one, func(x int) int32 {
+		return []int32{127, -128, 100, -100, 0, 1, -1, 64}[x%8]
+	})
+	// Runs between escaped values.
+	wide.line(func(x int) int32 {
+		if x%10 == 9 {
+			return 2
+		}
+		return 0
+	}, func(x int) int32 {
+		if x%10 == 9 {
+			return -128
+		}
+		return 0
+	})
+
+	// A narrower plane, at 9 bits as JPEG2000-RCT chroma is coded,
+	// starting with runs.
+	narrow := &testPlane{width: 12, bits: 9}
+	narrow.line(zero, zero)
+	narrow.line(zero, func(x int) int32 {
+		if x == 11 {
+			return 255
+		}
+		return 0
+	})
+	narrow.line(one, func(x int) int32 { return -256 + int32(x)*43 })
+	narrow.line(zero, zero)
+
+	planes := []*testPlane{wide, narrow, wide}
+
+	e := NewEncoder()
+	var states [][]State
+	for _, p := range planes {
+		e.NewPlane(p.width)
+		states = append(states, []State{NewState(), NewState(), NewState()})
+		for i, v := range p.values {
+			if i%int(p.width) == 0 {
+				e.NewLine()
+			}
+			ctx := p.contexts[i]
+			e.PutSG(ctx, &states[len(states)-1][ctx], v, p.bits)
+		}
+	}
+	buf := e.Finish()
+
+	c := NewCoder(buf)
+	states = nil
+	for n, p := range planes {
+		c.NewPlane(p.width)
+		states = append(states, []State{NewState(), NewState(), NewState()})
+		for i, v := range p.values {
+			if i%int(p.width) == 0 {
+				c.NewLine()
+			}
+			ctx := p.contexts[i]
+			got := c.SG(ctx, &states[len(states)-1][ctx], p.bits)
+			if got != v {
+				t.Fatalf("plane %d: sample %d is %d, not %d", n, i, got, v)
+			}
+		}
+	}
+	if c.Err() != nil {
+		t.Fatalf("unexpected error: %s", c.Err().Error())
+	}
+	// Nothing but padding is left.
+	if pos := c.r.pos; pos < len(buf) {
+		t.Errorf("read %d of %d bytes", pos, len(buf))
+	}
+}
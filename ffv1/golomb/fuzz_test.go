@@ -0,0 +1,92 @@
+package golomb
+
+import (
+	"testing"
+)
+
+// Plane width used by the fuzz target, narrow enough for runs to reach
+// the end of lines.
+const fuzzWidth = 16
+
+// FuzzSG decodes symbols from arbitrary data, which must not panic or
+// hang, and checks that symbols encoded from it decode back the same,
+// from any starting state.
+func FuzzSG(f *testing.F) {
+	f.Add([]byte{}, uint8(8), uint32(0))
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00}, uint8(8), uint32(0))
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, uint8(9), uint32(0))
+	// Full scale values, alternating sign, in context 1.
+	large := make([]byte, 3*fuzzWidth*4)
+	for i := 0; i < len(large); i += 3 {
+		large[i] = 1
+		large[i+1] = byte(0x7F + i%2)
+		large[i+2] = 0xFF
+	}
+	f.Add(large, uint8(8), uint32(0))
+	f.Add(large, uint8(0), uint32(0))
+	// A state far beyond what valid data leads to, so k is clamped.
+	f.Add(large, uint8(8), uint32(1<<30))
+	f.Add([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F, 0x20, 0x21}, uint8(8), uint32(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, bits uint8, errorSum uint32) {
+		// Up to 16 bits per sample, plus one for JPEG2000-RCT.
+		b := uint(bits%10) + 8
+
+		// Decoding arbitrary data must be safe. Past the end of the
+		// buffer, the coder is fed zeroes, so cap the symbol count.
+		c := NewCoder(data)
+		c.NewPlane(fuzzWidth)
+		states := []State{NewState(), NewState(), NewState()}
+		for i := 0; i < 8*len(data)+fuzzWidth && c.Err() == nil; i++ {
+			if i%fuzzWidth == 0 {
+				c.NewLine()
+			}
+			ctx := int32(i % 3)
+			c.SG(ctx, &states[ctx], b)
+		}
+
+		// Round trip, in whole lines, with one sample per three bytes:
+		// its context and its value, which covers the full range of
+		// the sample, so error_sum, and thus k, can get large.
+		var contexts, values []int32
+		for i := 0; i+2 < len(data); i += 3 {
+			// Zero contexts, and thus run mode, come up often.
+			contexts = append(contexts, int32(data[i]%3))
+			v := int32(data[i+1])<<8 | int32(data[i+2])
+			values = append(values, sign_extend(v, b))
+		}
+		values = values[:len(values)/fuzzWidth*fuzzWidth]
+
+		// Context 1 may start from any error_sum, such as damaged data
+		// can leave, which the encoder and decoder must agree on.
+		initial := []State{NewState(), NewState(), NewState()}
+		initial[1].error_sum = int32(errorSum>>1) + 4
+
+		e := NewEncoder()
+		e.NewPlane(fuzzWidth)
+		states = append([]State(nil), initial...)
+		for i, v := range values {
+			if i%fuzzWidth == 0 {
+				e.NewLine()
+			}
+			e.PutSG(contexts[i], &states[contexts[i]], v, b)
+		}
+		buf := e.Finish()
+
+		c = NewCoder(buf)
+		c.NewPlane(fuzzWidth)
+		states = append([]State(nil), initial...)
+		for i, v := range values {
+			if i%fuzzWidth == 0 {
+				c.NewLine()
+			}
+			got := c.SG(contexts[i], &states[contexts[i]], b)
+			if got != v {
+				t.Fatalf("symbol %d: got %d, want %d", i, got, v)
+			}
+		}
+		if c.Err() != nil {
+			t.Fatalf("unexpected error: %s", c.Err().Error())
+		}
+	})
+}
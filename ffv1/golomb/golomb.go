@@ -39,6 +39,13 @@ func NewCoder(buf []byte) *Coder {
 	return ret
 }
 
+// Err returns the first error hit while decoding, if any, such as
+// running out of data. Symbols read after an error are garbage, but
+// reading them is safe.
+func (c *Coder) Err() error {
+	return c.r.err
+}
+
 // NewPlane should be called on a given Coder as each new Plane is
 // processed. It resets the run index and sets the slice width.
 //
@@ -140,6 +147,11 @@ func (c *Coder) get_vlc_symbol(state *State, bits uint) int32 {
 		k++
 		i += i
 	}
+	// Valid streams never get here, but damaged ones can otherwise
+	// grow error_sum, and thus k, without bound. Same as FFmpeg.
+	if k > uint32(bits) {
+		k = uint32(bits)
+	}
 
 	v := c.get_sr_golomb(k, bits)
 
@@ -149,6 +161,15 @@ func (c *Coder) get_vlc_symbol(state *State, bits uint) int32 {
 
 	ret := sign_extend(v+state.bias, bits)
 
+	state.update(v)
+
+	return ret
+}
+
+// Adapts the state to the last coded symbol.
+//
+// See: 3.8.2.3. Scalar Mode
+func (state *State) update(v int32) {
 	state.error_sum += abs32(v)
 	state.drift += v
 
@@ -165,8 +186,6 @@ func (c *Coder) get_vlc_symbol(state *State, bits uint) int32 {
 		state.bias = min32(state.bias+1, 127)
 		state.drift = min32(state.drift-state.count, 0)
 	}
-
-	return ret
 }
 
 // Gets the next signed Golomb-Rice code
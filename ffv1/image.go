@@ -0,0 +1,284 @@
+package ffv1
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Image returns the frame as an image.Image, of the most fitting
+// standard library type:
+//   - 8-bit YCbCr with chroma, as *image.YCbCr, or *image.NYCbCrA if it
+//     has alpha, sharing the frame's planes. Chroma subsampling must be
+//     one of the ratios image.YCbCr supports.
+//   - High bit depth YCbCr with chroma, or 8-bit YCbCr with any other
+//     subsampling, as a *YCbCr16.
+//   - Luma only, as *image.Gray or *image.Gray16, or *image.NRGBA or
+//     *image.NRGBA64 if it has alpha.
+//   - RGB, as *image.NRGBA or, for high bit depths, *image.NRGBA64.
+//
+// High bit depth samples are scaled to 16 bits. Image data is copied,
+// except where noted. Float frames are not supported; see PlaneFloat32.
+func (f *Frame) Image() (image.Image, error) {
+	if f.Float {
+		return nil, fmt.Errorf("float frames have no image.Image representation")
+	}
+
+	rect := image.Rect(0, 0, int(f.Width), int(f.Height))
+
+	if f.ColorSpace == RGB {
+		if !f.HasChroma {
+			return nil, fmt.Errorf("RGB frame without chroma planes")
+		}
+		if f.BitDepth == 8 {
+			return f.nrgba(rect), nil
+		}
+		return f.nrgba64(rect), nil
+	}
+
+	if !f.HasChroma {
+		if f.HasAlpha {
+			if f.BitDepth == 8 {
+				return f.nrgba(rect), nil
+			}
+			return f.nrgba64(rect), nil
+		}
+		if f.BitDepth == 8 {
+			return &image.Gray{Pix: f.Buf[0], Stride: int(f.Width), Rect: rect}, nil
+		}
+		return f.gray16(rect), nil
+	}
+
+	ratio, ok := subsampleRatio(f.ChromaSubsampleH, f.ChromaSubsampleV)
+	if f.BitDepth != 8 || !ok {
+		return f.ycbcr16(rect), nil
+	}
+
+	chromaWidth := (int(f.Width) + (1 << f.ChromaSubsampleH) - 1) >> f.ChromaSubsampleH
+	ycbcr := image.YCbCr{
+		Y:              f.Buf[0],
+		Cb:             f.Buf[1],
+		Cr:             f.Buf[2],
+		YStride:        int(f.Width),
+		CStride:        chromaWidth,
+		SubsampleRatio: ratio,
+		Rect:           rect,
+	}
+	if f.HasAlpha {
+		return &image.NYCbCrA{YCbCr: ycbcr, A: f.Buf[3], AStride: int(f.Width)}, nil
+	}
+
+	return &ycbcr, nil
+}
+
+// Maps log2 chroma subsampling values to the ratios image.YCbCr supports.
+func subsampleRatio(h uint8, v uint8) (image.YCbCrSubsampleRatio, bool) {
+	switch {
+	case h == 0 && v == 0:
+		return image.YCbCrSubsampleRatio444, true
+	case h == 1 && v == 0:
+		return image.YCbCrSubsampleRatio422, true
+	case h == 1 && v == 1:
+		return image.YCbCrSubsampleRatio420, true
+	case h == 0 && v == 1:
+		return image.YCbCrSubsampleRatio440, true
+	case h == 2 && v == 0:
+		return image.YCbCrSubsampleRatio411, true
+	case h == 2 && v == 1:
+		return image.YCbCrSubsampleRatio410, true
+	}
+	return 0, false
+}
+
+// Scales a sample of the given bit depth to 16 bits, by replicating
+// the top bits into the bottom ones, so that the maximum maps to the
+// maximum.
+func scale16(v uint16, bits uint8) uint16 {
+	if bits >= 16 {
+		return v
+	}
+	if bits == 8 {
+		return v<<8 | v
+	}
+	return v<<(16-bits) | v>>(2*bits-16)
+}
+
+// Gets a sample from a plane, of whatever bit depth, scaled to 16 bits.
+func (f *Frame) sample16(p int, i int) uint16 {
+	if f.BitDepth == 8 {
+		return scale16(uint16(f.Buf[p][i]), 8)
+	}
+	return scale16(f.Buf16[p][i], f.BitDepth)
+}
+
+func (f *Frame) gray16(rect image.Rectangle) *image.Gray16 {
+	ret := image.NewGray16(rect)
+	for i := 0; i < int(f.Width*f.Height); i++ {
+		binary.BigEndian.PutUint16(ret.Pix[i*2:], f.sample16(0, i))
+	}
+	return ret
+}
+
+// Converts planar GBR(A), or luma and alpha, to an image.NRGBA.
+func (f *Frame) nrgba(rect image.Rectangle) *image.NRGBA {
+	ret := image.NewNRGBA(rect)
+	for i := 0; i < int(f.Width*f.Height); i++ {
+		pix := ret.Pix[i*4 : i*4+4]
+		if f.ColorSpace == RGB {
+			pix[0] = f.Buf[2][i]
+			pix[1] = f.Buf[0][i]
+			pix[2] = f.Buf[1][i]
+		} else {
+			pix[0] = f.Buf[0][i]
+			pix[1] = f.Buf[0][i]
+			pix[2] = f.Buf[0][i]
+		}
+		pix[3] = 0xFF
+		if f.HasAlpha {
+			pix[3] = f.Buf[len(f.Buf)-1][i]
+		}
+	}
+	return ret
+}
+
+// Converts planar GBR(A), or luma and alpha, to an image.NRGBA64.
+func (f *Frame) nrgba64(rect image.Rectangle) *image.NRGBA64 {
+	ret := image.NewNRGBA64(rect)
+	numPlanes := numFramePlanes(f)
+	for i := 0; i < int(f.Width*f.Height); i++ {
+		var r, g, b uint16
+		if f.ColorSpace == RGB {
+			r = f.sample16(2, i)
+			g = f.sample16(0, i)
+			b = f.sample16(1, i)
+		} else {
+			r = f.sample16(0, i)
+			g = r
+			b = r
+		}
+		a := uint16(0xFFFF)
+		if f.HasAlpha {
+			a = f.sample16(numPlanes-1, i)
+		}
+
+		pix := ret.Pix[i*8 : i*8+8]
+		binary.BigEndian.PutUint16(pix[0:], r)
+		binary.BigEndian.PutUint16(pix[2:], g)
+		binary.BigEndian.PutUint16(pix[4:], b)
+		binary.BigEndian.PutUint16(pix[6:], a)
+	}
+	return ret
+}
+
+func (f *Frame) ycbcr16(rect image.Rectangle) *YCbCr16 {
+	chromaWidth := (int(f.Width) + (1 << f.ChromaSubsampleH) - 1) >> f.ChromaSubsampleH
+	chromaHeight := (int(f.Height) + (1 << f.ChromaSubsampleV) - 1) >> f.ChromaSubsampleV
+
+	ret := &YCbCr16{
+		YStride:    int(f.Width),
+		CStride:    chromaWidth,
+		SubsampleH: f.ChromaSubsampleH,
+		SubsampleV: f.ChromaSubsampleV,
+		Rect:       rect,
+	}
+
+	plane := func(p int, size int) []uint16 {
+		out := make([]uint16, size)
+		for i := range out {
+			out[i] = f.sample16(p, i)
+		}
+		return out
+	}
+
+	ret.Y = plane(0, int(f.Width*f.Height))
+	ret.Cb = plane(1, chromaWidth*chromaHeight)
+	ret.Cr = plane(2, chromaWidth*chromaHeight)
+	if f.HasAlpha {
+		ret.A = plane(3, int(f.Width*f.Height))
+	}
+
+	return ret
+}
+
+// YCbCr16 is an in-memory image of 16-bit Y'CbCr colours, with optional
+// alpha, for bit depths and chroma subsamplings image.YCbCr cannot hold.
+//
+// Like image.YCbCr, samples are full range, and the chroma planes are
+// subsampled by 1<<SubsampleH and 1<<SubsampleV, rounding up.
+type YCbCr16 struct {
+	Y, Cb, Cr []uint16
+	// Alpha plane, or nil if the image is opaque. It has the same
+	// layout as Y.
+	A       []uint16
+	YStride int
+	CStride int
+	// The log2 horizontal chroma subsampling value.
+	SubsampleH uint8
+	// The log2 vertical chroma subsampling value.
+	SubsampleV uint8
+	Rect       image.Rectangle
+}
+
+// ColorModel returns color.NRGBA64Model, as At converts to RGB.
+func (p *YCbCr16) ColorModel() color.Model {
+	return color.NRGBA64Model
+}
+
+// Bounds returns the image's bounds.
+func (p *YCbCr16) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+// At returns the colour of the pixel at (x, y), converted to RGB.
+func (p *YCbCr16) At(x int, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.NRGBA64{}
+	}
+
+	yi := (y-p.Rect.Min.Y)*p.YStride + (x - p.Rect.Min.X)
+	ci := ((y-p.Rect.Min.Y)>>p.SubsampleV)*p.CStride + ((x - p.Rect.Min.X) >> p.SubsampleH)
+
+	r, g, b := ycbcr16ToRGB(p.Y[yi], p.Cb[ci], p.Cr[ci])
+	a := uint16(0xFFFF)
+	if p.A != nil {
+		a = p.A[yi]
+	}
+
+	return color.NRGBA64{R: r, G: g, B: b, A: a}
+}
+
+// Opaque reports whether the image has no alpha plane, or an alpha
+// plane which is fully opaque.
+func (p *YCbCr16) Opaque() bool {
+	for _, a := range p.A {
+		if a != 0xFFFF {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts full range 16-bit Y'CbCr to RGB, using the same JFIF
+// coefficients as color.YCbCrToRGB, in 16.16 fixed point.
+func ycbcr16ToRGB(y uint16, cb uint16, cr uint16) (uint16, uint16, uint16) {
+	yy := int64(y) << 16
+	cb1 := int64(cb) - 0x8000
+	cr1 := int64(cr) - 0x8000
+
+	r := (yy + 91881*cr1) >> 16
+	g := (yy - 22554*cb1 - 46802*cr1) >> 16
+	b := (yy + 116130*cb1) >> 16
+
+	return clamp16(r), clamp16(g), clamp16(b)
+}
+
+func clamp16(v int64) uint16 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(v)
+}
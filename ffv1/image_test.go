@@ -0,0 +1,184 @@
+package ffv1
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSubsampleRatio(t *testing.T) {
+	tests := []struct {
+		h     uint8
+		v     uint8
+		ratio image.YCbCrSubsampleRatio
+		ok    bool
+	}{
+		{0, 0, image.YCbCrSubsampleRatio444, true},
+		{1, 0, image.YCbCrSubsampleRatio422, true},
+		{1, 1, image.YCbCrSubsampleRatio420, true},
+		{0, 1, image.YCbCrSubsampleRatio440, true},
+		{2, 0, image.YCbCrSubsampleRatio411, true},
+		{2, 1, image.YCbCrSubsampleRatio410, true},
+		{2, 2, 0, false},
+		{0, 2, 0, false},
+	}
+
+	for _, test := range tests {
+		ratio, ok := subsampleRatio(test.h, test.v)
+		if ratio != test.ratio || ok != test.ok {
+			t.Errorf("%d, %d: got %v, %t, not %v, %t", test.h, test.v, ratio, ok, test.ratio, test.ok)
+		}
+	}
+}
+
+func TestScale16(t *testing.T) {
+	tests := []struct {
+		v    uint16
+		bits uint8
+		want uint16
+	}{
+		{0, 8, 0},
+		{0x80, 8, 0x8080},
+		{0xFF, 8, 0xFFFF},
+		{0, 10, 0},
+		{0x200, 10, 0x8020},
+		{0x3FF, 10, 0xFFFF},
+		{0x800, 12, 0x8008},
+		{0xFFF, 12, 0xFFFF},
+		{0x3FFF, 14, 0xFFFF},
+		{0x1234, 16, 0x1234},
+	}
+
+	for _, test := range tests {
+		if got := scale16(test.v, test.bits); got != test.want {
+			t.Errorf("%#x at %d bits: got %#x, not %#x", test.v, test.bits, got, test.want)
+		}
+	}
+}
+
+// Makes a 4x2 frame, whose samples are all 'sample' in plane 0, one
+// more in plane 1, and so on.
+func imageTestFrame(bits uint8, colorSpace int, chroma bool, alpha bool, h uint8, v uint8, sample uint16) *Frame {
+	f := &Frame{
+		Width:            4,
+		Height:           2,
+		BitDepth:         bits,
+		ColorSpace:       colorSpace,
+		HasChroma:        chroma,
+		HasAlpha:         alpha,
+		ChromaSubsampleH: h,
+		ChromaSubsampleV: v,
+	}
+	sizes := []int{8}
+	if chroma {
+		cw := (4 + (1 << h) - 1) >> h
+		ch := (2 + (1 << v) - 1) >> v
+		sizes = append(sizes, cw*ch, cw*ch)
+	}
+	if alpha {
+		sizes = append(sizes, 8)
+	}
+	for p, size := range sizes {
+		if bits == 8 {
+			plane := make([]byte, size)
+			for i := range plane {
+				plane[i] = byte(sample) + byte(p)
+			}
+			f.Buf = append(f.Buf, plane)
+		} else {
+			plane := make([]uint16, size)
+			for i := range plane {
+				plane[i] = sample + uint16(p)
+			}
+			f.Buf16 = append(f.Buf16, plane)
+		}
+	}
+	return f
+}
+
+func TestFrameImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+		check func(img image.Image) bool
+	}{
+		{"420", imageTestFrame(8, YCbCr, true, false, 1, 1, 16), func(img image.Image) bool {
+			y, ok := img.(*image.YCbCr)
+			return ok && y.SubsampleRatio == image.YCbCrSubsampleRatio420 && len(y.Cb) == 2 && y.CStride == 2 &&
+				y.YCbCrAt(3, 1) == color.YCbCr{16, 17, 18}
+		}},
+		{"411", imageTestFrame(8, YCbCr, true, false, 2, 0, 16), func(img image.Image) bool {
+			y, ok := img.(*image.YCbCr)
+			return ok && y.SubsampleRatio == image.YCbCrSubsampleRatio411 && y.CStride == 1
+		}},
+		{"444 alpha", imageTestFrame(8, YCbCr, true, true, 0, 0, 16), func(img image.Image) bool {
+			y, ok := img.(*image.NYCbCrA)
+			return ok && y.SubsampleRatio == image.YCbCrSubsampleRatio444 && y.A[0] == 19
+		}},
+		// image.YCbCr has no 4:1:0 with both halved.
+		{"410", imageTestFrame(8, YCbCr, true, false, 2, 2, 16), func(img image.Image) bool {
+			y, ok := img.(*YCbCr16)
+			return ok && y.SubsampleH == 2 && y.SubsampleV == 2 && y.CStride == 1 && len(y.Cb) == 1 && y.Y[0] == 0x1010
+		}},
+		{"420 10-bit", imageTestFrame(10, YCbCr, true, false, 1, 1, 0x200), func(img image.Image) bool {
+			y, ok := img.(*YCbCr16)
+			return ok && y.SubsampleH == 1 && y.SubsampleV == 1 && len(y.Cb) == 2 &&
+				y.Y[7] == 0x8020 && y.Cb[0] == 0x8060 && y.Cr[1] == 0x80A0 && y.A == nil
+		}},
+		{"mono", imageTestFrame(8, YCbCr, false, false, 0, 0, 16), func(img image.Image) bool {
+			g, ok := img.(*image.Gray)
+			return ok && g.GrayAt(3, 1).Y == 16
+		}},
+		{"mono 12-bit", imageTestFrame(12, YCbCr, false, false, 0, 0, 0xFFF), func(img image.Image) bool {
+			g, ok := img.(*image.Gray16)
+			return ok && g.Gray16At(3, 1).Y == 0xFFFF
+		}},
+		{"mono alpha", imageTestFrame(8, YCbCr, false, true, 0, 0, 16), func(img image.Image) bool {
+			n, ok := img.(*image.NRGBA)
+			return ok && n.NRGBAAt(0, 0) == color.NRGBA{16, 16, 16, 17}
+		}},
+		// Planes are G, B, R.
+		{"RGB", imageTestFrame(8, RGB, true, false, 0, 0, 16), func(img image.Image) bool {
+			n, ok := img.(*image.NRGBA)
+			return ok && n.NRGBAAt(3, 1) == color.NRGBA{18, 16, 17, 0xFF}
+		}},
+		{"RGB 10-bit alpha", imageTestFrame(10, RGB, true, true, 0, 0, 0x100), func(img image.Image) bool {
+			n, ok := img.(*image.NRGBA64)
+			return ok && n.NRGBA64At(3, 1) == color.NRGBA64{0x4090, 0x4010, 0x4050, 0x40D0}
+		}},
+	}
+
+	for _, test := range tests {
+		img, err := test.frame.Image()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		if img.Bounds() != image.Rect(0, 0, 4, 2) {
+			t.Errorf("%s: bounds are %v", test.name, img.Bounds())
+		}
+		if !test.check(img) {
+			t.Errorf("%s: got an unexpected %T: %+v", test.name, img, img)
+		}
+	}
+
+	float := imageTestFrame(16, YCbCr, true, false, 0, 0, 0)
+	float.Float = true
+	_, err := float.Image()
+	if err == nil {
+		t.Errorf("no error for a float frame")
+	}
+}
+
+// 8-bit planes are shared, not copied.
+func TestFrameImageShared(t *testing.T) {
+	f := imageTestFrame(8, YCbCr, true, false, 1, 1, 16)
+	img, err := f.Image()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	y := img.(*image.YCbCr)
+	if &y.Y[0] != &f.Buf[0][0] || &y.Cb[0] != &f.Buf[1][0] || &y.Cr[0] != &f.Buf[2][0] {
+		t.Errorf("planes were copied")
+	}
+}
@@ -2,8 +2,10 @@ package ffv1
 
 // Converts one line from 9-bit JPEG2000-RCT to planar GBR.
 //
-// See: 3.7.2. RGB
-func rct8(dst [][]byte, src [][]uint16, w int, h int, stride int, offset int) {
+// See: * 3.7.2. RGB
+//      * 4.5.12. slice_rct_by_coef
+//      * 4.5.13. slice_rct_ry_coef
+func rct8(dst [][]byte, src [][]uint16, w int, h int, stride int, offset int, by int32, ry int32) {
 	Y := src[0][offset:]
 	Cb := src[1][offset:]
 	Cr := src[2][offset:]
@@ -14,7 +16,7 @@ func rct8(dst [][]byte, src [][]uint16, w int, h int, stride int, offset int) {
 		for x := 0; x < w; x++ {
 			Cbtmp := int32(Cb[(y*stride)+x]) - (1 << 8) // Missing from spec
 			Crtmp := int32(Cr[(y*stride)+x]) - (1 << 8) // Missing from spec
-			g := int32(Y[(y*stride)+x]) - ((int32(Cbtmp) + int32(Crtmp)) >> 2)
+			g := int32(Y[(y*stride)+x]) - ((int32(Cbtmp)*by + int32(Crtmp)*ry) >> 2)
 			r := int32(Crtmp) + g
 			b := int32(Cbtmp) + g
 			G[(y*stride)+x] = byte(g)
@@ -35,8 +37,10 @@ func rct8(dst [][]byte, src [][]uint16, w int, h int, stride int, offset int) {
 
 // Converts one line from 10 to 16 bit JPEG2000-RCT to planar GBR, in place.
 //
-// See: 3.7.2. RGB
-func rctMid(src [][]uint16, w int, h int, stride int, offset int, bits uint) {
+// See: * 3.7.2. RGB
+//      * 4.5.12. slice_rct_by_coef
+//      * 4.5.13. slice_rct_ry_coef
+func rctMid(src [][]uint16, w int, h int, stride int, offset int, bits uint, by int32, ry int32) {
 	Y := src[0][offset:]
 	Cb := src[1][offset:]
 	Cr := src[2][offset:]
@@ -44,7 +48,7 @@ func rctMid(src [][]uint16, w int, h int, stride int, offset int, bits uint) {
 		for x := 0; x < w; x++ {
 			Cbtmp := int32(Cb[(y*stride)+x]) - int32(1<<bits) // Missing from spec
 			Crtmp := int32(Cr[(y*stride)+x]) - int32(1<<bits) // Missing from spec
-			b := int32(Y[(y*stride)+x]) - ((int32(Cbtmp) + int32(Crtmp)) >> 2)
+			b := int32(Y[(y*stride)+x]) - ((int32(Cbtmp)*by + int32(Crtmp)*ry) >> 2)
 			r := int32(Crtmp) + b
 			g := int32(Cbtmp) + b
 			Y[(y*stride)+x] = uint16(g)
@@ -54,12 +58,14 @@ func rctMid(src [][]uint16, w int, h int, stride int, offset int, bits uint) {
 	}
 }
 
-// Converts one line from 17-bit JPEG2000-RCT to planar GBR, in place.
+// Converts one line from JPEG2000-RCT, with one more bit than 'bits',
+// in 32-bit samples, to planar GBR. Used for 16-bit, and for 9 to
+// 15-bit with alpha.
 //
-// Currently unused until I refactor and allow for 17-bit buffers.
-//
-// See: 3.7.2. RGB
-func rct16(dst [][]uint16, src [][]uint32, w int, h int, stride int, offset int) {
+// See: * 3.7.2. RGB
+//      * 4.5.12. slice_rct_by_coef
+//      * 4.5.13. slice_rct_ry_coef
+func rct16(dst [][]uint16, src [][]uint32, w int, h int, stride int, offset int, bits uint, by int32, ry int32) {
 	Y := src[0][offset:]
 	Cb := src[1][offset:]
 	Cr := src[2][offset:]
@@ -68,9 +74,9 @@ func rct16(dst [][]uint16, src [][]uint32, w int, h int, stride int, offset int)
 	R := dst[2][offset:]
 	for y := 0; y < h; y++ {
 		for x := 0; x < w; x++ {
-			Cbtmp := int32(Cb[(y*stride)+x]) - (1 << 16) // Missing from spec
-			Crtmp := int32(Cr[(y*stride)+x]) - (1 << 16) // Missing from spec
-			g := int32(Y[(y*stride)+x]) - ((int32(Cbtmp) + int32(Crtmp)) >> 2)
+			Cbtmp := int32(Cb[(y*stride)+x]) - (1 << bits) // Missing from spec
+			Crtmp := int32(Cr[(y*stride)+x]) - (1 << bits) // Missing from spec
+			g := int32(Y[(y*stride)+x]) - ((int32(Cbtmp)*by + int32(Crtmp)*ry) >> 2)
 			r := int32(Crtmp) + g
 			b := int32(Cbtmp) + g
 			G[(y*stride)+x] = uint16(g)
@@ -88,3 +94,50 @@ func rct16(dst [][]uint16, src [][]uint32, w int, h int, stride int, offset int)
 		}
 	}
 }
+
+// Copies one line of 8-bit PCM coded RGB, which has no JPEG2000-RCT
+// applied, from the scratch buffer to planar GBR.
+//
+// See: 4.5.11. slice_coding_mode
+func pcm8(dst [][]byte, src [][]uint16, w int, h int, stride int, offset int) {
+	for p := 0; p < len(src); p++ {
+		s := src[p][offset:]
+		d := dst[p][offset:]
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				d[(y*stride)+x] = byte(s[(y*stride)+x])
+			}
+		}
+	}
+}
+
+// Converts one line of 10 to 16 bit PCM coded RGB to planar GBR, in place.
+//
+// The first two planes are coded swapped, as rctMid outputs them.
+//
+// See: 4.5.11. slice_coding_mode
+func pcmMid(src [][]uint16, w int, h int, stride int, offset int) {
+	Y := src[0][offset:]
+	Cb := src[1][offset:]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			Y[(y*stride)+x], Cb[(y*stride)+x] = Cb[(y*stride)+x], Y[(y*stride)+x]
+		}
+	}
+}
+
+// Copies one line of 16-bit PCM coded RGB, which has no JPEG2000-RCT
+// applied, from the scratch buffer to planar GBR.
+//
+// See: 4.5.11. slice_coding_mode
+func pcm16(dst [][]uint16, src [][]uint32, w int, h int, stride int, offset int) {
+	for p := 0; p < len(src); p++ {
+		s := src[p][offset:]
+		d := dst[p][offset:]
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				d[(y*stride)+x] = uint16(s[(y*stride)+x])
+			}
+		}
+	}
+}
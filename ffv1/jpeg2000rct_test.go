@@ -0,0 +1,282 @@
+package ffv1
+
+import (
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// Makes the planes of frame n of an RGB test sequence: G, B, R and
+// alpha, in the order Buf and Buf16 hold them. Samples cover the whole
+// range, with the largest differences between planes at the edges.
+func rgbTestPlanes(width int, height int, bits uint8, alpha bool, n int) [][]uint32 {
+	planes := 3
+	if alpha {
+		planes++
+	}
+	mask := uint32(1)<<bits - 1
+
+	ret := make([][]uint32, planes)
+	for p := range ret {
+		ret[p] = make([]uint32, width*height)
+		for i := range ret[p] {
+			x, y := i%width, i/width
+			switch {
+			case x == 0:
+				// Black against white.
+				ret[p][i] = mask * uint32((p+y)%2)
+			case x == width-1:
+				ret[p][i] = mask * uint32((p+y+n)%2)
+			default:
+				ret[p][i] = uint32(x*37+y*11+n*13+p*71+(x*y)%17) << (bits - 8) & mask
+			}
+		}
+	}
+	return ret
+}
+
+// A version 4 RGB stream, which the Encoder can not write, with slice
+// headers given per frame.
+type rgbStream struct {
+	record         configRecord
+	width          uint32
+	height         uint32
+	initial_states [][][]uint8
+	slices         []slice
+}
+
+// Sets up an RGB stream with 'slices' slices side by side, using the
+// quantization table sets the Encoder would.
+func newRGBStream(t *testing.T, width uint32, height uint32, bits uint8, alpha bool, slices int) *rgbStream {
+	t.Helper()
+
+	e, err := NewEncoder(EncoderOptions{Width: width, Height: height, HasChroma: true, HasAlpha: alpha, SlicesH: slices, EC: true})
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+
+	ret := &rgbStream{record: e.record, width: width, height: height, slices: e.slices}
+	ret.record.version = 4
+	ret.record.micro_version = 3
+	ret.record.colorspace_type = RGB
+	ret.record.bits_per_raw_sample = bits
+	ret.record.intra = 0
+	_, ret.initial_states = initialStates(&ret.record)
+
+	return ret
+}
+
+// Codes a slice header, as parseSliceHeader reads it.
+//
+// See: 4.5. Slice Header
+func putSliceHeader(c *rangecoder.Encoder, record *configRecord, s *slice) {
+	slice_state := make([]uint8, contextSize)
+	for i := range slice_state {
+		slice_state[i] = 128
+	}
+
+	c.PutUR(slice_state, s.header.slice_x)
+	c.PutUR(slice_state, s.header.slice_y)
+	c.PutUR(slice_state, s.header.slice_width_minus1)
+	c.PutUR(slice_state, s.header.slice_height_minus1)
+	for _, idx := range s.header.quant_table_set_index {
+		c.PutUR(slice_state, uint32(idx))
+	}
+	c.PutUR(slice_state, uint32(s.header.picture_structure))
+	c.PutUR(slice_state, s.header.sar_num)
+	c.PutUR(slice_state, s.header.sar_den)
+	if record.version > 3 {
+		c.PutBR(slice_state, s.header.reset_contexts)
+		c.PutUR(slice_state, s.header.slice_coding_mode)
+		if s.header.slice_coding_mode != 1 && record.colorspace_type == RGB {
+			c.PutUR(slice_state, s.header.slice_rct_by_coef)
+			c.PutUR(slice_state, s.header.slice_rct_ry_coef)
+		}
+	}
+	if hasRemap(record) {
+		c.PutUR(slice_state, s.header.remap)
+	}
+}
+
+// Applies the JPEG2000-RCT, with a slice's coefficients, to the part
+// of the planes it covers, or for PCM slices, puts the planes in the
+// order they are coded in. It is the inverse of rct8, rctMid and rct16,
+// or pcm8, pcmMid and pcm16.
+func (r *rgbStream) transform(planes [][]uint32, s *slice) [][]uint32 {
+	bits := r.record.bits_per_raw_sample
+	mid := bits >= 9 && bits <= 15 && !r.record.extra_plane
+
+	ret := make([][]uint32, len(planes))
+	for p := range ret {
+		ret[p] = append([]uint32(nil), planes[p]...)
+	}
+	if s.header.slice_coding_mode == 1 {
+		if mid {
+			ret[0], ret[1] = ret[1], ret[0]
+		}
+		return ret
+	}
+
+	// rctMid predicts from the second plane, and the others from the
+	// first.
+	base, cb := 0, 1
+	if mid {
+		base, cb = 1, 0
+	}
+	by := int32(s.header.slice_rct_by_coef)
+	ry := int32(s.header.slice_rct_ry_coef)
+	for y := s.start_y; y < s.start_y+s.height; y++ {
+		for x := s.start_x; x < s.start_x+s.width; x++ {
+			i := y*r.width + x
+			Cbtmp := int32(planes[cb][i]) - int32(planes[base][i])
+			Crtmp := int32(planes[2][i]) - int32(planes[base][i])
+			ret[0][i] = uint32(int32(planes[base][i]) + (Cbtmp*by+Crtmp*ry)>>2)
+			ret[1][i] = uint32(Cbtmp + 1<<bits)
+			ret[2][i] = uint32(Crtmp + 1<<bits)
+		}
+	}
+	return ret
+}
+
+// Codes a line of a plane, as decodeLine reads it.
+//
+// See: 4.7. Line
+func (r *rgbStream) putLine(c *rangecoder.Encoder, s *slice, plane []uint32, y int, p int, qt int) {
+	w, h, stride := int(s.width), int(s.height), int(r.width)
+	bits := r.record.bits_per_raw_sample
+
+	if s.header.slice_coding_mode == 1 {
+		for x := 0; x < w; x++ {
+			for i := int(bits) - 1; i >= 0; i-- {
+				c.PutBR([]uint8{128}, plane[y*stride+x]>>uint(i)&1 == 1)
+			}
+		}
+		return
+	}
+
+	shift := bits + 1
+	for x := 0; x < w; x++ {
+		T, L, t, l, tr, tl := deriveBorders32(plane, x, y, w, h, stride)
+		context := getContext(r.record.quant_tables[s.header.quant_table_set_index[qt]], T, L, t, l, tr, tl)
+		diff := int32(plane[y*stride+x]) - int32(getMedian(l, t, l+t-tl))
+		diff = ((diff + (1 << (shift - 1))) & ((1 << shift) - 1)) - (1 << (shift - 1))
+		if context < 0 {
+			context = -context
+			diff = -diff
+		}
+		c.PutSR(s.state[qt][context], diff)
+	}
+}
+
+// Encodes a frame, with the slice headers given, of which only the
+// fields from version 4 on are used. Float samples are given as their
+// 16-bit values, and remapped by slices which have remap set.
+func (r *rgbStream) encode(planes [][]uint32, keyframe bool, headers []sliceHeader) []byte {
+	var packet []byte
+	for i := range r.slices {
+		s := &r.slices[i]
+		s.header.reset_contexts = headers[i].reset_contexts
+		s.header.slice_coding_mode = headers[i].slice_coding_mode
+		s.header.slice_rct_by_coef = headers[i].slice_rct_by_coef
+		s.header.slice_rct_ry_coef = headers[i].slice_rct_ry_coef
+		s.header.remap = headers[i].remap
+
+		c := rangecoder.NewEncoder()
+		if i == 0 {
+			state := make([]uint8, contextSize)
+			for i := range state {
+				state[i] = 128
+			}
+			c.PutBR(state, keyframe)
+		}
+		putSliceHeader(c, &r.record, s)
+		if keyframe || s.header.reset_contexts {
+			resetSliceStates(s, &r.record, r.initial_states)
+		}
+
+		samples := planes
+		if s.header.remap != 0 {
+			samples = r.putRemap(c, s, planes)
+		}
+		coded := r.transform(samples, s)
+		offset := int(s.start_y*r.width + s.start_x)
+		for y := 0; y < int(s.height); y++ {
+			for p, qt := range []int{0, 1, 1, 2}[:len(planes)] {
+				r.putLine(c, s, coded[p][offset:], y, p, qt)
+			}
+		}
+
+		buf := c.SentinalEnd()
+		size := len(buf)
+		buf = append(buf, byte(size>>16), byte(size>>8), byte(size), 0)
+		packet = append(packet, appendCRCParity(buf)...)
+	}
+	return packet
+}
+
+// Checks that the decoded planes of out match planes.
+func checkRGBPlanes(t *testing.T, n int, planes [][]uint32, out *Frame) {
+	t.Helper()
+
+	for p := range planes {
+		for i, want := range planes[p] {
+			var got uint32
+			if out.BitDepth == 8 {
+				got = uint32(out.Buf[p][i])
+			} else {
+				got = uint32(out.Buf16[p][i])
+			}
+			if got != want {
+				t.Fatalf("frame %d: plane %d sample %d is %d, not %d", n, p, i, got, want)
+			}
+		}
+	}
+}
+
+// Slices can be PCM coded, or use any JPEG2000-RCT coefficients, and
+// change from frame to frame.
+func TestSliceCodingMode(t *testing.T) {
+	pcm := sliceHeader{slice_coding_mode: 1}
+	rct := func(by uint32, ry uint32, reset bool) sliceHeader {
+		return sliceHeader{slice_rct_by_coef: by, slice_rct_ry_coef: ry, reset_contexts: reset}
+	}
+	// Per frame, three slices each.
+	frames := [][]sliceHeader{
+		{pcm, rct(2, 1, false), rct(1, 1, false)},
+		{rct(0, 4, false), pcm, rct(3, 1, true)},
+		{rct(4, 0, false), rct(0, 0, false), pcm},
+	}
+
+	tests := []struct {
+		name  string
+		bits  uint8
+		alpha bool
+	}{
+		{"8-bit", 8, false},
+		{"8-bit alpha", 8, true},
+		{"10-bit", 10, false},
+		{"12-bit", 12, false},
+		{"10-bit alpha", 10, true},
+		{"16-bit", 16, false},
+		{"16-bit alpha", 16, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRGBStream(t, 24, 8, test.bits, test.alpha, 3)
+			d, err := NewDecoder(writeConfigRecord(&r.record), r.width, r.height)
+			if err != nil {
+				t.Fatalf("couldn't create decoder: %s", err.Error())
+			}
+
+			for n, headers := range frames {
+				planes := rgbTestPlanes(int(r.width), int(r.height), test.bits, test.alpha, n)
+				out, err := d.DecodeFrame(r.encode(planes, n == 0, headers))
+				if err != nil {
+					t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+				}
+				checkRGBPlanes(t, n, planes, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package ffv1
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// Codes quantization table set i of a record, as parseQuantTableSet
+// reads it.
+//
+// See: 4.9.  Quantization Table Set
+func putQuantTableSet(c *rangecoder.Encoder, record *configRecord, i int) {
+	for j := 0; j < maxContextInputs; j++ {
+		quant_state := make([]uint8, contextSize)
+		for qs := range quant_state {
+			quant_state[qs] = 128
+		}
+		for k := 0; k < 128; {
+			len_minus1 := 0
+			for k+len_minus1+1 < 128 && record.quant_tables[i][j][k+len_minus1+1] == record.quant_tables[i][j][k] {
+				len_minus1++
+			}
+			c.PutUR(quant_state, uint32(len_minus1))
+			k += len_minus1 + 1
+		}
+	}
+}
+
+// Codes the in-band parameters of a version 0 or 1 keyframe, as
+// parseKeyframeHeader reads them.
+//
+// See: 4.1. Parameters
+func putKeyframeHeader(c *rangecoder.Encoder, record *configRecord) {
+	state := make([]uint8, contextSize)
+	for i := range state {
+		state[i] = 128
+	}
+
+	c.PutUR(state, uint32(record.version))
+	c.PutUR(state, uint32(record.coder_type))
+	if record.coder_type > 1 {
+		for i := 1; i < 256; i++ {
+			c.PutSR(state, int32(record.state_transition_delta[i]))
+		}
+	}
+	c.PutUR(state, uint32(record.colorspace_type))
+	// Version 0 does not code it.
+	if record.version > 0 {
+		c.PutUR(state, uint32(record.bits_per_raw_sample))
+	}
+	c.PutBR(state, record.chroma_planes)
+	c.PutUR(state, uint32(record.log2_h_chroma_subsample))
+	c.PutUR(state, uint32(record.log2_v_chroma_subsample))
+	c.PutBR(state, record.extra_plane)
+	putQuantTableSet(c, record, 0)
+}
+
+// Encodes 'count' frames of the synthetic sequence as FFV1 version 0
+// or 1, which the Encoder can not, with every other frame a keyframe.
+// There is no configuration record, and each packet is a single
+// slice, with the parameters at the start of keyframes.
+func encodeLegacy(t *testing.T, opts EncoderOptions, version uint8, count int) [][]byte {
+	t.Helper()
+
+	e, err := NewEncoder(opts)
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+	e.record.version = version
+	e.record.micro_version = 0
+
+	var packets [][]byte
+	for n := 0; n < count; n++ {
+		keyframe := n%2 == 0
+		s := &e.slices[0]
+		if keyframe {
+			resetSliceStates(s, &e.record, e.initial_states)
+		}
+
+		c := rangecoder.NewEncoder()
+		state := make([]uint8, contextSize)
+		for i := range state {
+			state[i] = 128
+		}
+		c.PutBR(state, keyframe)
+		if keyframe {
+			putKeyframeHeader(c, &e.record)
+		}
+		if e.record.coder_type == 2 {
+			c.SetTable(e.state_transition)
+		}
+		e.encodeSliceContent(c, nil, s, testFrame(opts, n))
+		packets = append(packets, c.Finish())
+	}
+
+	return packets
+}
+
+// Codes the slice layout of a version 2 keyframe, as parseSliceLayout
+// reads it.
+//
+// See: 4.3. Frame
+func putSliceLayout(c *rangecoder.Encoder, slices []slice) {
+	state := make([]uint8, contextSize)
+	for i := range state {
+		state[i] = 128
+	}
+
+	c.PutUR(state, uint32(len(slices)))
+	for i := range slices {
+		h := &slices[i].header
+		c.PutUR(state, h.slice_x)
+		c.PutUR(state, h.slice_y)
+		c.PutUR(state, h.slice_width_minus1)
+		c.PutUR(state, h.slice_height_minus1)
+		for _, idx := range h.quant_table_set_index {
+			c.PutUR(state, uint32(idx))
+		}
+	}
+}
+
+// Encodes 'count' frames of the synthetic sequence as FFV1 version 2,
+// with every other frame a keyframe, and the given slice layout on the
+// slice grid of opts. Quantization table set 1 differs from the rest,
+// so that the indexes in the layout matter.
+//
+// Each slice is range coded from its start, with the keyframe bit and
+// the layout at the start of the first, and all but the first end
+// with their size.
+func encodeVersion2(t *testing.T, opts EncoderOptions, layout []sliceHeader, count int) ([]byte, [][]byte) {
+	t.Helper()
+
+	e, err := NewEncoder(opts)
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+	e.record.version = 2
+	e.record.micro_version = 0
+	e.record.intra = 0
+	e.record.quant_tables[1] = [maxContextInputs][256]int16{}
+	levels := makeQuantTable(&e.record.quant_tables[1][0], []int{1, 2, 5, 120}, 1)
+	e.record.context_count[1] = int32((levels + 1) / 2)
+	allocateInitialStateDelta(&e.record)
+	e.state_transition, e.initial_states = initialStates(&e.record)
+
+	slices := make([]slice, len(layout))
+	for i := range slices {
+		slices[i].header = layout[i]
+		sliceBounds(&e.record, opts.Width, opts.Height, &slices[i])
+	}
+
+	var packets [][]byte
+	for n := 0; n < count; n++ {
+		keyframe := n%2 == 0
+		frame := testFrame(opts, n)
+
+		var packet []byte
+		for i := range slices {
+			if keyframe {
+				resetSliceStates(&slices[i], &e.record, e.initial_states)
+			}
+
+			c := rangecoder.NewEncoder()
+			if i == 0 {
+				state := make([]uint8, contextSize)
+				for i := range state {
+					state[i] = 128
+				}
+				c.PutBR(state, keyframe)
+				if keyframe {
+					putSliceLayout(c, slices)
+				}
+			}
+			if e.record.coder_type == 2 {
+				c.SetTable(e.state_transition)
+			}
+			e.encodeSliceContent(c, nil, &slices[i], frame)
+
+			buf := c.Finish()
+			if i > 0 {
+				size := len(buf)
+				buf = append(buf, byte(size>>16), byte(size>>8), byte(size))
+			}
+			packet = append(packet, buf...)
+		}
+		packets = append(packets, packet)
+	}
+
+	return writeConfigRecord(&e.record), packets
+}
+
+// Checks that every plane of out matches in.
+func checkPlanes(t *testing.T, n int, in *Frame, out *Frame) {
+	t.Helper()
+
+	if len(out.Buf) != len(in.Buf) {
+		t.Fatalf("frame %d: %d planes, not %d", n, len(out.Buf), len(in.Buf))
+	}
+	for p := range in.Buf {
+		if !bytes.Equal(out.Buf[p], in.Buf[p]) {
+			t.Fatalf("frame %d: plane %d differs", n, p)
+		}
+	}
+}
+
+func TestVersion0And1(t *testing.T) {
+	var transition [256]uint8
+	for i := range transition {
+		transition[i] = rangecoder.DefaultStateTransition[i]
+	}
+	transition[100] += 3
+	transition[200] -= 5
+
+	tests := []struct {
+		name    string
+		version uint8
+		opts    EncoderOptions
+	}{
+		{"version 0", 0, EncoderOptions{Width: 24, Height: 16, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}},
+		{"version 0 luma", 0, EncoderOptions{Width: 17, Height: 9}},
+		{"version 1", 1, EncoderOptions{Width: 24, Height: 16, HasChroma: true, ChromaSubsampleH: 1}},
+		{"version 1 alpha", 1, EncoderOptions{Width: 24, Height: 16, HasChroma: true, HasAlpha: true, StateTransition: &transition}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := encodeLegacy(t, test.opts, test.version, 4)
+
+			d, err := NewDecoder(nil, test.opts.Width, test.opts.Height)
+			if err != nil {
+				t.Fatalf("couldn't create decoder: %s", err.Error())
+			}
+			// Inter frames decode only if their contexts carry over
+			// from the keyframe before them.
+			for n, packet := range packets {
+				out, err := d.DecodeFrame(packet)
+				if err != nil {
+					t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+				}
+				if out.BitDepth != 8 || out.HasAlpha != test.opts.HasAlpha {
+					t.Errorf("frame %d: bit depth %d, alpha %t", n, out.BitDepth, out.HasAlpha)
+				}
+				checkPlanes(t, n, testFrame(test.opts, n), out)
+			}
+
+			// Without a configuration record, decoding must start at a
+			// keyframe.
+			d, err = NewDecoder(nil, test.opts.Width, test.opts.Height)
+			if err != nil {
+				t.Fatalf("couldn't create decoder: %s", err.Error())
+			}
+			_, err = d.DecodeFrame(packets[1])
+			if err == nil {
+				t.Errorf("no error for an inter frame before any keyframe")
+			}
+		})
+	}
+}
+
+func TestVersion2(t *testing.T) {
+	grid := EncoderOptions{Width: 32, Height: 32, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1, SlicesH: 2, SlicesV: 2}
+	alpha := EncoderOptions{Width: 30, Height: 24, HasChroma: true, HasAlpha: true, SlicesH: 3, SlicesV: 2}
+
+	tests := []struct {
+		name   string
+		opts   EncoderOptions
+		layout []sliceHeader
+	}{
+		{"one slice per position", grid, []sliceHeader{
+			{slice_x: 0, slice_y: 0, quant_table_set_index: []uint8{0, 1}},
+			{slice_x: 1, slice_y: 0, quant_table_set_index: []uint8{0, 1}},
+			{slice_x: 0, slice_y: 1, quant_table_set_index: []uint8{0, 1}},
+			{slice_x: 1, slice_y: 1, quant_table_set_index: []uint8{0, 1}},
+		}},
+		// Slices may span several positions, come in any order, and
+		// use any quantization table set for any plane.
+		{"merged slices", grid, []sliceHeader{
+			{slice_x: 0, slice_y: 0, slice_width_minus1: 1, quant_table_set_index: []uint8{0, 1}},
+			{slice_x: 1, slice_y: 1, quant_table_set_index: []uint8{1, 0}},
+			{slice_x: 0, slice_y: 1, quant_table_set_index: []uint8{1, 1}},
+		}},
+		{"alpha", alpha, []sliceHeader{
+			{slice_x: 0, slice_y: 0, slice_height_minus1: 1, quant_table_set_index: []uint8{0, 1, 2}},
+			{slice_x: 1, slice_y: 0, slice_width_minus1: 1, quant_table_set_index: []uint8{2, 1, 1}},
+			{slice_x: 1, slice_y: 1, slice_width_minus1: 1, quant_table_set_index: []uint8{0, 0, 0}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, packets := encodeVersion2(t, test.opts, test.layout, 4)
+
+			d, err := NewDecoder(record, test.opts.Width, test.opts.Height)
+			if err != nil {
+				t.Fatalf("couldn't create decoder: %s", err.Error())
+			}
+			for n, packet := range packets {
+				out, err := d.DecodeFrame(packet)
+				if err != nil {
+					t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+				}
+				checkPlanes(t, n, testFrame(test.opts, n), out)
+			}
+		})
+	}
+}
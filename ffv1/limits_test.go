@@ -0,0 +1,72 @@
+package ffv1
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecoderLimits(t *testing.T) {
+	opts := EncoderOptions{
+		Width:            32,
+		Height:           16,
+		HasChroma:        true,
+		ChromaSubsampleH: 1,
+		ChromaSubsampleV: 1,
+		SlicesH:          2,
+		SlicesV:          2,
+	}
+	record, packets := encodeSequence(t, opts, 1)
+	packet := packets[0]
+
+	r, err := ParseConfigRecord(record)
+	if err != nil {
+		t.Fatalf("couldn't parse record: %s", err.Error())
+	}
+	contexts := int(r.ContextCount[0])
+	d, err := NewDecoder(record, opts.Width, opts.Height)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+	frameSize := frameBytes(&d.record, opts.Width, opts.Height, 4, false)
+
+	tests := []struct {
+		name    string
+		options DecoderOptions
+		// Whether or not the limit is hit, and if so, by NewDecoder or
+		// by DecodeFrame.
+		exceeded bool
+		atFrame  bool
+	}{
+		{"pixels", DecoderOptions{MaxPixels: 32 * 16}, false, false},
+		{"too many pixels", DecoderOptions{MaxPixels: 32*16 - 1}, true, false},
+		{"slices", DecoderOptions{MaxSlices: 4}, false, false},
+		{"too many slices", DecoderOptions{MaxSlices: 3}, true, true},
+		{"frame bytes", DecoderOptions{MaxFrameBytes: frameSize}, false, false},
+		{"too many frame bytes", DecoderOptions{MaxFrameBytes: frameSize - 1}, true, true},
+		{"context count", DecoderOptions{MaxContextCount: contexts}, false, false},
+		{"too many contexts", DecoderOptions{MaxContextCount: contexts - 1}, true, false},
+	}
+
+	for _, test := range tests {
+		options := test.options
+		d, err := NewDecoderWithOptions(record, opts.Width, opts.Height, &options)
+		if err == nil {
+			_, err = d.DecodeFrame(packet)
+			if err != nil && !test.atFrame {
+				t.Errorf("%s: DecodeFrame failed instead of NewDecoder", test.name)
+			}
+		} else if test.atFrame {
+			t.Errorf("%s: NewDecoder failed instead of DecodeFrame", test.name)
+		}
+
+		if !test.exceeded {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			}
+			continue
+		}
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: got error %v, not one wrapping ErrLimitExceeded", test.name, err)
+		}
+	}
+}
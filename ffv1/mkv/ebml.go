@@ -0,0 +1,101 @@
+package mkv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Size of an element whose size is unknown, e.g. a live stream's
+// Segment or Cluster.
+const unknownSize = -1
+
+// Reads an EBML variable length integer, keeping the length marker
+// for element IDs, and returns it along with its length in bytes.
+func readVint(r io.ByteReader, keepMarker bool) (uint64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	length := 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		length++
+		if length > 8 {
+			return 0, 0, fmt.Errorf("invalid variable length integer")
+		}
+	}
+
+	v := uint64(first)
+	if !keepMarker {
+		v &= uint64(0xFF) >> uint(length)
+	}
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+
+	return v, length, nil
+}
+
+// Reads an element's ID and size. A size of unknownSize means the
+// element's end is only known by what comes after it.
+func readElementHeader(r io.ByteReader) (uint64, int64, error) {
+	id, _, err := readVint(r, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, length, err := readVint(r, false)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if size == (uint64(1)<<uint(7*length))-1 {
+		return id, unknownSize, nil
+	}
+	if size > 1<<62 {
+		return 0, 0, fmt.Errorf("invalid element size")
+	}
+	return id, int64(size), nil
+}
+
+// Walks the children of a master element's data.
+func walkElements(data []byte, fn func(id uint64, data []byte) error) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		id, size, err := readElementHeader(r)
+		if err != nil {
+			return err
+		}
+		if size == unknownSize || size > int64(r.Len()) {
+			return fmt.Errorf("element 0x%X overruns its parent", id)
+		}
+		child := data[len(data)-r.Len() : len(data)-r.Len()+int(size)]
+		r.Seek(size, io.SeekCurrent)
+		err = fn(id, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readUint(data []byte) uint64 {
+	v := uint64(0)
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func readString(data []byte) string {
+	return string(bytes.TrimRight(data, "\x00"))
+}
@@ -0,0 +1,535 @@
+// Package mkv implements a minimal Matroska demuxer, just enough to find
+// an FFV1 track, set up a decoder for it, and read its packets.
+//
+// The file is read front to back, so it works on pipes and files still
+// being written, and Tracks must come before the first Cluster, as
+// every muxer writes it.
+package mkv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+// Matroska element IDs.
+const (
+	idEBML            = 0x1A45DFA3
+	idDocType         = 0x4282
+	idSegment         = 0x18538067
+	idInfo            = 0x1549A966
+	idTimecodeScale   = 0x2AD7B1
+	idTracks          = 0x1654AE6B
+	idTrackEntry      = 0xAE
+	idTrackNumber     = 0xD7
+	idTrackType       = 0x83
+	idCodecID         = 0x86
+	idCodecPrivate    = 0x63A2
+	idDefaultDuration = 0x23E383
+	idVideo           = 0xE0
+	idPixelWidth      = 0xB0
+	idPixelHeight     = 0xBA
+	idCluster         = 0x1F43B675
+	idTimecode        = 0xE7
+	idBlockGroup      = 0xA0
+	idBlock           = 0xA1
+	idReferenceBlock  = 0xFB
+	idSimpleBlock     = 0xA3
+)
+
+// Track types.
+const (
+	TrackVideo = 1
+	TrackAudio = 2
+)
+
+// The FFV1 FourCC, as stored little endian in a BITMAPINFOHEADER.
+const fourccFFV1 = 0x31564646
+
+// Largest block that will be read into memory.
+const maxElementSize = 1 << 30
+
+// Largest EBML header, segment info, tracks, or cluster timecode that
+// will be read into memory. They are small, so anything larger is
+// garbage.
+const maxHeaderSize = 1 << 20
+
+// Track describes a track in the file.
+type Track struct {
+	// Number of the track, as used by Packet.Track.
+	Number uint64
+	// Type of the track. See the Track constants.
+	Type uint64
+	// CodecID, e.g. V_FFV1.
+	CodecID string
+	// CodecPrivate, as stored in the file.
+	CodecPrivate []byte
+	// Width of the video, in pixels, or zero if not a video track.
+	Width uint32
+	// Height of the video, in pixels, or zero if not a video track.
+	Height uint32
+	// Duration of each frame, or zero if unknown.
+	DefaultDuration time.Duration
+}
+
+// Packet is a frame read from a Block or SimpleBlock.
+type Packet struct {
+	// Number of the track the packet belongs to.
+	Track uint64
+	// Data is the frame itself.
+	Data []byte
+	// Timestamp of the frame.
+	Timestamp time.Duration
+	// Whether or not the frame is marked as a keyframe by the
+	// container.
+	Keyframe bool
+}
+
+// Demuxer is a Matroska demuxer instance.
+type Demuxer struct {
+	r             *bufio.Reader
+	tracks        []Track
+	timecodeScale uint64
+	clusterTime   int64
+	// Frames left over from a laced block.
+	pending []*Packet
+}
+
+// NewDemuxer reads the headers of a Matroska or WebM file, up to the
+// first Cluster.
+func NewDemuxer(r io.Reader) (*Demuxer, error) {
+	ret := &Demuxer{
+		r:             bufio.NewReader(r),
+		timecodeScale: 1000000,
+	}
+
+	id, size, err := readElementHeader(ret.r)
+	if err != nil {
+		return nil, err
+	}
+	if id != idEBML {
+		return nil, fmt.Errorf("not a Matroska file")
+	}
+	data, err := ret.readData(size, maxHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	docType := "matroska"
+	err = walkElements(data, func(id uint64, data []byte) error {
+		if id == idDocType {
+			docType = readString(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid EBML header: %s", err.Error())
+	}
+	if docType != "matroska" && docType != "webm" {
+		return nil, fmt.Errorf("unsupported DocType: %s", docType)
+	}
+
+	// Read up to the first cluster, picking up the segment info and
+	// the tracks on the way.
+	for {
+		id, size, err := readElementHeader(ret.r)
+		if err == io.EOF {
+			return nil, fmt.Errorf("no clusters found")
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case idSegment:
+			// Descend.
+		case idInfo:
+			data, err := ret.readData(size, maxHeaderSize)
+			if err != nil {
+				return nil, err
+			}
+			err = walkElements(data, func(id uint64, data []byte) error {
+				if id == idTimecodeScale {
+					ret.timecodeScale = readUint(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("invalid segment info: %s", err.Error())
+			}
+			if ret.timecodeScale == 0 {
+				return nil, fmt.Errorf("invalid TimecodeScale: 0")
+			}
+		case idTracks:
+			data, err := ret.readData(size, maxHeaderSize)
+			if err != nil {
+				return nil, err
+			}
+			ret.tracks, err = parseTracks(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tracks: %s", err.Error())
+			}
+		case idCluster:
+			if ret.tracks == nil {
+				return nil, fmt.Errorf("no tracks found before the first cluster")
+			}
+			return ret, nil
+		default:
+			err = ret.skipData(size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Tracks returns the tracks in the file.
+func (d *Demuxer) Tracks() []Track {
+	return d.tracks
+}
+
+// FFV1Track returns the first FFV1 track in the file, stored either
+// as V_FFV1, or as V_MS/VFW/FOURCC with the FFV1 FourCC.
+func (d *Demuxer) FFV1Track() (*Track, error) {
+	for i := range d.tracks {
+		t := &d.tracks[i]
+		if t.CodecID == "V_FFV1" {
+			return t, nil
+		}
+		if t.CodecID == "V_MS/VFW/FOURCC" && len(t.CodecPrivate) >= 20 &&
+			binary.LittleEndian.Uint32(t.CodecPrivate[16:]) == fourccFFV1 {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no FFV1 track found")
+}
+
+// NewDecoder creates an FFV1 decoder for the first FFV1 track in the
+// file, with the given options, which may be nil, and returns it along
+// with the track. Packets for other tracks should be skipped.
+func (d *Demuxer) NewDecoder(options *ffv1.DecoderOptions) (*ffv1.Decoder, *Track, error) {
+	t, err := d.FFV1Track()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record, width, height, err := t.ffv1Params()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec, err := ffv1.NewDecoderWithOptions(record, width, height, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dec, t, nil
+}
+
+// Gets the configuration record and dimensions of an FFV1 track.
+//
+// For VFW tracks, CodecPrivate is a BITMAPINFOHEADER, followed by the
+// record, and the dimensions may be taken from it if the track has no
+// Video element.
+func (t *Track) ffv1Params() ([]byte, uint32, uint32, error) {
+	if t.CodecID != "V_MS/VFW/FOURCC" {
+		return t.CodecPrivate, t.Width, t.Height, nil
+	}
+
+	priv := t.CodecPrivate
+	if len(priv) < 40 {
+		return nil, 0, 0, fmt.Errorf("truncated BITMAPINFOHEADER")
+	}
+
+	width, height := t.Width, t.Height
+	if width == 0 || height == 0 {
+		// biHeight is negative for top-down images.
+		width = binary.LittleEndian.Uint32(priv[4:])
+		h := int32(binary.LittleEndian.Uint32(priv[8:]))
+		if h < 0 {
+			h = -h
+		}
+		height = uint32(h)
+	}
+
+	// biSize counts the record too, if it is set right at all, so the
+	// record is always taken to start right after the 40 byte header.
+	return priv[40:], width, height, nil
+}
+
+// ReadPacket returns the next frame, of any track, in file order. It
+// returns io.EOF at the end of the file.
+//
+// Laced blocks are split into their frames. If the track has a
+// DefaultDuration, it is used to work out the timestamps of all but
+// the first frame in a lace; otherwise, they share the block's.
+func (d *Demuxer) ReadPacket() (*Packet, error) {
+	for {
+		if len(d.pending) > 0 {
+			ret := d.pending[0]
+			d.pending = d.pending[1:]
+			return ret, nil
+		}
+
+		id, size, err := readElementHeader(d.r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case idSegment, idCluster:
+			// Descend.
+		case idTimecode:
+			data, err := d.readData(size, maxHeaderSize)
+			if err != nil {
+				return nil, err
+			}
+			d.clusterTime = int64(readUint(data))
+		case idSimpleBlock:
+			data, err := d.readData(size, maxElementSize)
+			if err != nil {
+				return nil, err
+			}
+			err = d.parseBlock(data, true, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SimpleBlock: %s", err.Error())
+			}
+		case idBlockGroup:
+			data, err := d.readData(size, maxElementSize)
+			if err != nil {
+				return nil, err
+			}
+			err = d.parseBlockGroup(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid BlockGroup: %s", err.Error())
+			}
+		default:
+			err = d.skipData(size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Reads an element's data of up to max bytes. The buffer grows as data
+// is read, rather than being allocated up front from the size, which
+// could be anything in a broken file.
+func (d *Demuxer) readData(size int64, max int64) ([]byte, error) {
+	if size == unknownSize {
+		return nil, fmt.Errorf("unknown size element can not be read")
+	}
+	if size > max {
+		return nil, fmt.Errorf("element too large: %d bytes", size)
+	}
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, d.r, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+func (d *Demuxer) skipData(size int64) error {
+	if size == unknownSize {
+		return fmt.Errorf("unknown size element can not be skipped")
+	}
+	_, err := io.CopyN(io.Discard, d.r, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *Demuxer) track(number uint64) *Track {
+	for i := range d.tracks {
+		if d.tracks[i].Number == number {
+			return &d.tracks[i]
+		}
+	}
+	return nil
+}
+
+// A BlockGroup's Block is a keyframe if it references no other blocks.
+func (d *Demuxer) parseBlockGroup(data []byte) error {
+	var block []byte
+	keyframe := true
+	err := walkElements(data, func(id uint64, data []byte) error {
+		switch id {
+		case idBlock:
+			block = data
+		case idReferenceBlock:
+			keyframe = false
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("no Block found")
+	}
+	return d.parseBlock(block, false, keyframe)
+}
+
+// Parses a Block or SimpleBlock, queueing up its frames.
+func (d *Demuxer) parseBlock(data []byte, simple bool, keyframe bool) error {
+	r := bytes.NewReader(data)
+	track, _, err := readVint(r, false)
+	if err != nil {
+		return err
+	}
+	if r.Len() < 3 {
+		return fmt.Errorf("truncated block header")
+	}
+	hdr := data[len(data)-r.Len():]
+	timecode := int64(int16(binary.BigEndian.Uint16(hdr[0:])))
+	flags := hdr[2]
+	if simple {
+		keyframe = flags&0x80 != 0
+	}
+
+	frames, err := splitLaces(hdr[3:], (flags>>1)&0x03)
+	if err != nil {
+		return err
+	}
+
+	var duration time.Duration
+	if t := d.track(track); t != nil {
+		duration = t.DefaultDuration
+	}
+	timestamp := time.Duration((d.clusterTime + timecode) * int64(d.timecodeScale))
+	for i, frame := range frames {
+		d.pending = append(d.pending, &Packet{
+			Track:     track,
+			Data:      frame,
+			Timestamp: timestamp + time.Duration(i)*duration,
+			Keyframe:  keyframe,
+		})
+	}
+
+	return nil
+}
+
+// Lacing types.
+const (
+	lacingNone  = 0
+	lacingXiph  = 1
+	lacingFixed = 2
+	lacingEBML  = 3
+)
+
+// Splits a block's data into its frames.
+func splitLaces(data []byte, lacing byte) ([][]byte, error) {
+	if lacing == lacingNone {
+		return [][]byte{data}, nil
+	}
+
+	if len(data) < 1 {
+		return nil, fmt.Errorf("truncated lace header")
+	}
+	count := int(data[0]) + 1
+	r := bytes.NewReader(data[1:])
+
+	// Sizes of all but the last frame, which takes up the rest.
+	sizes := make([]int64, count-1)
+	switch lacing {
+	case lacingXiph:
+		for i := range sizes {
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("truncated lace header")
+				}
+				sizes[i] += int64(b)
+				if b != 0xFF {
+					break
+				}
+			}
+		}
+	case lacingEBML:
+		if len(sizes) > 0 {
+			size, _, err := readVint(r, false)
+			if err != nil {
+				return nil, fmt.Errorf("truncated lace header")
+			}
+			sizes[0] = int64(size)
+		}
+		// The rest are signed differences from the previous size.
+		for i := 1; i < len(sizes); i++ {
+			diff, length, err := readVint(r, false)
+			if err != nil {
+				return nil, fmt.Errorf("truncated lace header")
+			}
+			bias := int64(1)<<uint(7*length-1) - 1
+			sizes[i] = sizes[i-1] + int64(diff) - bias
+		}
+	case lacingFixed:
+		if r.Len()%count != 0 {
+			return nil, fmt.Errorf("fixed size lace of %d bytes does not split into %d frames", r.Len(), count)
+		}
+		for i := range sizes {
+			sizes[i] = int64(r.Len() / count)
+		}
+	}
+
+	data = data[len(data)-r.Len():]
+	frames := make([][]byte, count)
+	for i, size := range sizes {
+		if size < 0 || size > int64(len(data)) {
+			return nil, fmt.Errorf("invalid lace size: %d", size)
+		}
+		frames[i] = data[:size]
+		data = data[size:]
+	}
+	frames[count-1] = data
+
+	return frames, nil
+}
+
+func parseTracks(data []byte) ([]Track, error) {
+	tracks := []Track{}
+	err := walkElements(data, func(id uint64, data []byte) error {
+		if id != idTrackEntry {
+			return nil
+		}
+		var t Track
+		err := walkElements(data, func(id uint64, data []byte) error {
+			switch id {
+			case idTrackNumber:
+				t.Number = readUint(data)
+			case idTrackType:
+				t.Type = readUint(data)
+			case idCodecID:
+				t.CodecID = readString(data)
+			case idCodecPrivate:
+				t.CodecPrivate = data
+			case idDefaultDuration:
+				t.DefaultDuration = time.Duration(readUint(data))
+			case idVideo:
+				return walkElements(data, func(id uint64, data []byte) error {
+					switch id {
+					case idPixelWidth:
+						t.Width = uint32(readUint(data))
+					case idPixelHeight:
+						t.Height = uint32(readUint(data))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if t.Number == 0 {
+			return fmt.Errorf("track without a TrackNumber")
+		}
+		tracks = append(tracks, t)
+		return nil
+	})
+	return tracks, err
+}
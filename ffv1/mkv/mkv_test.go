@@ -0,0 +1,285 @@
+package mkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/internal/ffv1test"
+)
+
+// Makes an element, with a 4-byte size, or an unknown one if data is
+// nil.
+func element(id uint32, data []byte) []byte {
+	var buf []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> uint(shift)); b != 0 || len(buf) > 0 {
+			buf = append(buf, b)
+		}
+	}
+	if data == nil {
+		return append(buf, 0xFF)
+	}
+	n := len(data)
+	buf = append(buf, 0x10|byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(buf, data...)
+}
+
+func uintElement(id uint32, v uint64) []byte {
+	return element(id, []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func concat(elements ...[]byte) []byte {
+	return bytes.Join(elements, nil)
+}
+
+// Builds a minimal Matroska file with an FFV1 track stored the VFW way,
+// as a BITMAPINFOHEADER followed by the record, with no Video element,
+// and an audio track. The Segment and Cluster have unknown sizes, as
+// when streaming. The first frame is in a SimpleBlock, and the rest in
+// BlockGroups, each referencing the one before, with audio blocks in
+// between.
+func buildMKV(record []byte, frames [][]byte) []byte {
+	bih := make([]byte, 40)
+	binary.LittleEndian.PutUint32(bih[0:], uint32(40+len(record)))
+	binary.LittleEndian.PutUint32(bih[4:], ffv1test.Width)
+	// Negative, for a top-down image.
+	height := -int32(ffv1test.Height)
+	binary.LittleEndian.PutUint32(bih[8:], uint32(height))
+	binary.LittleEndian.PutUint16(bih[12:], 1)
+	binary.LittleEndian.PutUint16(bih[14:], 24)
+	binary.LittleEndian.PutUint32(bih[16:], fourccFFV1)
+
+	tracks := element(idTracks, concat(
+		element(idTrackEntry, concat(
+			uintElement(idTrackNumber, 1),
+			uintElement(idTrackType, TrackVideo),
+			element(idCodecID, []byte("V_MS/VFW/FOURCC")),
+			element(idCodecPrivate, append(bih, record...)),
+			uintElement(idDefaultDuration, uint64(40*time.Millisecond)),
+		)),
+		element(idTrackEntry, concat(
+			uintElement(idTrackNumber, 2),
+			uintElement(idTrackType, TrackAudio),
+			element(idCodecID, []byte("A_PCM/INT/LIT")),
+		)),
+	))
+
+	block := func(track byte, timecode int16, flags byte, data []byte) []byte {
+		return concat([]byte{0x80 | track, byte(timecode >> 8), byte(timecode), flags}, data)
+	}
+	cluster := concat(element(idCluster, nil), uintElement(idTimecode, 100))
+	for i, frame := range frames {
+		timecode := int16(40 * i)
+		if i == 0 {
+			cluster = append(cluster, element(idSimpleBlock, block(1, timecode, 0x80, frame))...)
+		} else {
+			cluster = append(cluster, element(idBlockGroup, concat(
+				element(idBlock, block(1, timecode, 0, frame)),
+				element(idReferenceBlock, []byte{0xD8}),
+			))...)
+		}
+		cluster = append(cluster, element(idSimpleBlock, block(2, timecode, 0x80, make([]byte, 8)))...)
+	}
+
+	return concat(
+		element(idEBML, element(idDocType, []byte("matroska"))),
+		element(idSegment, nil),
+		element(idInfo, uintElement(idTimecodeScale, 1000000)),
+		tracks,
+		cluster,
+	)
+}
+
+// Demuxes and decodes every FFV1 frame of a file.
+func demux(t *testing.T, data []byte) (*Track, []*Packet) {
+	d, err := NewDemuxer(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't open file: %s", err.Error())
+	}
+	dec, track, err := d.NewDecoder(nil)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+
+	var packets []*Packet
+	for {
+		packet, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("couldn't read packet %d: %s", len(packets), err.Error())
+		}
+		if packet.Track != track.Number {
+			continue
+		}
+		_, err = dec.DecodeFrame(packet.Data)
+		if err != nil {
+			t.Fatalf("couldn't decode packet %d: %s", len(packets), err.Error())
+		}
+		packets = append(packets, packet)
+	}
+
+	return track, packets
+}
+
+func TestDemuxer(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 3)
+	track, packets := demux(t, buildMKV(record, frames))
+
+	priv, width, height, err := track.ffv1Params()
+	if err != nil {
+		t.Fatalf("couldn't get track parameters: %s", err.Error())
+	}
+	if !bytes.Equal(priv, record) {
+		t.Errorf("configuration record differs")
+	}
+	if width != ffv1test.Width || height != ffv1test.Height {
+		t.Errorf("track is %dx%d, not %dx%d", width, height, ffv1test.Width, ffv1test.Height)
+	}
+
+	if len(packets) != len(frames) {
+		t.Fatalf("got %d packets, not %d", len(packets), len(frames))
+	}
+	for i, packet := range packets {
+		if !bytes.Equal(packet.Data, frames[i]) {
+			t.Errorf("packet %d differs", i)
+		}
+		if want := time.Duration(100+40*i) * time.Millisecond; packet.Timestamp != want {
+			t.Errorf("packet %d has timestamp %s, not %s", i, packet.Timestamp, want)
+		}
+		if packet.Keyframe != (i == 0) {
+			t.Errorf("packet %d has keyframe %t", i, packet.Keyframe)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.mkv")
+	if err != nil {
+		t.Fatalf("couldn't read sample: %s", err.Error())
+	}
+	_, packets := demux(t, data)
+	if len(packets) != 2 {
+		t.Errorf("sample has %d packets, not 2", len(packets))
+	}
+}
+
+func TestSplitLaces(t *testing.T) {
+	payload := make([]byte, 700)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	tests := []struct {
+		name   string
+		lacing byte
+		header []byte
+		sizes  []int
+		err    bool
+	}{
+		{"none", lacingNone, nil, []int{700}, false},
+		{"xiph", lacingXiph, []byte{2, 0xFF, 0xFF, 10, 0}, []int{520, 0, 180}, false},
+		{"xiph truncated", lacingXiph, []byte{1, 0xFF}, nil, true},
+		{"xiph overrun", lacingXiph, []byte{1, 0xFF, 10, 0}, nil, true},
+		// 300, then -5 and -200 as signed differences.
+		{"ebml", lacingEBML, []byte{3, 0x41, 0x2C, 0xBA, 0x5F, 0x37}, []int{300, 295, 95, 10}, false},
+		{"ebml negative size", lacingEBML, []byte{2, 0x85, 0x80, 0, 0, 0, 0, 0}, nil, true},
+		{"fixed", lacingFixed, []byte{3}, []int{175, 175, 175, 175}, false},
+		{"fixed uneven", lacingFixed, []byte{2, 0, 0}, nil, true},
+		{"empty", lacingXiph, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		// Broken lace headers are tested on their own.
+		if test.err {
+			_, err := splitLaces(test.header, test.lacing)
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+
+		frames, err := splitLaces(append(test.header, payload...), test.lacing)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		var sizes []int
+		var joined []byte
+		for _, frame := range frames {
+			sizes = append(sizes, len(frame))
+			joined = append(joined, frame...)
+		}
+		if !reflect.DeepEqual(sizes, test.sizes) {
+			t.Errorf("%s: frame sizes are %v, not %v", test.name, sizes, test.sizes)
+		}
+		if !bytes.Equal(joined, payload) {
+			t.Errorf("%s: frames do not add up to the payload", test.name)
+		}
+	}
+}
+
+// Element sizes in broken files must not be trusted for allocations.
+func TestLargeSize(t *testing.T) {
+	record, _ := ffv1test.Essence(t, 1)
+	file := buildMKV(record, nil)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// An EBML header which says it is 1 GiB.
+		{"header", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x01, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00}},
+		// A SimpleBlock which says it is 512 MiB, but is cut off.
+		{"block", append(file, idSimpleBlock, 0x01, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x81)},
+	}
+
+	for _, test := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		d, err := NewDemuxer(bytes.NewReader(test.data))
+		for err == nil {
+			_, err = d.ReadPacket()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: no error", test.name)
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+}
+
+// FuzzDemuxer demuxes arbitrary data, which must not panic, hang, or
+// allocate beyond what the data holds.
+func FuzzDemuxer(f *testing.F) {
+	record, frames := ffv1test.Essence(f, 2)
+	f.Add(buildMKV(record, frames))
+	f.Add([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x01, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := NewDemuxer(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		d.NewDecoder(nil)
+		for {
+			packet, err := d.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(packet.Data) > len(data) {
+				t.Fatalf("packet of %d bytes from %d bytes of data", len(packet.Data), len(data))
+			}
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Size of a box header, without the 64-bit largesize.
+const boxHeaderSize = 8
+
+// Reads a box header from r, and returns the box's type, and the size
+// of its payload. A size of -1 means the box runs to the end of the
+// file.
+func readBoxHeader(r io.Reader) (string, int64, error) {
+	var hdr [boxHeaderSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	typ := string(hdr[4:8])
+	size := int64(binary.BigEndian.Uint32(hdr[0:]))
+	switch size {
+	case 0:
+		return typ, -1, nil
+	case 1:
+		var large [8]byte
+		_, err := io.ReadFull(r, large[:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(large[:]))
+		if size < boxHeaderSize+8 {
+			return "", 0, fmt.Errorf("invalid size for box '%s': %d", typ, size)
+		}
+		return typ, size - boxHeaderSize - 8, nil
+	}
+	if size < boxHeaderSize {
+		return "", 0, fmt.Errorf("invalid size for box '%s': %d", typ, size)
+	}
+
+	return typ, size - boxHeaderSize, nil
+}
+
+// Walks the child boxes in a box's payload.
+func walkBoxes(data []byte, fn func(typ string, data []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < boxHeaderSize {
+			return fmt.Errorf("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:]))
+		typ := string(data[4:8])
+		hdrSize := uint64(boxHeaderSize)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < boxHeaderSize+8 {
+				return fmt.Errorf("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			hdrSize += 8
+		}
+		if size < hdrSize || size > uint64(len(data)) {
+			return fmt.Errorf("box '%s' overruns its parent", typ)
+		}
+
+		err := fn(typ, data[hdrSize:size])
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// Finds the first child box of the given type, or nil if there is none.
+func findBox(data []byte, typ string) ([]byte, error) {
+	var ret []byte
+	err := walkBoxes(data, func(t string, data []byte) error {
+		if ret == nil && t == typ {
+			ret = data
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// Strips the version and flags from a full box's payload.
+func fullBox(data []byte, typ string) (byte, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("truncated '%s' box", typ)
+	}
+	return data[0], data[4:], nil
+}
@@ -0,0 +1,549 @@
+// Package mp4 implements a minimal ISOBMFF and QuickTime demuxer, just
+// enough to find an FFV1 track, set up a decoder for it, and read its
+// packets.
+//
+// Only files with a sample table in 'moov' are supported; fragmented
+// files are not. The 'moov' box may be anywhere in the file, so it
+// needs to be seekable.
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+// Largest 'moov' box that will be read into memory.
+const maxMoovSize = 1 << 30
+
+// Size of a VisualSampleEntry, or a QuickTime video sample
+// description, before its child boxes, not counting the box header.
+const visualSampleEntrySize = 78
+
+// Track describes a track in the file.
+type Track struct {
+	// ID of the track, as used by Packet.Track.
+	ID uint32
+	// Handler type of the track, e.g. "vide" or "soun".
+	Handler string
+	// Format of the track's first sample entry, e.g. "FFV1".
+	Format string
+	// Width of the video, in pixels, or zero if not a video track.
+	Width uint32
+	// Height of the video, in pixels, or zero if not a video track.
+	Height uint32
+	// Timescale of the track's timestamps, in units per second.
+	Timescale uint32
+	// Contents of the 'glbl' box in the sample entry, if any. For FFV1,
+	// this is the configuration record.
+	Glbl []byte
+	// Number of samples in the track.
+	NumSamples int
+}
+
+// Packet is a sample read from the file.
+type Packet struct {
+	// ID of the track the packet belongs to.
+	Track uint32
+	// Data is the sample itself.
+	Data []byte
+	// Timestamp of the sample, from its decode time.
+	Timestamp time.Duration
+	// Whether or not the sample is a sync sample.
+	Keyframe bool
+}
+
+type sample struct {
+	track    uint32
+	offset   uint64
+	size     uint32
+	time     time.Duration
+	keyframe bool
+}
+
+// Demuxer is an ISOBMFF or QuickTime demuxer instance.
+type Demuxer struct {
+	r      io.ReadSeeker
+	tracks []Track
+	// Samples of all tracks, in file order.
+	samples []sample
+	next    int
+}
+
+// NewDemuxer finds and reads the 'moov' box of an ISOBMFF or QuickTime
+// file, and builds the sample tables of all its tracks.
+func NewDemuxer(r io.ReadSeeker) (*Demuxer, error) {
+	ret := &Demuxer{r: r}
+
+	fileSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var moov []byte
+	for pos := int64(0); pos < fileSize; {
+		typ, size, err := readBoxHeader(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read box header: %s", err.Error())
+		}
+		payload, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if size == -1 {
+			size = fileSize - payload
+		}
+
+		if typ == "moov" {
+			if size > maxMoovSize || size > fileSize-payload {
+				return nil, fmt.Errorf("'moov' box too large: %d bytes", size)
+			}
+			moov = make([]byte, size)
+			_, err = io.ReadFull(r, moov)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read 'moov' box: %s", err.Error())
+			}
+			break
+		}
+
+		pos, err = r.Seek(payload+size, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if moov == nil {
+		return nil, fmt.Errorf("no 'moov' box found")
+	}
+
+	err = walkBoxes(moov, func(typ string, data []byte) error {
+		if typ != "trak" {
+			return nil
+		}
+		t, samples, err := parseTrak(data, uint64(fileSize))
+		if err != nil {
+			return err
+		}
+		ret.tracks = append(ret.tracks, *t)
+		ret.samples = append(ret.samples, samples...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'moov' box: %s", err.Error())
+	}
+
+	sort.SliceStable(ret.samples, func(i, j int) bool {
+		return ret.samples[i].offset < ret.samples[j].offset
+	})
+
+	return ret, nil
+}
+
+// Tracks returns the tracks in the file.
+func (d *Demuxer) Tracks() []Track {
+	return d.tracks
+}
+
+// FFV1Track returns the first track in the file with an FFV1 sample
+// entry.
+func (d *Demuxer) FFV1Track() (*Track, error) {
+	for i := range d.tracks {
+		if d.tracks[i].Format == "FFV1" {
+			return &d.tracks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no FFV1 track found")
+}
+
+// NewDecoder creates an FFV1 decoder for the first FFV1 track in the
+// file, with the given options, which may be nil, and returns it along
+// with the track. Packets for other tracks should be skipped.
+func (d *Demuxer) NewDecoder(options *ffv1.DecoderOptions) (*ffv1.Decoder, *Track, error) {
+	t, err := d.FFV1Track()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec, err := ffv1.NewDecoderWithOptions(t.Glbl, t.Width, t.Height, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dec, t, nil
+}
+
+// ReadPacket returns the next sample, of any track, in file order. It
+// returns io.EOF after the last sample.
+func (d *Demuxer) ReadPacket() (*Packet, error) {
+	if d.next >= len(d.samples) {
+		return nil, io.EOF
+	}
+	s := d.samples[d.next]
+	d.next++
+
+	_, err := d.r.Seek(int64(s.offset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, s.size)
+	_, err = io.ReadFull(d.r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read sample: %s", err.Error())
+	}
+
+	return &Packet{
+		Track:     s.track,
+		Data:      data,
+		Timestamp: s.time,
+		Keyframe:  s.keyframe,
+	}, nil
+}
+
+// Parses a 'trak' box, and builds its sample table.
+func parseTrak(data []byte, fileSize uint64) (*Track, []sample, error) {
+	t := new(Track)
+
+	tkhd, err := findBox(data, "tkhd")
+	if err != nil {
+		return nil, nil, err
+	}
+	version, tkhd, err := fullBox(tkhd, "tkhd")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Track ID, after the creation and modification times, and the
+	// dimensions, in 16.16 fixed point, at the very end.
+	idOffset := 8
+	if version == 1 {
+		idOffset = 16
+	}
+	if len(tkhd) < idOffset+4 || len(tkhd) < 8 {
+		return nil, nil, fmt.Errorf("truncated 'tkhd' box")
+	}
+	t.ID = binary.BigEndian.Uint32(tkhd[idOffset:])
+	t.Width = binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16
+	t.Height = binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16
+
+	mdia, err := findBox(data, "mdia")
+	if err != nil {
+		return nil, nil, err
+	}
+	if mdia == nil {
+		return nil, nil, fmt.Errorf("track %d has no 'mdia' box", t.ID)
+	}
+
+	mdhd, err := findBox(mdia, "mdhd")
+	if err != nil {
+		return nil, nil, err
+	}
+	version, mdhd, err = fullBox(mdhd, "mdhd")
+	if err != nil {
+		return nil, nil, err
+	}
+	scaleOffset := 8
+	if version == 1 {
+		scaleOffset = 16
+	}
+	if len(mdhd) < scaleOffset+4 {
+		return nil, nil, fmt.Errorf("truncated 'mdhd' box")
+	}
+	t.Timescale = binary.BigEndian.Uint32(mdhd[scaleOffset:])
+	if t.Timescale == 0 {
+		return nil, nil, fmt.Errorf("track %d has a timescale of 0", t.ID)
+	}
+
+	hdlr, err := findBox(mdia, "hdlr")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hdlr) >= 12 {
+		t.Handler = string(hdlr[8:12])
+	}
+
+	minf, err := findBox(mdia, "minf")
+	if err != nil {
+		return nil, nil, err
+	}
+	stbl, err := findBox(minf, "stbl")
+	if err != nil {
+		return nil, nil, err
+	}
+	if stbl == nil {
+		return nil, nil, fmt.Errorf("track %d has no sample table", t.ID)
+	}
+
+	stsd, err := findBox(stbl, "stsd")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = parseStsd(stsd, t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	samples, err := parseSampleTable(stbl, t, fileSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("track %d: %s", t.ID, err.Error())
+	}
+	t.NumSamples = len(samples)
+
+	return t, samples, nil
+}
+
+// Reads the format of the first sample entry, and for video, its
+// dimensions and 'glbl' box.
+func parseStsd(data []byte, t *Track) error {
+	_, data, err := fullBox(data, "stsd")
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 {
+		return fmt.Errorf("truncated 'stsd' box")
+	}
+	if binary.BigEndian.Uint32(data[0:]) == 0 {
+		return fmt.Errorf("track %d has no sample entries", t.ID)
+	}
+
+	var entry []byte
+	err = walkBoxes(data[4:], func(typ string, data []byte) error {
+		if entry == nil {
+			t.Format = typ
+			entry = data
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if t.Handler != "vide" {
+		return nil
+	}
+
+	if len(entry) < visualSampleEntrySize {
+		return fmt.Errorf("truncated '%s' sample entry", t.Format)
+	}
+	t.Width = uint32(binary.BigEndian.Uint16(entry[24:]))
+	t.Height = uint32(binary.BigEndian.Uint16(entry[26:]))
+
+	t.Glbl, err = findBox(entry[visualSampleEntrySize:], "glbl")
+	return err
+}
+
+// Expands a track's sample table, from 'stsz', 'stco' or 'co64', 'stsc',
+// 'stts', and, if present, 'stss'.
+func parseSampleTable(stbl []byte, t *Track, fileSize uint64) ([]sample, error) {
+	sizes, err := parseStsz(stbl, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := parseChunkOffsets(stbl)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]sample, len(sizes))
+	for i := range samples {
+		samples[i].track = t.ID
+		samples[i].size = sizes[i]
+		samples[i].keyframe = true
+	}
+
+	// Samples are laid out back to back within each chunk.
+	stsc, err := findBox(stbl, "stsc")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := tableEntries(stsc, "stsc", 12)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for i := 0; i < len(entries); i += 12 {
+		first := binary.BigEndian.Uint32(entries[i:])
+		perChunk := binary.BigEndian.Uint32(entries[i+4:])
+		last := uint32(len(offsets)) + 1
+		if i+12 < len(entries) {
+			last = binary.BigEndian.Uint32(entries[i+12:])
+		}
+		if first == 0 || last < first || last > uint32(len(offsets))+1 {
+			return nil, fmt.Errorf("invalid 'stsc' entry")
+		}
+		for chunk := first; chunk < last; chunk++ {
+			offset := offsets[chunk-1]
+			for j := uint32(0); j < perChunk; j++ {
+				if n >= len(samples) {
+					return nil, fmt.Errorf("'stsc' describes more samples than 'stsz'")
+				}
+				// ReadPacket allocates the sample's size, so it must
+				// at least be in the file.
+				if offset > fileSize || uint64(samples[n].size) > fileSize-offset {
+					return nil, fmt.Errorf("sample %d overruns the file", n+1)
+				}
+				samples[n].offset = offset
+				offset += uint64(samples[n].size)
+				n++
+			}
+		}
+	}
+	if n != len(samples) {
+		return nil, fmt.Errorf("'stsc' describes %d samples, 'stsz' %d", n, len(samples))
+	}
+
+	stts, err := findBox(stbl, "stts")
+	if err != nil {
+		return nil, err
+	}
+	entries, err = tableEntries(stts, "stts", 8)
+	if err != nil {
+		return nil, err
+	}
+	n = 0
+	dts := uint64(0)
+	for i := 0; i < len(entries) && n < len(samples); i += 8 {
+		count := binary.BigEndian.Uint32(entries[i:])
+		delta := uint64(binary.BigEndian.Uint32(entries[i+4:]))
+		for j := uint32(0); j < count && n < len(samples); j++ {
+			samples[n].time = scaleTime(dts, t.Timescale)
+			dts += delta
+			n++
+		}
+	}
+
+	// No 'stss' box means every sample is a sync sample.
+	stss, err := findBox(stbl, "stss")
+	if err != nil {
+		return nil, err
+	}
+	if stss != nil {
+		entries, err = tableEntries(stss, "stss", 4)
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i].keyframe = false
+		}
+		for i := 0; i < len(entries); i += 4 {
+			num := binary.BigEndian.Uint32(entries[i:])
+			if num == 0 || num > uint32(len(samples)) {
+				return nil, fmt.Errorf("invalid 'stss' entry: %d", num)
+			}
+			samples[num-1].keyframe = true
+		}
+	}
+
+	return samples, nil
+}
+
+// Reads the sample sizes from 'stsz'.
+func parseStsz(stbl []byte, fileSize uint64) ([]uint32, error) {
+	stsz, err := findBox(stbl, "stsz")
+	if err != nil {
+		return nil, err
+	}
+	if stsz == nil {
+		return nil, fmt.Errorf("no 'stsz' box")
+	}
+	_, stsz, err = fullBox(stsz, "stsz")
+	if err != nil {
+		return nil, err
+	}
+	if len(stsz) < 8 {
+		return nil, fmt.Errorf("truncated 'stsz' box")
+	}
+	size := binary.BigEndian.Uint32(stsz[0:])
+	count := binary.BigEndian.Uint32(stsz[4:])
+
+	if size != 0 {
+		// Every sample takes up at least one byte of the file.
+		if uint64(count) > fileSize {
+			return nil, fmt.Errorf("invalid sample count: %d", count)
+		}
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			sizes[i] = size
+		}
+		return sizes, nil
+	}
+
+	if uint64(len(stsz)-8) < uint64(count)*4 {
+		return nil, fmt.Errorf("truncated 'stsz' box")
+	}
+	sizes := make([]uint32, count)
+	for i := range sizes {
+		sizes[i] = binary.BigEndian.Uint32(stsz[8+i*4:])
+	}
+	return sizes, nil
+}
+
+// Reads the chunk offsets from 'stco' or 'co64'.
+func parseChunkOffsets(stbl []byte) ([]uint64, error) {
+	stco, err := findBox(stbl, "stco")
+	if err != nil {
+		return nil, err
+	}
+	if stco != nil {
+		entries, err := tableEntries(stco, "stco", 4)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make([]uint64, len(entries)/4)
+		for i := range offsets {
+			offsets[i] = uint64(binary.BigEndian.Uint32(entries[i*4:]))
+		}
+		return offsets, nil
+	}
+
+	co64, err := findBox(stbl, "co64")
+	if err != nil {
+		return nil, err
+	}
+	if co64 == nil {
+		return nil, fmt.Errorf("no 'stco' or 'co64' box")
+	}
+	entries, err := tableEntries(co64, "co64", 8)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(entries)/8)
+	for i := range offsets {
+		offsets[i] = binary.BigEndian.Uint64(entries[i*8:])
+	}
+	return offsets, nil
+}
+
+// Gets the entries of a full box made up of an entry count, followed
+// by that many entries of the given size. A missing box has none.
+func tableEntries(data []byte, typ string, entrySize int) ([]byte, error) {
+	if data == nil {
+		return nil, nil
+	}
+	_, data, err := fullBox(data, typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("truncated '%s' box", typ)
+	}
+	count := uint64(binary.BigEndian.Uint32(data[0:]))
+	if uint64(len(data)-4) < count*uint64(entrySize) {
+		return nil, fmt.Errorf("truncated '%s' box", typ)
+	}
+	return data[4 : 4+count*uint64(entrySize)], nil
+}
+
+// Converts a time in timescale units to a time.Duration, without
+// overflowing for long files.
+func scaleTime(t uint64, timescale uint32) time.Duration {
+	scale := uint64(timescale)
+	return time.Duration(t/scale)*time.Second + time.Duration((t%scale)*uint64(time.Second)/scale)
+}
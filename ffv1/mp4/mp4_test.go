@@ -0,0 +1,325 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/internal/ffv1test"
+)
+
+func box(typ string, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	buf := make([]byte, boxHeaderSize, boxHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:], uint32(boxHeaderSize+len(data)))
+	copy(buf[4:], typ)
+	return append(buf, data...)
+}
+
+// Makes a version 0 full box.
+func fullBoxData(typ string, children ...[]byte) []byte {
+	return box(typ, append([][]byte{{0, 0, 0, 0}}, children...)...)
+}
+
+func be32(v ...uint32) []byte {
+	var buf []byte
+	for _, x := range v {
+		buf = append(buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+	}
+	return buf
+}
+
+// A track's sample table, as written to its 'stbl' box.
+type testTable struct {
+	sizes   []uint32
+	offsets []uint64
+	// First chunk, samples per chunk, and sample description index.
+	stsc [][3]uint32
+	// Sync samples, or nil to leave 'stss' out.
+	stss []uint32
+	co64 bool
+}
+
+func (tt *testTable) box(entry []byte) []byte {
+	stsz := be32(0, uint32(len(tt.sizes)))
+	stsz = append(stsz, be32(tt.sizes...)...)
+
+	var chunks []byte
+	if tt.co64 {
+		chunks = be32(uint32(len(tt.offsets)))
+		for _, offset := range tt.offsets {
+			chunks = append(chunks, be32(uint32(offset>>32), uint32(offset))...)
+		}
+		chunks = fullBoxData("co64", chunks)
+	} else {
+		chunks = be32(uint32(len(tt.offsets)))
+		for _, offset := range tt.offsets {
+			chunks = append(chunks, be32(uint32(offset))...)
+		}
+		chunks = fullBoxData("stco", chunks)
+	}
+
+	stsc := be32(uint32(len(tt.stsc)))
+	for _, e := range tt.stsc {
+		stsc = append(stsc, be32(e[0], e[1], e[2])...)
+	}
+
+	var stss []byte
+	if tt.stss != nil {
+		stss = fullBoxData("stss", be32(uint32(len(tt.stss))), be32(tt.stss...))
+	}
+
+	return box("stbl",
+		fullBoxData("stsd", be32(1), entry),
+		fullBoxData("stts", be32(1, uint32(len(tt.sizes)), 1)),
+		fullBoxData("stsc", stsc),
+		fullBoxData("stsz", stsz),
+		chunks,
+		stss,
+	)
+}
+
+func trak(id uint32, handler string, timescale uint32, entry []byte, table *testTable) []byte {
+	tkhd := make([]byte, 80)
+	binary.BigEndian.PutUint32(tkhd[8:], id)
+	binary.BigEndian.PutUint32(tkhd[72:], ffv1test.Width<<16)
+	binary.BigEndian.PutUint32(tkhd[76:], ffv1test.Height<<16)
+
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[8:], timescale)
+
+	hdlr := make([]byte, 21)
+	copy(hdlr[4:], handler)
+
+	return box("trak",
+		fullBoxData("tkhd", tkhd),
+		box("mdia",
+			fullBoxData("mdhd", mdhd),
+			fullBoxData("hdlr", hdlr),
+			box("minf", table.box(entry)),
+		),
+	)
+}
+
+func ffv1Entry(record []byte) []byte {
+	entry := make([]byte, visualSampleEntrySize)
+	binary.BigEndian.PutUint16(entry[24:], ffv1test.Width)
+	binary.BigEndian.PutUint16(entry[26:], ffv1test.Height)
+	return box("FFV1", entry, box("glbl", record))
+}
+
+// Builds a file with an FFV1 track at 25 fps, whose first chunk has
+// two frames and the rest one each, with an audio chunk of two samples
+// after the first video chunk, followed by 'moov'. Every other frame is
+// a sync sample.
+func buildMP4(record []byte, frames [][]byte, co64 bool) []byte {
+	ftyp := box("ftyp", []byte("isom"), be32(0), []byte("isom"))
+	audio := [][]byte{{1, 2, 3, 4}, {5, 6, 7, 8}}
+
+	video := &testTable{co64: co64, stsc: [][3]uint32{{1, 2, 1}, {2, 1, 1}}}
+	sound := &testTable{stsc: [][3]uint32{{1, 2, 1}}}
+
+	var mdat []byte
+	pos := uint64(len(ftyp) + boxHeaderSize)
+	for i, frame := range frames {
+		if i == 0 || i >= 2 {
+			video.offsets = append(video.offsets, pos+uint64(len(mdat)))
+		}
+		video.sizes = append(video.sizes, uint32(len(frame)))
+		if i%2 == 0 {
+			video.stss = append(video.stss, uint32(i+1))
+		}
+		mdat = append(mdat, frame...)
+
+		if i == 1 {
+			sound.offsets = append(sound.offsets, pos+uint64(len(mdat)))
+			for _, s := range audio {
+				sound.sizes = append(sound.sizes, uint32(len(s)))
+				mdat = append(mdat, s...)
+			}
+		}
+	}
+
+	moov := box("moov",
+		trak(1, "vide", 25, ffv1Entry(record), video),
+		trak(2, "soun", 48000, box("sowt", make([]byte, 28)), sound),
+	)
+
+	return bytes.Join([][]byte{ftyp, box("mdat", mdat), moov}, nil)
+}
+
+func TestDemuxer(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 4)
+
+	for _, co64 := range []bool{false, true} {
+		d, err := NewDemuxer(bytes.NewReader(buildMP4(record, frames, co64)))
+		if err != nil {
+			t.Fatalf("co64 %t: couldn't open file: %s", co64, err.Error())
+		}
+		dec, track, err := d.NewDecoder(nil)
+		if err != nil {
+			t.Fatalf("co64 %t: couldn't create decoder: %s", co64, err.Error())
+		}
+		if track.Width != ffv1test.Width || track.Height != ffv1test.Height || track.NumSamples != len(frames) {
+			t.Errorf("co64 %t: track is %dx%d with %d samples", co64, track.Width, track.Height, track.NumSamples)
+		}
+
+		var tracks []uint32
+		n := 0
+		for {
+			packet, err := d.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("co64 %t: couldn't read packet: %s", co64, err.Error())
+			}
+			tracks = append(tracks, packet.Track)
+			if packet.Track != track.ID {
+				continue
+			}
+
+			if !bytes.Equal(packet.Data, frames[n]) {
+				t.Errorf("co64 %t: frame %d differs", co64, n)
+			}
+			if want := time.Duration(n) * 40 * time.Millisecond; packet.Timestamp != want {
+				t.Errorf("co64 %t: frame %d has timestamp %s, not %s", co64, n, packet.Timestamp, want)
+			}
+			if packet.Keyframe != (n%2 == 0) {
+				t.Errorf("co64 %t: frame %d has keyframe %t", co64, n, packet.Keyframe)
+			}
+			_, err = dec.DecodeFrame(packet.Data)
+			if err != nil {
+				t.Errorf("co64 %t: couldn't decode frame %d: %s", co64, n, err.Error())
+			}
+			n++
+		}
+
+		// In file order.
+		if want := []uint32{1, 1, 2, 2, 1, 1}; !reflect.DeepEqual(tracks, want) {
+			t.Errorf("co64 %t: packets are from tracks %v, not %v", co64, tracks, want)
+		}
+	}
+}
+
+func TestParseSampleTable(t *testing.T) {
+	const fileSize = 1000
+
+	tests := []struct {
+		name      string
+		table     testTable
+		offsets   []uint64
+		keyframes []bool
+		err       bool
+	}{
+		{
+			name:      "one sample per chunk",
+			table:     testTable{sizes: []uint32{10, 20, 30}, offsets: []uint64{100, 200, 300}, stsc: [][3]uint32{{1, 1, 1}}},
+			offsets:   []uint64{100, 200, 300},
+			keyframes: []bool{true, true, true},
+		},
+		{
+			name:      "runs of chunks",
+			table:     testTable{sizes: []uint32{10, 20, 30, 40, 50}, offsets: []uint64{100, 200, 300}, stsc: [][3]uint32{{1, 2, 1}, {2, 1, 1}, {3, 2, 1}}},
+			offsets:   []uint64{100, 110, 200, 300, 340},
+			keyframes: []bool{true, true, true, true, true},
+		},
+		{
+			name:      "co64 and stss",
+			table:     testTable{sizes: []uint32{10, 20, 30}, offsets: []uint64{100, 500}, stsc: [][3]uint32{{1, 2, 1}, {2, 1, 1}}, stss: []uint32{1, 3}, co64: true},
+			offsets:   []uint64{100, 110, 500},
+			keyframes: []bool{true, false, true},
+		},
+		{
+			name:  "too few samples",
+			table: testTable{sizes: []uint32{10, 20, 30}, offsets: []uint64{100}, stsc: [][3]uint32{{1, 2, 1}}},
+			err:   true,
+		},
+		{
+			name:  "too many samples",
+			table: testTable{sizes: []uint32{10}, offsets: []uint64{100}, stsc: [][3]uint32{{1, 2, 1}}},
+			err:   true,
+		},
+		{
+			name:  "chunk out of order",
+			table: testTable{sizes: []uint32{10, 20}, offsets: []uint64{100, 200}, stsc: [][3]uint32{{2, 1, 1}, {1, 1, 1}}},
+			err:   true,
+		},
+		{
+			name:  "sample beyond the file",
+			table: testTable{sizes: []uint32{10, 1 << 30}, offsets: []uint64{100}, stsc: [][3]uint32{{1, 2, 1}}},
+			err:   true,
+		},
+		{
+			name:  "chunk beyond the file",
+			table: testTable{sizes: []uint32{10}, offsets: []uint64{1 << 40}, stsc: [][3]uint32{{1, 1, 1}}, co64: true},
+			err:   true,
+		},
+		{
+			name:  "invalid stss",
+			table: testTable{sizes: []uint32{10}, offsets: []uint64{100}, stsc: [][3]uint32{{1, 1, 1}}, stss: []uint32{2}},
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		stbl := test.table.box(nil)[boxHeaderSize:]
+		samples, err := parseSampleTable(stbl, &Track{ID: 1, Timescale: 1}, fileSize)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+
+		var offsets []uint64
+		var keyframes []bool
+		for i, s := range samples {
+			offsets = append(offsets, s.offset)
+			keyframes = append(keyframes, s.keyframe)
+			if s.size != test.table.sizes[i] {
+				t.Errorf("%s: sample %d has size %d, not %d", test.name, i, s.size, test.table.sizes[i])
+			}
+			if s.time != time.Duration(i)*time.Second {
+				t.Errorf("%s: sample %d has time %s", test.name, i, s.time)
+			}
+		}
+		if !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%s: offsets are %v, not %v", test.name, offsets, test.offsets)
+		}
+		if !reflect.DeepEqual(keyframes, test.keyframes) {
+			t.Errorf("%s: keyframes are %v, not %v", test.name, keyframes, test.keyframes)
+		}
+	}
+}
+
+// FuzzDemuxer demuxes arbitrary data, which must not panic, hang, or
+// allocate beyond what the data holds.
+func FuzzDemuxer(f *testing.F) {
+	record, frames := ffv1test.Essence(f, 3)
+	f.Add(buildMP4(record, frames, false))
+	f.Add(buildMP4(record, frames, true))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := NewDemuxer(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		d.NewDecoder(nil)
+		for {
+			packet, err := d.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(packet.Data) > len(data) {
+				t.Fatalf("packet of %d bytes from %d bytes of data", len(packet.Data), len(data))
+			}
+		}
+	})
+}
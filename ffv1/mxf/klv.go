@@ -0,0 +1,136 @@
+package mxf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A SMPTE Universal Label.
+type ul [16]byte
+
+// Compares two ULs, ignoring the registry version byte, which writers
+// do not agree on.
+func (u ul) equal(o ul) bool {
+	for i := range u {
+		if i != 7 && u[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if a UL starts with the given bytes, ignoring the registry
+// version byte.
+func (u ul) hasPrefix(prefix []byte) bool {
+	for i := range prefix {
+		if i != 7 && u[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads a KLV key and its BER coded length.
+func readKL(r io.Reader) (ul, int64, error) {
+	var key ul
+	_, err := io.ReadFull(r, key[:])
+	if err != nil {
+		return key, 0, err
+	}
+
+	var first [1]byte
+	_, err = io.ReadFull(r, first[:])
+	if err != nil {
+		return key, 0, io.ErrUnexpectedEOF
+	}
+	if first[0] < 0x80 {
+		return key, int64(first[0]), nil
+	}
+
+	n := int(first[0] & 0x7F)
+	if n == 0 || n > 8 {
+		return key, 0, fmt.Errorf("invalid BER length")
+	}
+	var buf [8]byte
+	_, err = io.ReadFull(r, buf[8-n:])
+	if err != nil {
+		return key, 0, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint64(buf[:])
+	if length > 1<<62 {
+		return key, 0, fmt.Errorf("invalid BER length")
+	}
+
+	return key, int64(length), nil
+}
+
+// A header metadata set, with its items by local tag.
+type localSet struct {
+	key   ul
+	items map[uint16][]byte
+}
+
+// Parses the items of a local set: a 2-byte tag, a 2-byte length, and
+// the value, for each.
+func parseLocalSet(key ul, data []byte) (*localSet, error) {
+	ret := &localSet{key: key, items: make(map[uint16][]byte)}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated local set item")
+		}
+		tag := binary.BigEndian.Uint16(data[0:])
+		size := int(binary.BigEndian.Uint16(data[2:]))
+		if size > len(data)-4 {
+			return nil, fmt.Errorf("local set item 0x%04X overruns its set", tag)
+		}
+		ret.items[tag] = data[4 : 4+size]
+		data = data[4+size:]
+	}
+	return ret, nil
+}
+
+// Parses a primer pack, which maps local tags to item ULs.
+func parsePrimer(data []byte) (map[uint16]ul, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("truncated primer pack")
+	}
+	count := uint64(binary.BigEndian.Uint32(data[0:]))
+	size := uint64(binary.BigEndian.Uint32(data[4:]))
+	if size != 18 || count*size > uint64(len(data)-8) {
+		return nil, fmt.Errorf("invalid primer pack")
+	}
+
+	ret := make(map[uint16]ul)
+	for i := uint64(0); i < count; i++ {
+		entry := data[8+i*size:]
+		var u ul
+		copy(u[:], entry[2:18])
+		ret[binary.BigEndian.Uint16(entry[0:])] = u
+	}
+	return ret, nil
+}
+
+func readUint32(data []byte) (uint32, bool) {
+	if len(data) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data), true
+}
+
+// Reads a batch or array of 16 byte values, such as strong references.
+func readUIDs(data []byte) ([]ul, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("truncated batch")
+	}
+	count := uint64(binary.BigEndian.Uint32(data[0:]))
+	size := uint64(binary.BigEndian.Uint32(data[4:]))
+	if size != 16 || count*size > uint64(len(data)-8) {
+		return nil, fmt.Errorf("invalid batch")
+	}
+	ret := make([]ul, count)
+	for i := range ret {
+		copy(ret[i][:], data[8+i*16:])
+	}
+	return ret, nil
+}
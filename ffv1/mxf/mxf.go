@@ -0,0 +1,396 @@
+// Package mxf implements a minimal MXF demuxer for FFV1 essence, as
+// mapped by SMPTE RDD 48, just enough to set up a decoder for it, and
+// read its frames.
+//
+// It reads front to back without seeking, using the header metadata in
+// the header partition, so it works on pipes. Only frame-wrapped essence
+// is supported.
+package mxf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+// Largest essence element that will be read into memory.
+const maxValueSize = 1 << 30
+
+// Largest partition pack, primer pack, or header metadata set that will
+// be read into memory. They are small, so anything larger is garbage.
+const maxMetadataSize = 1 << 20
+
+// Largest run-in before the header partition pack, as per SMPTE 377.
+const maxRunIn = 65536
+
+// Key prefixes.
+var (
+	partitionPrefix = []byte{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x05, 0x01, 0x01, 0x0D, 0x01, 0x02, 0x01, 0x01}
+	localSetPrefix  = []byte{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x53, 0x01, 0x01}
+	indexPrefix     = []byte{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x53, 0x01, 0x01, 0x0D, 0x01, 0x02, 0x01, 0x01, 0x10}
+	essencePrefix   = []byte{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x02, 0x01, 0x01, 0x0D, 0x01, 0x03, 0x01}
+	fillPrefix      = []byte{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x03, 0x01, 0x02, 0x10, 0x01}
+)
+
+// Partition pack kinds, from byte 13 of their keys.
+const (
+	kindHeader = 0x02
+	kindPrimer = 0x05
+)
+
+// GC picture item type, from byte 12 of essence element keys.
+const itemTypePicture = 0x15
+
+// Set keys.
+var (
+	cdciDescriptorKey    = ul{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x53, 0x01, 0x01, 0x0D, 0x01, 0x01, 0x01, 0x01, 0x01, 0x28, 0x00}
+	rgbaDescriptorKey    = ul{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x53, 0x01, 0x01, 0x0D, 0x01, 0x01, 0x01, 0x01, 0x01, 0x29, 0x00}
+	timelineTrackKey     = ul{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x53, 0x01, 0x01, 0x0D, 0x01, 0x01, 0x01, 0x01, 0x01, 0x3B, 0x00}
+	ffv1SubDescriptorKey = ul{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x53, 0x01, 0x01, 0x0D, 0x01, 0x01, 0x01, 0x01, 0x01, 0x81, 0x00}
+)
+
+// A header metadata item: its UL, and its static local tag, if it has
+// one. Dynamic tags are looked up in the primer pack.
+type item struct {
+	tag   uint16
+	label ul
+}
+
+var (
+	itemInstanceUID    = item{0x3C0A, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x15, 0x02, 0x00, 0x00, 0x00, 0x00}}
+	itemLinkedTrackID  = item{0x3006, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x05, 0x06, 0x01, 0x01, 0x03, 0x05, 0x00, 0x00, 0x00}}
+	itemSampleRate     = item{0x3001, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x04, 0x06, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00}}
+	itemStoredHeight   = item{0x3202, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x04, 0x01, 0x05, 0x02, 0x01, 0x00, 0x00, 0x00}}
+	itemStoredWidth    = item{0x3203, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x04, 0x01, 0x05, 0x02, 0x02, 0x00, 0x00, 0x00}}
+	itemFrameLayout    = item{0x320C, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x04, 0x01, 0x03, 0x01, 0x04, 0x00, 0x00, 0x00}}
+	itemSubDescriptors = item{0, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x09, 0x06, 0x01, 0x01, 0x04, 0x06, 0x10, 0x00, 0x00}}
+	itemTrackID        = item{0x4801, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x02, 0x01, 0x07, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00}}
+	itemTrackNumber    = item{0x4804, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x02, 0x01, 0x04, 0x01, 0x03, 0x00, 0x00, 0x00, 0x00}}
+	itemEditRate       = item{0x4B01, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x02, 0x05, 0x30, 0x04, 0x05, 0x00, 0x00, 0x00, 0x00}}
+	// The FFV1 configuration record, in the FFV1 sub-descriptor.
+	itemInitMetadata = item{0, ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x0E, 0x04, 0x01, 0x06, 0x0C, 0x01, 0x00, 0x00, 0x00}}
+)
+
+// Frame layouts.
+const separateFields = 1
+
+// Stream describes the FFV1 essence in the file.
+type Stream struct {
+	// Width of the video, in pixels.
+	Width uint32
+	// Height of the video, in pixels. For separate fields, this is the
+	// height of a frame, not of a field, as stored in the descriptor.
+	Height uint32
+	// EditRateNum and EditRateDen give the frame rate, if known.
+	EditRateNum uint32
+	EditRateDen uint32
+	// The FFV1 configuration record, from the initialization metadata
+	// of the FFV1 sub-descriptor.
+	Record []byte
+	// TrackNumber of the essence elements, or zero if there is no
+	// track linked to the descriptor, in which case all picture
+	// elements are taken to be FFV1.
+	TrackNumber uint32
+}
+
+// Packet is a frame-wrapped FFV1 essence element.
+type Packet struct {
+	// Data is the frame itself.
+	Data []byte
+	// Timestamp of the frame, worked out from its position and the edit
+	// rate.
+	Timestamp time.Duration
+}
+
+// Demuxer is an MXF demuxer instance.
+type Demuxer struct {
+	r      *bufio.Reader
+	primer map[uint16]ul
+	sets   []*localSet
+	stream Stream
+	frames uint64
+	// The first KLV after the header metadata, if not read yet.
+	pendingKey    *ul
+	pendingLength int64
+}
+
+// NewDemuxer reads the header partition of an MXF file, and finds the
+// FFV1 essence descriptor in its header metadata.
+func NewDemuxer(r io.Reader) (*Demuxer, error) {
+	ret := &Demuxer{r: bufio.NewReader(r)}
+
+	err := ret.skipRunIn()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		key, length, err := readKL(ret.r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		header := key.hasPrefix(partitionPrefix) && (key[13] == kindHeader || key[13] == kindPrimer)
+		metadata := key.hasPrefix(localSetPrefix) && !key.hasPrefix(indexPrefix)
+		if !header && !metadata && !key.hasPrefix(fillPrefix) {
+			ret.pendingKey = &key
+			ret.pendingLength = length
+			break
+		}
+
+		if !header && !metadata {
+			err = ret.skipValue(length)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data, err := ret.readValue(length, maxMetadataSize)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case key.hasPrefix(partitionPrefix) && key[13] == kindPrimer:
+			if ret.primer == nil {
+				ret.primer, err = parsePrimer(data)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case metadata:
+			set, err := parseLocalSet(key, data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid header metadata: %s", err.Error())
+			}
+			ret.sets = append(ret.sets, set)
+		}
+	}
+
+	err = ret.findStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Skips the run-in, if any, before the header partition pack.
+func (d *Demuxer) skipRunIn() error {
+	for i := 0; i <= maxRunIn; i++ {
+		buf, err := d.r.Peek(len(partitionPrefix))
+		if err != nil {
+			break
+		}
+		var key ul
+		copy(key[:], buf)
+		if key.hasPrefix(partitionPrefix) {
+			return nil
+		}
+		d.r.Discard(1)
+	}
+	return fmt.Errorf("not an MXF file")
+}
+
+// Reads a KLV value of up to max bytes. The buffer grows as data is
+// read, rather than being allocated up front from the length, which
+// could be anything in a broken file.
+func (d *Demuxer) readValue(length int64, max int64) ([]byte, error) {
+	if length > max {
+		return nil, fmt.Errorf("KLV too large: %d bytes", length)
+	}
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, d.r, length)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+func (d *Demuxer) skipValue(length int64) error {
+	_, err := io.CopyN(io.Discard, d.r, length)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Looks an item up in a set, by its UL if the primer pack maps a local
+// tag to it, or its static local tag.
+func (d *Demuxer) item(s *localSet, it item) []byte {
+	for tag, label := range d.primer {
+		if label.equal(it.label) {
+			if v, ok := s.items[tag]; ok {
+				return v
+			}
+		}
+	}
+	if it.tag != 0 {
+		return s.items[it.tag]
+	}
+	return nil
+}
+
+// Finds the FFV1 sub-descriptor, the picture descriptor that refers to
+// it, and the track that descriptor is linked to.
+func (d *Demuxer) findStream() error {
+	var sub *localSet
+	var pictures []*localSet
+	for _, s := range d.sets {
+		switch {
+		case s.key.equal(ffv1SubDescriptorKey):
+			if sub == nil {
+				sub = s
+			}
+		case s.key.equal(cdciDescriptorKey), s.key.equal(rgbaDescriptorKey):
+			pictures = append(pictures, s)
+		}
+	}
+	if sub == nil {
+		return fmt.Errorf("no FFV1 sub-descriptor found")
+	}
+	d.stream.Record = d.item(sub, itemInitMetadata)
+
+	// Some writers may not list their sub-descriptors, in which case a
+	// lone picture descriptor is taken to be the one.
+	var desc *localSet
+	uid := d.item(sub, itemInstanceUID)
+	for _, s := range pictures {
+		refs, err := readUIDs(d.item(s, itemSubDescriptors))
+		if err != nil {
+			continue
+		}
+		for _, ref := range refs {
+			if bytes.Equal(ref[:], uid) {
+				desc = s
+			}
+		}
+	}
+	if desc == nil && len(pictures) == 1 {
+		desc = pictures[0]
+	}
+	if desc == nil {
+		return fmt.Errorf("no picture descriptor found for the FFV1 sub-descriptor")
+	}
+
+	width, ok1 := readUint32(d.item(desc, itemStoredWidth))
+	height, ok2 := readUint32(d.item(desc, itemStoredHeight))
+	if !ok1 || !ok2 || width == 0 || height == 0 {
+		return fmt.Errorf("picture descriptor has no stored dimensions")
+	}
+	layout := d.item(desc, itemFrameLayout)
+	if len(layout) == 1 && layout[0] == separateFields {
+		height *= 2
+	}
+	d.stream.Width = width
+	d.stream.Height = height
+	d.stream.EditRateNum, d.stream.EditRateDen = readRational(d.item(desc, itemSampleRate))
+
+	// Material package tracks share IDs with file package tracks, but
+	// have no track number.
+	linked, ok := readUint32(d.item(desc, itemLinkedTrackID))
+	if !ok {
+		return nil
+	}
+	for _, s := range d.sets {
+		if !s.key.equal(timelineTrackKey) {
+			continue
+		}
+		id, ok1 := readUint32(d.item(s, itemTrackID))
+		number, ok2 := readUint32(d.item(s, itemTrackNumber))
+		if ok1 && ok2 && id == linked && number != 0 {
+			d.stream.TrackNumber = number
+			num, den := readRational(d.item(s, itemEditRate))
+			if num != 0 && den != 0 {
+				d.stream.EditRateNum, d.stream.EditRateDen = num, den
+			}
+		}
+	}
+
+	return nil
+}
+
+func readRational(data []byte) (uint32, uint32) {
+	if len(data) != 8 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(data[0:]), binary.BigEndian.Uint32(data[4:])
+}
+
+// FFV1Stream returns the FFV1 essence in the file.
+func (d *Demuxer) FFV1Stream() *Stream {
+	return &d.stream
+}
+
+// NewDecoder creates an FFV1 decoder for the FFV1 essence in the file,
+// with the given options, which may be nil, and returns it along with
+// the stream.
+func (d *Demuxer) NewDecoder(options *ffv1.DecoderOptions) (*ffv1.Decoder, *Stream, error) {
+	dec, err := ffv1.NewDecoderWithOptions(d.stream.Record, d.stream.Width, d.stream.Height, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dec, &d.stream, nil
+}
+
+// ReadPacket returns the next FFV1 essence element. Everything else,
+// such as other essence, index tables, and later partitions, is skipped.
+// It returns io.EOF at the end of the file.
+func (d *Demuxer) ReadPacket() (*Packet, error) {
+	for {
+		var key ul
+		var length int64
+		if d.pendingKey != nil {
+			key, length = *d.pendingKey, d.pendingLength
+			d.pendingKey = nil
+		} else {
+			var err error
+			key, length, err = readKL(d.r)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !d.isFFV1Element(key) {
+			err := d.skipValue(length)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data, err := d.readValue(length, maxValueSize)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read essence element: %s", err.Error())
+		}
+
+		ret := &Packet{Data: data}
+		num := uint64(d.stream.EditRateNum)
+		den := uint64(d.stream.EditRateDen)
+		if num != 0 {
+			n := d.frames * den
+			ret.Timestamp = time.Duration(n/num)*time.Second + time.Duration((n%num)*uint64(time.Second)/num)
+		}
+		d.frames++
+
+		return ret, nil
+	}
+}
+
+// Essence element keys end in the track number of their track.
+func (d *Demuxer) isFFV1Element(key ul) bool {
+	if !key.hasPrefix(essencePrefix) {
+		return false
+	}
+	if d.stream.TrackNumber == 0 {
+		return key[12] == itemTypePicture
+	}
+	return binary.BigEndian.Uint32(key[12:]) == d.stream.TrackNumber
+}
@@ -0,0 +1,234 @@
+package mxf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/internal/ffv1test"
+)
+
+const (
+	testTrackNumber = 0x15011D01
+)
+
+// Dynamic local tags, mapped by the primer pack.
+const (
+	tagSubDescriptors = 0xFFFF
+	tagInitMetadata   = 0xFFFE
+)
+
+var (
+	headerPartitionKey = ul{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x05, 0x01, 0x01, 0x0D, 0x01, 0x02, 0x01, 0x01, kindHeader, 0x04, 0x00}
+	primerKey          = ul{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x05, 0x01, 0x01, 0x0D, 0x01, 0x02, 0x01, 0x01, kindPrimer, 0x01, 0x00}
+	fillKey            = ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x01, 0x01, 0x01, 0x03, 0x01, 0x02, 0x10, 0x01, 0x00, 0x00, 0x00}
+	soundElementKey    = ul{0x06, 0x0E, 0x2B, 0x34, 0x01, 0x02, 0x01, 0x01, 0x0D, 0x01, 0x03, 0x01, 0x16, 0x01, 0x01, 0x01}
+	subDescriptorUID   = ul{0xAA, 0xBB, 0xCC, 0xDD, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C}
+)
+
+// Appends a KLV, always with a 4-byte BER length, as most writers use.
+func appendKLV(buf []byte, key ul, value []byte) []byte {
+	buf = append(buf, key[:]...)
+	buf = append(buf, 0x83, byte(len(value)>>16), byte(len(value)>>8), byte(len(value)))
+	return append(buf, value...)
+}
+
+func appendItem(buf []byte, tag uint16, value []byte) []byte {
+	buf = append(buf, byte(tag>>8), byte(tag), byte(len(value)>>8), byte(len(value)))
+	return append(buf, value...)
+}
+
+func be32(v ...uint32) []byte {
+	var buf []byte
+	for _, x := range v {
+		buf = append(buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+	}
+	return buf
+}
+
+// Builds a minimal frame-wrapped MXF file: a header partition with a
+// primer pack, a CDCI descriptor with an FFV1 sub-descriptor, and the
+// track it is linked to, followed by fill, the essence, and a sound
+// element, which must be skipped.
+func buildMXF(record []byte, frames [][]byte) []byte {
+	// A run-in, which must be skipped too.
+	buf := []byte{0x00, 0x01, 0x02}
+
+	buf = appendKLV(buf, headerPartitionKey, make([]byte, 88))
+
+	primer := be32(2, 18)
+	primer = append(primer, byte(tagSubDescriptors>>8), byte(tagSubDescriptors&0xFF))
+	primer = append(primer, itemSubDescriptors.label[:]...)
+	primer = append(primer, byte(tagInitMetadata>>8), byte(tagInitMetadata&0xFF))
+	primer = append(primer, itemInitMetadata.label[:]...)
+	buf = appendKLV(buf, primerKey, primer)
+
+	var track []byte
+	track = appendItem(track, itemTrackID.tag, be32(2))
+	track = appendItem(track, itemTrackNumber.tag, be32(testTrackNumber))
+	track = appendItem(track, itemEditRate.tag, be32(25, 1))
+	buf = appendKLV(buf, timelineTrackKey, track)
+
+	var desc []byte
+	desc = appendItem(desc, itemStoredWidth.tag, be32(ffv1test.Width))
+	desc = appendItem(desc, itemStoredHeight.tag, be32(ffv1test.Height))
+	desc = appendItem(desc, itemFrameLayout.tag, []byte{0})
+	desc = appendItem(desc, itemLinkedTrackID.tag, be32(2))
+	desc = appendItem(desc, tagSubDescriptors, append(be32(1, 16), subDescriptorUID[:]...))
+	buf = appendKLV(buf, cdciDescriptorKey, desc)
+
+	var sub []byte
+	sub = appendItem(sub, itemInstanceUID.tag, subDescriptorUID[:])
+	sub = appendItem(sub, tagInitMetadata, record)
+	buf = appendKLV(buf, ffv1SubDescriptorKey, sub)
+
+	buf = appendKLV(buf, fillKey, make([]byte, 100))
+
+	for _, frame := range frames {
+		var key ul
+		copy(key[:], essencePrefix)
+		binary.BigEndian.PutUint32(key[12:], testTrackNumber)
+		buf = appendKLV(buf, key, frame)
+		buf = appendKLV(buf, soundElementKey, make([]byte, 10))
+	}
+
+	return buf
+}
+
+// Demuxes and decodes every frame of a file.
+func demux(t *testing.T, data []byte) (*Stream, []*Packet) {
+	d, err := NewDemuxer(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't open file: %s", err.Error())
+	}
+	dec, stream, err := d.NewDecoder(nil)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+
+	var packets []*Packet
+	for {
+		packet, err := d.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("couldn't read packet %d: %s", len(packets), err.Error())
+		}
+		_, err = dec.DecodeFrame(packet.Data)
+		if err != nil {
+			t.Fatalf("couldn't decode packet %d: %s", len(packets), err.Error())
+		}
+		packets = append(packets, packet)
+	}
+
+	return stream, packets
+}
+
+func TestDemuxer(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 3)
+	stream, packets := demux(t, buildMXF(record, frames))
+
+	if stream.Width != ffv1test.Width || stream.Height != ffv1test.Height {
+		t.Errorf("stream is %dx%d, not %dx%d", stream.Width, stream.Height, ffv1test.Width, ffv1test.Height)
+	}
+	if stream.TrackNumber != testTrackNumber {
+		t.Errorf("track number is 0x%08X, not 0x%08X", stream.TrackNumber, testTrackNumber)
+	}
+	if stream.EditRateNum != 25 || stream.EditRateDen != 1 {
+		t.Errorf("edit rate is %d/%d, not 25/1", stream.EditRateNum, stream.EditRateDen)
+	}
+	if !bytes.Equal(stream.Record, record) {
+		t.Errorf("configuration record differs")
+	}
+
+	if len(packets) != len(frames) {
+		t.Fatalf("got %d packets, not %d", len(packets), len(frames))
+	}
+	for i, packet := range packets {
+		if !bytes.Equal(packet.Data, frames[i]) {
+			t.Errorf("packet %d differs", i)
+		}
+		if want := time.Duration(i) * 40 * time.Millisecond; packet.Timestamp != want {
+			t.Errorf("packet %d has timestamp %s, not %s", i, packet.Timestamp, want)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.mxf")
+	if err != nil {
+		t.Fatalf("couldn't read sample: %s", err.Error())
+	}
+	stream, packets := demux(t, data)
+	if stream.Width != ffv1test.Width || stream.Height != ffv1test.Height || len(packets) != 2 {
+		t.Errorf("sample is %dx%d with %d packets, not %dx%d with 2", stream.Width, stream.Height, len(packets), ffv1test.Width, ffv1test.Height)
+	}
+}
+
+// KLV lengths in broken files must not be trusted for allocations.
+func TestLargeLength(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 1)
+	file := buildMXF(record, frames)
+
+	var essenceKey ul
+	copy(essenceKey[:], essencePrefix)
+	binary.BigEndian.PutUint32(essenceKey[12:], testTrackNumber)
+	start := bytes.Index(file, essenceKey[:])
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// A header partition pack which says it is 1 GiB.
+		{"metadata", append(headerPartitionKey[:len(headerPartitionKey):len(headerPartitionKey)], 0x84, 0x40, 0x00, 0x00, 0x00)},
+		// An essence element which says it is 512 MiB, but is cut off.
+		{"essence", append(file[:start+16:start+16], 0x84, 0x20, 0x00, 0x00, 0x00, 0x01, 0x02)},
+	}
+
+	for _, test := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		d, err := NewDemuxer(bytes.NewReader(test.data))
+		if err == nil {
+			_, err = d.ReadPacket()
+		}
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+}
+
+// FuzzDemuxer demuxes arbitrary data, which must not panic, hang, or
+// allocate beyond what the data holds.
+func FuzzDemuxer(f *testing.F) {
+	record, frames := ffv1test.Essence(f, 2)
+	f.Add(buildMXF(record, frames))
+	f.Add(buildMXF(record, nil))
+	f.Add(append(headerPartitionKey[:], 0x84, 0x40, 0x00, 0x00, 0x00))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := NewDemuxer(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for {
+			packet, err := d.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(packet.Data) > len(data) {
+				t.Fatalf("packet of %d bytes from %d bytes of data", len(packet.Data), len(data))
+			}
+		}
+	})
+}
@@ -0,0 +1,685 @@
+// Package nut implements a streaming NUT demuxer, just enough to find
+// an FFV1 stream, set up a decoder for it, and read its packets.
+//
+// It reads front to back without seeking, so it works on pipes, e.g.
+// the output of 'ffmpeg -f nut -'. Index and info packets are skipped.
+package nut
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+// The file ID string, including its terminating zero byte.
+const idString = "nut/multimedia container\x00"
+
+// Packet startcodes.
+const (
+	mainStartcode      = 0x4E4D7A561F5F04AD
+	streamStartcode    = 0x4E5311405BF2F9C4
+	syncpointStartcode = 0x4E4BE4ADEECA4569
+)
+
+// Frame flags.
+const (
+	flagKey       = 1
+	flagCodedPTS  = 8
+	flagStreamID  = 16
+	flagSizeMSB   = 32
+	flagChecksum  = 64
+	flagReserved  = 128
+	flagSMData    = 256
+	flagHeaderIdx = 1024
+	flagMatchTime = 2048
+	flagCoded     = 4096
+	flagInvalid   = 8192
+)
+
+// Main header flags.
+const mainFlagBroadcast = 1
+
+// Stream classes.
+const (
+	ClassVideo    = 0
+	ClassAudio    = 1
+	ClassSubtitle = 2
+	ClassUserData = 3
+)
+
+// Largest packet that will be read into memory.
+const maxPacketSize = 1 << 30
+
+// Stream describes a stream in the file.
+type Stream struct {
+	// Index of the stream, as used by Packet.Stream.
+	Index int
+	// Class of the stream. See the Class constants.
+	Class uint64
+	// FourCC of the stream's codec, e.g. "FFV1".
+	FourCC string
+	// Codec specific data. For FFV1, this is the configuration record.
+	CodecData []byte
+	// Time base of the stream's timestamps, in seconds.
+	TimeBaseNum uint64
+	TimeBaseDen uint64
+	// Width of the video, in pixels, or zero if not a video stream.
+	Width uint32
+	// Height of the video, in pixels, or zero if not a video stream.
+	Height uint32
+}
+
+// Packet is a frame read from the file.
+type Packet struct {
+	// Index of the stream the packet belongs to.
+	Stream int
+	// Data is the frame itself.
+	Data []byte
+	// PTS of the frame, in the stream's time base.
+	PTS int64
+	// Timestamp of the frame.
+	Timestamp time.Duration
+	// Whether or not the frame is a keyframe.
+	Keyframe bool
+}
+
+type timeBase struct {
+	num uint64
+	den uint64
+}
+
+// The properties of a frame code, from the main header.
+type frameCode struct {
+	flags     uint64
+	stream    uint64
+	sizeMul   uint64
+	sizeLSB   uint64
+	ptsDelta  int64
+	reserved  uint64
+	headerIdx uint64
+}
+
+type streamState struct {
+	timeBase    timeBase
+	msbPTSShift uint64
+	lastPTS     int64
+	seen        bool
+}
+
+// Demuxer is a NUT demuxer instance.
+type Demuxer struct {
+	r         *bufio.Reader
+	version   uint64
+	flags     uint64
+	timeBases []timeBase
+	codes     [256]frameCode
+	// Elision headers; the first is always empty.
+	headers [][]byte
+	streams []Stream
+	state   []streamState
+}
+
+// NewDemuxer reads the headers of a NUT file, up to the first packet
+// after the main header and all of the stream headers.
+func NewDemuxer(r io.Reader) (*Demuxer, error) {
+	ret := &Demuxer{r: bufio.NewReader(r)}
+
+	id := make([]byte, len(idString))
+	_, err := io.ReadFull(ret.r, id)
+	if err != nil || string(id) != idString {
+		return nil, fmt.Errorf("not a NUT file")
+	}
+
+	for ret.streams == nil || !ret.haveStreams() {
+		pkt, err := ret.readUnit()
+		if err == io.EOF {
+			return nil, fmt.Errorf("missing stream headers")
+		} else if err != nil {
+			return nil, err
+		}
+		if pkt != nil {
+			return nil, fmt.Errorf("frame before stream headers")
+		}
+	}
+
+	return ret, nil
+}
+
+func (d *Demuxer) haveStreams() bool {
+	for _, s := range d.state {
+		if !s.seen {
+			return false
+		}
+	}
+	return true
+}
+
+// Streams returns the streams in the file.
+func (d *Demuxer) Streams() []Stream {
+	return d.streams
+}
+
+// FFV1Stream returns the first FFV1 stream in the file.
+func (d *Demuxer) FFV1Stream() (*Stream, error) {
+	for i := range d.streams {
+		if d.streams[i].Class == ClassVideo && d.streams[i].FourCC == "FFV1" {
+			return &d.streams[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no FFV1 stream found")
+}
+
+// NewDecoder creates an FFV1 decoder for the first FFV1 stream in the
+// file, with the given options, which may be nil, and returns it along
+// with the stream. Packets for other streams should be skipped.
+func (d *Demuxer) NewDecoder(options *ffv1.DecoderOptions) (*ffv1.Decoder, *Stream, error) {
+	s, err := d.FFV1Stream()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec, err := ffv1.NewDecoderWithOptions(s.CodecData, s.Width, s.Height, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dec, s, nil
+}
+
+// ReadPacket returns the next frame, of any stream, in file order. It
+// returns io.EOF at the end of the file.
+func (d *Demuxer) ReadPacket() (*Packet, error) {
+	for {
+		pkt, err := d.readUnit()
+		if err != nil {
+			return nil, err
+		}
+		if pkt != nil {
+			return pkt, nil
+		}
+	}
+}
+
+// Reads either a packet with a startcode, returning nil, or a frame.
+// Repeated main and stream headers are skipped.
+func (d *Demuxer) readUnit() (*Packet, error) {
+	first, err := d.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != 'N' {
+		if d.streams == nil {
+			return nil, fmt.Errorf("frame before main header")
+		}
+		return d.readFrame()
+	}
+
+	var sc [8]byte
+	_, err = io.ReadFull(d.r, sc[:])
+	if err != nil {
+		return nil, fmt.Errorf("truncated startcode")
+	}
+	startcode := binary.BigEndian.Uint64(sc[:])
+
+	data, err := d.readPacket(sc[:])
+	if err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(data)
+	r := &reader{r: br}
+
+	switch startcode {
+	case mainStartcode:
+		if d.streams == nil {
+			err = d.parseMainHeader(r, br)
+			if err != nil {
+				return nil, fmt.Errorf("invalid main header: %s", err.Error())
+			}
+		}
+	case streamStartcode:
+		if d.streams == nil {
+			return nil, fmt.Errorf("stream header before main header")
+		}
+		err = d.parseStreamHeader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream header: %s", err.Error())
+		}
+	case syncpointStartcode:
+		if d.streams == nil {
+			return nil, fmt.Errorf("syncpoint before main header")
+		}
+		err = d.parseSyncpoint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syncpoint: %s", err.Error())
+		}
+	}
+
+	return nil, nil
+}
+
+// Reads the rest of a packet's header, after its startcode, and its
+// data, checking both checksums, and returns the data, without the
+// checksum.
+func (d *Demuxer) readPacket(startcode []byte) ([]byte, error) {
+	// The header checksum covers forward_ptr as it is coded.
+	hdr := append([]byte{}, startcode...)
+	forwardPtr := uint64(0)
+	for i := 0; ; i++ {
+		b, err := d.r.ReadByte()
+		if err != nil || i == 9 {
+			return nil, fmt.Errorf("invalid forward_ptr")
+		}
+		hdr = append(hdr, b)
+		forwardPtr = forwardPtr<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if forwardPtr > 4096 {
+		var checksum [4]byte
+		_, err := io.ReadFull(d.r, checksum[:])
+		if err != nil {
+			return nil, fmt.Errorf("truncated packet header")
+		}
+		if updateCRC(0, append(hdr, checksum[:]...)) != 0 {
+			return nil, fmt.Errorf("packet header checksum mismatch")
+		}
+	}
+	if forwardPtr < 4 || forwardPtr > maxPacketSize {
+		return nil, fmt.Errorf("invalid forward_ptr: %d", forwardPtr)
+	}
+
+	r := &reader{r: d.r}
+	data := r.bytes(forwardPtr)
+	if r.err != nil {
+		return nil, fmt.Errorf("truncated packet")
+	}
+	if updateCRC(0, data) != 0 {
+		return nil, fmt.Errorf("packet checksum mismatch")
+	}
+
+	return data[:len(data)-4], nil
+}
+
+// The reader must read from br, which is used to find out if the
+// optional fields at the end are present.
+func (d *Demuxer) parseMainHeader(r *reader, br *bytes.Reader) error {
+	d.version = r.v()
+	if r.err == nil && (d.version < 2 || d.version > 4) {
+		return fmt.Errorf("unsupported NUT version: %d", d.version)
+	}
+	if d.version > 3 {
+		r.v() // minor_version
+	}
+
+	streamCount := r.v()
+	r.v() // max_distance
+	timeBaseCount := r.v()
+	if r.err != nil {
+		return r.err
+	}
+	if streamCount == 0 || streamCount > 256 {
+		return fmt.Errorf("invalid stream_count: %d", streamCount)
+	}
+	if timeBaseCount == 0 || timeBaseCount > uint64(br.Size())/2 {
+		return fmt.Errorf("invalid time_base_count: %d", timeBaseCount)
+	}
+
+	d.timeBases = make([]timeBase, timeBaseCount)
+	for i := range d.timeBases {
+		d.timeBases[i].num = r.v()
+		d.timeBases[i].den = r.v()
+		if r.err == nil && (d.timeBases[i].num == 0 || d.timeBases[i].den == 0) {
+			return fmt.Errorf("invalid time base: %d/%d", d.timeBases[i].num, d.timeBases[i].den)
+		}
+	}
+
+	// The frame code table is coded as runs of codes that share most of
+	// their properties. Values carry over from one run to the next,
+	// except for the size and reserved count.
+	var ptsDelta int64
+	var sizeMul uint64 = 1
+	var stream, headerIdx uint64
+	for i := 0; i < 256 && r.err == nil; {
+		flags := r.v()
+		fields := r.v()
+		if fields > 0 {
+			ptsDelta = r.s()
+		}
+		if fields > 1 {
+			sizeMul = r.v()
+		}
+		if fields > 2 {
+			stream = r.v()
+		}
+		var sizeLSB, reserved uint64
+		if fields > 3 {
+			sizeLSB = r.v()
+		}
+		if fields > 4 {
+			reserved = r.v()
+		}
+		count := sizeMul - sizeLSB
+		if fields > 5 {
+			count = r.v()
+		}
+		if fields > 6 {
+			r.s() // match_time_delta
+		}
+		if fields > 7 {
+			headerIdx = r.v()
+		}
+		for j := uint64(8); j < fields && r.err == nil; j++ {
+			r.v() // reserved
+		}
+		if r.err != nil {
+			break
+		}
+
+		if stream >= streamCount {
+			return fmt.Errorf("invalid frame code stream: %d", stream)
+		}
+		left := uint64(256 - i)
+		if i <= 'N' {
+			left--
+		}
+		if count == 0 || count > left {
+			return fmt.Errorf("invalid frame code count: %d", count)
+		}
+
+		// 'N' is never a frame code, as it starts every startcode.
+		for j := uint64(0); j < count; j++ {
+			if i == 'N' {
+				d.codes[i].flags = flagInvalid
+				i++
+			}
+			d.codes[i] = frameCode{
+				flags:     flags,
+				stream:    stream,
+				sizeMul:   sizeMul,
+				sizeLSB:   sizeLSB + j,
+				ptsDelta:  ptsDelta,
+				reserved:  reserved,
+				headerIdx: headerIdx,
+			}
+			i++
+		}
+		if i == 'N' {
+			d.codes[i].flags = flagInvalid
+			i++
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// Elision headers, which may be left off in older files.
+	d.headers = [][]byte{nil}
+	if br.Len() > 0 {
+		headerCount := r.v() + 1
+		if r.err == nil && headerCount > 128 {
+			return fmt.Errorf("invalid header_count: %d", headerCount)
+		}
+		for i := uint64(1); i < headerCount && r.err == nil; i++ {
+			header := r.vb()
+			if r.err == nil && (len(header) == 0 || len(header) > 255) {
+				return fmt.Errorf("invalid elision header length: %d", len(header))
+			}
+			d.headers = append(d.headers, header)
+		}
+	}
+	if d.version > 3 && br.Len() > 0 {
+		d.flags = r.v()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	d.streams = make([]Stream, streamCount)
+	d.state = make([]streamState, streamCount)
+	for i := range d.streams {
+		d.streams[i].Index = i
+	}
+
+	return nil
+}
+
+func (d *Demuxer) parseStreamHeader(r *reader) error {
+	id := r.v()
+	if r.err != nil {
+		return r.err
+	}
+	if id >= uint64(len(d.streams)) {
+		return fmt.Errorf("invalid stream_id: %d", id)
+	}
+	st := &d.state[id]
+	if st.seen {
+		// A repeated header.
+		return nil
+	}
+	s := &d.streams[id]
+
+	s.Class = r.v()
+	fourcc := r.vb()
+	if r.err == nil && len(fourcc) != 2 && len(fourcc) != 4 {
+		return fmt.Errorf("invalid fourcc length: %d", len(fourcc))
+	}
+	s.FourCC = string(fourcc)
+	timeBaseID := r.v()
+	st.msbPTSShift = r.v()
+	r.v() // max_pts_distance
+	r.v() // decode_delay
+	r.v() // stream_flags
+	s.CodecData = r.vb()
+	if r.err != nil {
+		return r.err
+	}
+	if timeBaseID >= uint64(len(d.timeBases)) {
+		return fmt.Errorf("invalid time_base_id: %d", timeBaseID)
+	}
+	if st.msbPTSShift >= 48 {
+		return fmt.Errorf("invalid msb_pts_shift: %d", st.msbPTSShift)
+	}
+	st.timeBase = d.timeBases[timeBaseID]
+	s.TimeBaseNum = st.timeBase.num
+	s.TimeBaseDen = st.timeBase.den
+
+	if s.Class == ClassVideo {
+		width := r.v()
+		height := r.v()
+		r.v() // sample_width
+		r.v() // sample_height
+		r.v() // colorspace_type
+		if r.err != nil {
+			return r.err
+		}
+		if width == 0 || height == 0 || width > 1<<31 || height > 1<<31 {
+			return fmt.Errorf("invalid dimensions: %dx%d", width, height)
+		}
+		s.Width = uint32(width)
+		s.Height = uint32(height)
+	}
+
+	st.seen = r.err == nil
+	return r.err
+}
+
+// A syncpoint resets the last PTS of every stream to its global_key_pts.
+func (d *Demuxer) parseSyncpoint(r *reader) error {
+	t := r.v()
+	r.v() // back_ptr_div16
+	if d.flags&mainFlagBroadcast != 0 {
+		r.v() // transmit_ts
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	tb := d.timeBases[t%uint64(len(d.timeBases))]
+	pts := new(big.Int).SetUint64(t / uint64(len(d.timeBases)))
+	for i := range d.state {
+		st := &d.state[i]
+		if !st.seen {
+			continue
+		}
+		st.lastPTS = rescale(pts, tb.num, st.timeBase.den, tb.den, st.timeBase.num)
+	}
+
+	return nil
+}
+
+// Reads a frame header and its data.
+func (d *Demuxer) readFrame() (*Packet, error) {
+	r := &reader{r: d.r}
+
+	code := &d.codes[r.u8()]
+	flags := code.flags
+	if flags&flagInvalid != 0 {
+		return nil, fmt.Errorf("invalid frame code")
+	}
+	if flags&flagCoded != 0 {
+		flags ^= r.v()
+	}
+	stream := code.stream
+	if flags&flagStreamID != 0 {
+		stream = r.v()
+	}
+	if r.err == nil && stream >= uint64(len(d.streams)) {
+		return nil, fmt.Errorf("invalid stream_id: %d", stream)
+	}
+	st := &d.state[stream]
+	if !st.seen {
+		return nil, fmt.Errorf("frame for stream %d before its header", stream)
+	}
+
+	var pts int64
+	if flags&flagCodedPTS != 0 {
+		coded := r.v()
+		if coded < 1<<st.msbPTSShift {
+			pts = lsbToFull(st, int64(coded))
+		} else {
+			pts = int64(coded - 1<<st.msbPTSShift)
+		}
+	} else {
+		pts = st.lastPTS + code.ptsDelta
+	}
+
+	size := code.sizeLSB
+	if flags&flagSizeMSB != 0 {
+		size += code.sizeMul * r.v()
+	}
+	if flags&flagMatchTime != 0 {
+		r.s() // match_time_delta
+	}
+	headerIdx := code.headerIdx
+	if flags&flagHeaderIdx != 0 {
+		headerIdx = r.v()
+	}
+	reserved := code.reserved
+	if flags&flagReserved != 0 {
+		reserved = r.v()
+	}
+	for i := uint64(0); i < reserved && r.err == nil; i++ {
+		r.v()
+	}
+	if flags&flagChecksum != 0 {
+		// Not checked, as FFmpeg does not either.
+		r.u32()
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid frame header: %s", r.err.Error())
+	}
+
+	if headerIdx >= uint64(len(d.headers)) {
+		return nil, fmt.Errorf("invalid header_idx: %d", headerIdx)
+	}
+	if size > 4096 {
+		headerIdx = 0
+	}
+	header := d.headers[headerIdx]
+	if size < uint64(len(header)) {
+		return nil, fmt.Errorf("frame smaller than its elision header")
+	}
+	size -= uint64(len(header))
+
+	data := r.bytes(size)
+	if r.err != nil {
+		return nil, fmt.Errorf("truncated frame: %s", r.err.Error())
+	}
+
+	if flags&flagSMData != 0 {
+		if d.version < 4 {
+			return nil, fmt.Errorf("side data in a version %d file", d.version)
+		}
+		n, err := skipSMData(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid side data: %s", err.Error())
+		}
+		data = data[n:]
+	}
+	if len(header) > 0 {
+		data = append(append([]byte{}, header...), data...)
+	}
+
+	st.lastPTS = pts
+
+	return &Packet{
+		Stream:    int(stream),
+		Data:      data,
+		PTS:       pts,
+		Timestamp: time.Duration(rescale(big.NewInt(pts), st.timeBase.num, uint64(time.Second), st.timeBase.den, 1)),
+		Keyframe:  flags&flagKey != 0,
+	}, nil
+}
+
+// Works out a full PTS from its least significant bits, picking the
+// one closest to the last PTS of the stream.
+func lsbToFull(st *streamState, lsb int64) int64 {
+	mask := int64(1)<<st.msbPTSShift - 1
+	delta := st.lastPTS - mask/2
+	return ((lsb - delta) & mask) + delta
+}
+
+// Skips the side data and metadata at the start of a frame's data, and
+// returns their size.
+func skipSMData(data []byte) (int, error) {
+	br := bytes.NewReader(data)
+	r := &reader{r: br}
+	for list := 0; list < 2; list++ {
+		count := r.v()
+		for i := uint64(0); i < count && r.err == nil; i++ {
+			r.vb() // name
+			value := r.s()
+			switch {
+			case value == -1:
+				r.vb() // UTF-8 string
+			case value == -2:
+				r.vb() // type
+				r.vb() // binary data
+			case value == -3:
+				r.s()
+			case value == -4:
+				r.v()
+			case value < -4:
+				r.s() // numerator of a rational
+			}
+		}
+	}
+	return len(data) - br.Len(), r.err
+}
+
+// Computes v * num1 * num2 / (den1 * den2), rounding down.
+func rescale(v *big.Int, num1 uint64, num2 uint64, den1 uint64, den2 uint64) int64 {
+	ret := new(big.Int).Mul(v, new(big.Int).SetUint64(num1))
+	ret.Mul(ret, new(big.Int).SetUint64(num2))
+	den := new(big.Int).SetUint64(den1)
+	den.Mul(den, new(big.Int).SetUint64(den2))
+	return ret.Div(ret, den).Int64()
+}
@@ -0,0 +1,413 @@
+package nut
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dwbuiten/go-ffv1/internal/ffv1test"
+)
+
+// Writes the NUT types, as reader reads them.
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) v(v uint64) {
+	var tmp []byte
+	for {
+		tmp = append([]byte{byte(v & 0x7F)}, tmp...)
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := 0; i < len(tmp)-1; i++ {
+		tmp[i] |= 0x80
+	}
+	w.buf = append(w.buf, tmp...)
+}
+
+func (w *writer) s(v int64) {
+	if v <= 0 {
+		w.v(uint64(-2 * v))
+	} else {
+		w.v(uint64(2*v - 1))
+	}
+}
+
+func (w *writer) vb(data []byte) {
+	w.v(uint64(len(data)))
+	w.buf = append(w.buf, data...)
+}
+
+func be64(buf []byte, v uint64) []byte {
+	return be32(be32(buf, uint32(v>>32)), uint32(v))
+}
+
+func be32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Appends a packet with a startcode, with its checksums.
+func (w *writer) packet(startcode uint64, payload []byte) {
+	var hdr writer
+	hdr.buf = be64(nil, startcode)
+	hdr.v(uint64(len(payload) + 4))
+	if len(payload)+4 > 4096 {
+		hdr.buf = be32(hdr.buf, updateCRC(0, hdr.buf))
+	}
+	w.buf = append(w.buf, hdr.buf...)
+	w.buf = append(w.buf, payload...)
+	w.buf = be32(w.buf, updateCRC(0, payload))
+}
+
+// Frame codes used by buildNUT.
+const (
+	codeSizeMSB  = 1  // 1-16: keyframes with a size of 16 * msb + code - 1
+	codeCodedPTS = 17 // A coded PTS and a frame checksum.
+	codeElided   = 18 // A keyframe with elision header 1.
+	codeCoded    = 19 // 19 and up: flags coded in the frame.
+)
+
+// Writes a version 3 main header with one time base, of 1/25, and a
+// frame code table of runs of the codes above. The first two bytes of
+// every frame are the elision header.
+func mainHeader(header []byte) []byte {
+	var w writer
+	w.v(3)     // version
+	w.v(1)     // stream_count
+	w.v(65536) // max_distance
+	w.v(1)     // time_base_count
+	w.v(1)
+	w.v(25)
+
+	// Only the first run needs to code the header_idx, as it carries
+	// over, as does the PTS delta.
+	run := func(flags uint64, ptsDelta int64, sizeMul uint64, count uint64, headerIdx int) {
+		w.v(flags)
+		fields := uint64(6)
+		if headerIdx >= 0 {
+			fields = 8
+		}
+		w.v(fields)
+		w.s(ptsDelta)
+		w.v(sizeMul)
+		w.v(0) // stream_id
+		w.v(0) // size_lsb
+		w.v(0) // reserved_count
+		w.v(count)
+		if headerIdx >= 0 {
+			w.s(0) // match_time_delta
+			w.v(uint64(headerIdx))
+		}
+	}
+	run(flagInvalid, 0, 1, 1, 0)
+	run(flagKey|flagSizeMSB, 1, 16, 16, -1)
+	run(flagSizeMSB|flagCodedPTS|flagChecksum, 0, 1, 1, -1)
+	run(flagKey|flagSizeMSB, 1, 1, 1, 1)
+	// The rest, leaving out 'N'.
+	run(flagCoded, 1, 1, 256-codeCoded-1, 0)
+
+	w.v(1) // header_count - 1
+	w.vb(header)
+
+	return w.buf
+}
+
+func streamHeader(record []byte, msbPTSShift uint64) []byte {
+	var w writer
+	w.v(0) // stream_id
+	w.v(ClassVideo)
+	w.vb([]byte("FFV1"))
+	w.v(0) // time_base_id
+	w.v(msbPTSShift)
+	w.v(25)
+	w.v(0) // decode_delay
+	w.v(0) // stream_flags
+	w.vb(record)
+	w.v(ffv1test.Width)
+	w.v(ffv1test.Height)
+	w.v(1)
+	w.v(1)
+	w.v(0) // colorspace_type
+	return w.buf
+}
+
+// The PTS of each frame buildNUT writes.
+var testPTS = []int64{1, 2, 3, 10}
+
+// Builds a NUT file with four frames, each using a different frame
+// code: the first with its size from the frame code, the second with
+// a coded PTS of only its low bits, the third with an elision header,
+// and the fourth with coded flags and a full coded PTS. A syncpoint
+// sets the PTS to zero before them.
+func buildNUT(record []byte, frames [][]byte) []byte {
+	header := frames[2][:2]
+
+	w := &writer{buf: []byte(idString)}
+	w.packet(mainStartcode, mainHeader(header))
+	w.packet(streamStartcode, streamHeader(record, 7))
+
+	var sp writer
+	sp.v(0) // global_key_pts
+	sp.v(0) // back_ptr_div16
+	w.packet(syncpointStartcode, sp.buf)
+
+	size := uint64(len(frames[0]))
+	w.buf = append(w.buf, byte(codeSizeMSB+size%16))
+	w.v(size / 16)
+	w.buf = append(w.buf, frames[0]...)
+
+	w.buf = append(w.buf, codeCodedPTS)
+	w.v(uint64(testPTS[1]))
+	w.v(uint64(len(frames[1])))
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	w.buf = append(w.buf, frames[1]...)
+
+	w.buf = append(w.buf, codeElided)
+	w.v(uint64(len(frames[2])))
+	w.buf = append(w.buf, frames[2][len(header):]...)
+
+	w.buf = append(w.buf, codeCoded)
+	w.v(flagCoded ^ flagSizeMSB ^ flagCodedPTS)
+	w.v(uint64(testPTS[3]) + 1<<7)
+	w.v(uint64(len(frames[3])))
+	w.buf = append(w.buf, frames[3]...)
+
+	return w.buf
+}
+
+func TestDemuxer(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 4)
+
+	d, err := NewDemuxer(bytes.NewReader(buildNUT(record, frames)))
+	if err != nil {
+		t.Fatalf("couldn't open file: %s", err.Error())
+	}
+	dec, s, err := d.NewDecoder(nil)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+	if s.Width != ffv1test.Width || s.Height != ffv1test.Height || s.TimeBaseNum != 1 || s.TimeBaseDen != 25 {
+		t.Errorf("stream is %dx%d with a time base of %d/%d", s.Width, s.Height, s.TimeBaseNum, s.TimeBaseDen)
+	}
+
+	for i := range frames {
+		packet, err := d.ReadPacket()
+		if err != nil {
+			t.Fatalf("couldn't read packet %d: %s", i, err.Error())
+		}
+		if !bytes.Equal(packet.Data, frames[i]) {
+			t.Errorf("packet %d differs", i)
+		}
+		if packet.PTS != testPTS[i] || packet.Timestamp != time.Duration(testPTS[i])*40*time.Millisecond {
+			t.Errorf("packet %d has PTS %d, timestamp %s", i, packet.PTS, packet.Timestamp)
+		}
+		if packet.Keyframe != (i%2 == 0) {
+			t.Errorf("packet %d has keyframe %t", i, packet.Keyframe)
+		}
+		_, err = dec.DecodeFrame(packet.Data)
+		if err != nil {
+			t.Errorf("couldn't decode packet %d: %s", i, err.Error())
+		}
+	}
+
+	_, err = d.ReadPacket()
+	if err != io.EOF {
+		t.Errorf("got %v after the last packet, not io.EOF", err)
+	}
+}
+
+func TestFrameCodes(t *testing.T) {
+	d := new(Demuxer)
+	br := bytes.NewReader(mainHeader([]byte{1, 2}))
+	err := d.parseMainHeader(&reader{r: br}, br)
+	if err != nil {
+		t.Fatalf("couldn't parse main header: %s", err.Error())
+	}
+
+	tests := []struct {
+		code int
+		want frameCode
+	}{
+		{0, frameCode{flags: flagInvalid, sizeMul: 1}},
+		// The PTS delta carries over from the run before.
+		{1, frameCode{flags: flagKey | flagSizeMSB, sizeMul: 16, ptsDelta: 1}},
+		{16, frameCode{flags: flagKey | flagSizeMSB, sizeMul: 16, sizeLSB: 15, ptsDelta: 1}},
+		{codeCodedPTS, frameCode{flags: flagSizeMSB | flagCodedPTS | flagChecksum, sizeMul: 1}},
+		{codeElided, frameCode{flags: flagKey | flagSizeMSB, sizeMul: 1, ptsDelta: 1, headerIdx: 1}},
+		{codeCoded, frameCode{flags: flagCoded, sizeMul: 1, ptsDelta: 1}},
+		{'N' - 1, frameCode{flags: flagCoded, sizeMul: 1, sizeLSB: 'N' - 1 - codeCoded, ptsDelta: 1}},
+		{'N', frameCode{flags: flagInvalid}},
+		{'N' + 1, frameCode{flags: flagCoded, sizeMul: 1, sizeLSB: 'N' - codeCoded, ptsDelta: 1}},
+		{255, frameCode{flags: flagCoded, sizeMul: 1, sizeLSB: 255 - codeCoded - 1, ptsDelta: 1}},
+	}
+	for _, test := range tests {
+		if got := d.codes[test.code]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("frame code %d is %+v, not %+v", test.code, got, test.want)
+		}
+	}
+	if !reflect.DeepEqual(d.headers, [][]byte{nil, {1, 2}}) {
+		t.Errorf("elision headers are %v", d.headers)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// CRC-32/POSIX, without its final inversion.
+	if crc := updateCRC(0, []byte("123456789")); crc != ^uint32(0x765E7680) {
+		t.Errorf("checksum is 0x%08X", crc)
+	}
+
+	record, frames := ffv1test.Essence(t, 1)
+	file := buildNUT(record, [][]byte{frames[0], frames[0], frames[0], frames[0]})
+
+	// Flip a bit in the middle of the stream header's data.
+	streamStart := bytes.Index(file, be64(nil, streamStartcode))
+	broken := append([]byte{}, file...)
+	broken[streamStart+12] ^= 1
+	_, err := NewDemuxer(bytes.NewReader(broken))
+	if err == nil {
+		t.Errorf("no error for a broken stream header")
+	}
+
+	// A packet of over 4096 bytes has a checksum of its header too.
+	w := &writer{buf: []byte(idString)}
+	w.packet(mainStartcode, mainHeader(frames[0][:2]))
+	big := make([]byte, 5000)
+	w.packet(0x4E49AB68B596BA78, big) // An info packet, which is skipped.
+	w.packet(streamStartcode, streamHeader(record, 7))
+	_, err = NewDemuxer(bytes.NewReader(w.buf))
+	if err != nil {
+		t.Errorf("couldn't open file with a large packet: %s", err.Error())
+	}
+	for i := len(idString); i < len(w.buf)-8; i++ {
+		if binary.BigEndian.Uint64(w.buf[i:]) == 0x4E49AB68B596BA78 {
+			// The header checksum follows the startcode and the two
+			// byte forward_ptr.
+			w.buf[i+10] ^= 1
+			break
+		}
+	}
+	_, err = NewDemuxer(bytes.NewReader(w.buf))
+	if err == nil {
+		t.Errorf("no error for a broken packet header")
+	}
+}
+
+func TestLsbToFull(t *testing.T) {
+	tests := []struct {
+		last  int64
+		shift uint64
+		lsb   int64
+		want  int64
+	}{
+		{0, 7, 5, 5},
+		{100, 7, 101 & 127, 101},
+		// Wrapping forwards and backwards.
+		{126, 7, 2, 130},
+		{130, 7, 126, 126},
+		// Nearest to the last PTS, half a range either way.
+		{1000, 4, 1000 & 15, 1000},
+		{1000, 4, (1000 + 8) & 15, 1000 + 8},
+		{1000, 4, (1000 - 7) & 15, 1000 - 7},
+		{-5, 7, (-3) & 127, -3},
+		// Up to 47 bits, as FFmpeg writes.
+		{1 << 40, 47, 1<<40 + 3, 1<<40 + 3},
+		{1<<47 - 1, 47, 1, 1<<47 + 1},
+	}
+	for _, test := range tests {
+		st := &streamState{lastPTS: test.last, msbPTSShift: test.shift}
+		if got := lsbToFull(st, test.lsb); got != test.want {
+			t.Errorf("lsbToFull(%d, %d bits of %d) is %d, not %d", test.last, test.shift, test.lsb, got, test.want)
+		}
+	}
+}
+
+func TestMSBPTSShift(t *testing.T) {
+	record, _ := ffv1test.Essence(t, 1)
+	for _, test := range []struct {
+		shift uint64
+		ok    bool
+	}{
+		{0, true},
+		{16, true},
+		{47, true},
+		{48, false},
+		{64, false},
+	} {
+		w := &writer{buf: []byte(idString)}
+		w.packet(mainStartcode, mainHeader([]byte{1, 2}))
+		w.packet(streamStartcode, streamHeader(record, test.shift))
+		_, err := NewDemuxer(bytes.NewReader(w.buf))
+		if (err == nil) != test.ok {
+			t.Errorf("msb_pts_shift of %d: got error %v", test.shift, err)
+		}
+	}
+}
+
+// Sizes in broken files must not be trusted for allocations.
+func TestLargeSize(t *testing.T) {
+	record, frames := ffv1test.Essence(t, 1)
+
+	// A packet which says it is 512 MiB, but is cut off.
+	packet := &writer{buf: []byte(idString)}
+	packet.packet(mainStartcode, mainHeader(frames[0][:2]))
+	packet.buf = be64(packet.buf, streamStartcode)
+	hdr := len(packet.buf) - 8
+	packet.v(1 << 29)
+	packet.buf = be32(packet.buf, updateCRC(0, packet.buf[hdr:]))
+	packet.buf = append(packet.buf, 1, 2, 3)
+
+	// A frame which says it is 512 MiB, but is cut off.
+	frame := &writer{buf: buildNUT(record, [][]byte{frames[0], frames[0], frames[0], frames[0]})}
+	frame.buf = append(frame.buf, codeSizeMSB)
+	frame.v(1 << 25)
+	frame.buf = append(frame.buf, 1, 2, 3)
+
+	for name, data := range map[string][]byte{"packet": packet.buf, "frame": frame.buf} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		d, err := NewDemuxer(bytes.NewReader(data))
+		for err == nil {
+			_, err = d.ReadPacket()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: no error", name)
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", name, allocated)
+		}
+	}
+}
+
+// FuzzDemuxer demuxes arbitrary data, which must not panic, hang, or
+// allocate beyond what the data holds.
+func FuzzDemuxer(f *testing.F) {
+	record, frames := ffv1test.Essence(f, 4)
+	f.Add(buildNUT(record, frames))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := NewDemuxer(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		d.NewDecoder(nil)
+		for {
+			packet, err := d.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(packet.Data) > len(data)+255 {
+				t.Fatalf("packet of %d bytes from %d bytes of data", len(packet.Data), len(data))
+			}
+		}
+	})
+}
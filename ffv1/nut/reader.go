@@ -0,0 +1,120 @@
+package nut
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Reads the NUT types, keeping the first error, so that whole headers
+// can be read before checking for one.
+type reader struct {
+	r   byteReader
+	err error
+}
+
+func (r *reader) u8() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+	return b
+}
+
+func (r *reader) u32() uint32 {
+	buf := r.bytes(4)
+	if len(buf) < 4 {
+		return 0
+	}
+	return uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+}
+
+// Reads an unsigned variable length integer: 7 bits per byte, most
+// significant first, with the top bit set on all but the last byte.
+func (r *reader) v() uint64 {
+	v := uint64(0)
+	for i := 0; ; i++ {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if i == 9 {
+			r.err = fmt.Errorf("variable length integer too long")
+			return 0
+		}
+		v = v<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+// Reads a signed variable length integer, coded as v, with the sign in
+// the bottom bit.
+func (r *reader) s() int64 {
+	v := r.v() + 1
+	if v&1 != 0 {
+		return -int64(v >> 1)
+	}
+	return int64(v >> 1)
+}
+
+// Reads a variable length byte string: its length, and the bytes.
+func (r *reader) vb() []byte {
+	return r.bytes(r.v())
+}
+
+func (r *reader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > maxPacketSize {
+		r.err = fmt.Errorf("string too long: %d bytes", n)
+		return nil
+	}
+	// The buffer grows as data is read, rather than being allocated
+	// up front from a length which could be anything in a broken file.
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r.r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+	return buf.Bytes()
+}
+
+// Table for CRC-32 with the 0x04C11DB7 polynomial, most significant bit
+// first, as used for NUT checksums.
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		table[i] = c
+	}
+	return table
+}()
+
+// Updates a NUT checksum, which starts at zero. Checksums are stored
+// big endian, so that of the data and its checksum together is zero.
+func updateCRC(crc uint32, buf []byte) uint32 {
+	for _, b := range buf {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,100 @@
+package ffv1
+
+import (
+	"sync"
+)
+
+// FramePool is a pool of frames, whose image data can be reused by
+// DecodeFrameInto, to avoid allocating new planes for every frame.
+//
+// It holds a bounded number of frames, all of the same format. When a
+// frame of a different format is released, e.g. because the stream
+// changed resolution, the frames already in the pool are dropped, as
+// their planes would not fit.
+//
+// It is safe to use from multiple goroutines.
+type FramePool struct {
+	lock   sync.Mutex
+	size   int
+	class  frameClass
+	frames []*Frame
+}
+
+// What decides the sizes of a frame's planes.
+type frameClass struct {
+	width            uint32
+	height           uint32
+	bitDepth         uint8
+	float            bool
+	hasChroma        bool
+	hasAlpha         bool
+	chromaSubsampleV uint8
+	chromaSubsampleH uint8
+}
+
+func classOf(f *Frame) frameClass {
+	return frameClass{
+		width:            f.Width,
+		height:           f.Height,
+		bitDepth:         f.BitDepth,
+		float:            f.Float,
+		hasChroma:        f.HasChroma,
+		hasAlpha:         f.HasAlpha,
+		chromaSubsampleV: f.ChromaSubsampleV,
+		chromaSubsampleH: f.ChromaSubsampleH,
+	}
+}
+
+// NewFramePool creates a new, empty, frame pool, which holds at most
+// 'size' frames. Frames released when it is full are dropped.
+func NewFramePool(size int) *FramePool {
+	if size < 1 {
+		size = 1
+	}
+
+	ret := new(FramePool)
+	ret.size = size
+
+	return ret
+}
+
+// Get returns a frame from the pool, or a new, empty, frame if the
+// pool is empty. It is meant to be passed to DecodeFrameInto.
+func (p *FramePool) Get() *Frame {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.frames) == 0 {
+		return new(Frame)
+	}
+
+	f := p.frames[len(p.frames)-1]
+	p.frames[len(p.frames)-1] = nil
+	p.frames = p.frames[:len(p.frames)-1]
+
+	return f
+}
+
+// Release returns a frame to the pool. The frame, and its image
+// data, must not be used by the caller afterwards.
+func (p *FramePool) Release(f *Frame) {
+	if f == nil {
+		return
+	}
+	f.Concealed = f.Concealed[:0]
+	class := classOf(f)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if class != p.class {
+		for i := range p.frames {
+			p.frames[i] = nil
+		}
+		p.frames = p.frames[:0]
+		p.class = class
+	}
+	if len(p.frames) < p.size {
+		p.frames = append(p.frames, f)
+	}
+}
@@ -0,0 +1,134 @@
+package ffv1
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFramePool(t *testing.T) {
+	pool := NewFramePool(2)
+
+	frames := []*Frame{
+		{Width: 16, Height: 8, BitDepth: 8},
+		{Width: 16, Height: 8, BitDepth: 8},
+		{Width: 16, Height: 8, BitDepth: 8},
+	}
+	for _, f := range frames {
+		pool.Release(f)
+	}
+	if len(pool.frames) != 2 {
+		t.Fatalf("pool holds %d frames, not 2", len(pool.frames))
+	}
+	if f := pool.Get(); f != frames[1] {
+		t.Errorf("got %p, not the last frame kept, %p", f, frames[1])
+	}
+
+	// A frame of another size evicts the rest.
+	other := &Frame{Width: 32, Height: 8, BitDepth: 8}
+	pool.Release(other)
+	if len(pool.frames) != 1 {
+		t.Fatalf("pool holds %d frames after a size change, not 1", len(pool.frames))
+	}
+	if f := pool.Get(); f != other {
+		t.Errorf("got %p, not the frame of the new size, %p", f, other)
+	}
+	if f := pool.Get(); f == nil || f == frames[0] || f.Buf != nil {
+		t.Errorf("got %p from an empty pool, not a new frame", f)
+	}
+}
+
+func TestDecodeFrameIntoReuse(t *testing.T) {
+	opts := EncoderOptions{
+		Width:            16,
+		Height:           8,
+		HasChroma:        true,
+		ChromaSubsampleH: 1,
+		ChromaSubsampleV: 1,
+		GOPSize:          2,
+	}
+	e, err := NewEncoder(opts)
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+	d, err := NewDecoder(e.Record(), opts.Width, opts.Height)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+
+	pool := NewFramePool(1)
+	var planes []*byte
+	for n := 0; n < 3; n++ {
+		in := testFrame(opts, n)
+		packet, err := e.EncodeFrame(in)
+		if err != nil {
+			t.Fatalf("frame %d: couldn't encode: %s", n, err.Error())
+		}
+		out := pool.Get()
+		err = d.DecodeFrameInto(packet, out)
+		if err != nil {
+			t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+		}
+		for p := range in.Buf {
+			if !bytes.Equal(out.Buf[p], in.Buf[p]) {
+				t.Fatalf("frame %d: plane %d differs", n, p)
+			}
+		}
+		if planes == nil {
+			for p := range out.Buf {
+				planes = append(planes, &out.Buf[p][0])
+			}
+		} else {
+			for p := range out.Buf {
+				if &out.Buf[p][0] != planes[p] {
+					t.Errorf("frame %d: plane %d was not reused", n, p)
+				}
+			}
+		}
+		pool.Release(out)
+	}
+}
+
+// The decoder's scratch space must never end up in the caller's frame,
+// not even when a slice fails.
+func TestDecodeFrameIntoScratch(t *testing.T) {
+	opts := EncoderOptions{Width: 16, Height: 8, HasChroma: true, EC: true}
+	yuv, packets := encodeSequence(t, opts, 1)
+	packet := packets[0]
+
+	// 8-bit RGB is decoded through Buf16. The samples are meaningless,
+	// but that does not matter here.
+	r, err := ParseConfigRecord(yuv)
+	if err != nil {
+		t.Fatalf("couldn't parse record: %s", err.Error())
+	}
+	r.ColorSpace = RGB
+	record, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal record: %s", err.Error())
+	}
+	d, err := NewDecoder(record, opts.Width, opts.Height)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+
+	dst := new(Frame)
+	err = d.DecodeFrameInto(packet, dst)
+	if err != nil {
+		t.Fatalf("couldn't decode: %s", err.Error())
+	}
+	if dst.Buf16 != nil || dst.buf32 != nil {
+		t.Errorf("scratch space left in the frame")
+	}
+
+	broken := append([]byte{}, packet...)
+	broken[len(broken)/2] ^= 0xFF
+	err = d.DecodeFrameInto(broken, dst)
+	var sliceErr *SliceError
+	if !errors.As(err, &sliceErr) {
+		t.Fatalf("got error %v, not a *SliceError", err)
+	}
+	if dst.Buf16 != nil || dst.buf32 != nil {
+		t.Errorf("scratch space left in the frame after a slice error")
+	}
+}
@@ -0,0 +1,185 @@
+package rangecoder
+
+// Encoder is an instance of a range encoder, the counterpart to Coder.
+//
+// Output is written to an internal, growable buffer, which is returned
+// by Finish or SentinalEnd.
+type Encoder struct {
+	buf               []byte
+	low               uint32
+	rng               uint32
+	outstanding_count int
+	outstanding_byte  int32
+	zero_state        [256]uint8
+	one_state         [256]uint8
+}
+
+// NewEncoder creates a new range encoder instance.
+//
+// See: 3.8.1. Range Coding Mode
+func NewEncoder() *Encoder {
+	ret := new(Encoder)
+
+	ret.low = 0
+	// Figure 13.
+	ret.rng = 0xFF00
+	ret.outstanding_byte = -1
+
+	// 3.8.1.3. Initial Values for the Context Model
+	ret.SetTable(DefaultStateTransition)
+
+	return ret
+}
+
+// SetTable sets the state transition table used by the encoder, which
+// must match the table used by the decoding Coder.
+func (c *Encoder) SetTable(table [256]uint8) {
+	// 3.8.1.4. State Transition Table
+
+	// Figure 17.
+	for i := 0; i < 256; i++ {
+		c.one_state[i] = table[i]
+	}
+	// Figure 18.
+	for i := 1; i < 255; i++ {
+		c.zero_state[i] = uint8(uint16(256) - uint16(c.one_state[256-i]))
+	}
+}
+
+// Renormalizes the range and writes out any settled bytes.
+//
+// Carries are handled by holding back the last byte written, along
+// with any 0xFF bytes that follow it, until it is known whether
+// they will be affected by a carry.
+func (c *Encoder) renorm() {
+	for c.rng < 0x100 {
+		if c.outstanding_byte < 0 {
+			c.outstanding_byte = int32(c.low >> 8)
+		} else if c.low <= 0xFF00 {
+			c.buf = append(c.buf, byte(c.outstanding_byte))
+			for ; c.outstanding_count > 0; c.outstanding_count-- {
+				c.buf = append(c.buf, 0xFF)
+			}
+			c.outstanding_byte = int32(c.low >> 8)
+		} else if c.low >= 0x10000 {
+			c.buf = append(c.buf, byte(c.outstanding_byte+1))
+			for ; c.outstanding_count > 0; c.outstanding_count-- {
+				c.buf = append(c.buf, 0x00)
+			}
+			c.outstanding_byte = int32(c.low>>8) - 0x100
+		} else {
+			c.outstanding_count++
+		}
+
+		c.low = (c.low & 0xFF) << 8
+		c.rng <<= 8
+	}
+}
+
+// Puts the next boolean state
+func (c *Encoder) put(state *uint8, bit bool) {
+	rangeoff := (c.rng * uint32(*state)) >> 8
+	if !bit {
+		c.rng -= rangeoff
+		*state = c.zero_state[int(*state)]
+	} else {
+		c.low += c.rng - rangeoff
+		c.rng = rangeoff
+		*state = c.one_state[int(*state)]
+	}
+	c.renorm()
+}
+
+// PutUR puts a range coded unsigned scalar symbol.
+//
+// See: 4. Bitstream
+func (c *Encoder) PutUR(state []uint8, v uint32) {
+	c.symbol(state, int64(v), false)
+}
+
+// PutSR puts a range coded signed scalar symbol.
+//
+// See: 4. Bitstream
+func (c *Encoder) PutSR(state []uint8, v int32) {
+	c.symbol(state, int64(v), true)
+}
+
+// PutBR puts a range coded Boolean symbol.
+//
+// See: 4. Bitstream
+func (c *Encoder) PutBR(state []uint8, v bool) {
+	c.put(&state[0], v)
+}
+
+// Puts a range coded symbol.
+//
+// See: 3.8.1.2. Range Non Binary Values
+func (c *Encoder) symbol(state []uint8, v int64, signed bool) {
+	if v == 0 {
+		c.put(&state[0], true)
+		return
+	}
+
+	a := v
+	if a < 0 {
+		a = -a
+	}
+	e := int32(0)
+	for (a >> uint(e+1)) != 0 {
+		e++
+	}
+
+	c.put(&state[0], false)
+	for i := int32(0); i < e; i++ {
+		c.put(&state[1+min32(i, 9)], true)
+	}
+	c.put(&state[1+min32(e, 9)], false)
+
+	for i := e - 1; i >= 0; i-- {
+		c.put(&state[22+min32(i, 9)], (a>>uint(i))&1 == 1)
+	}
+
+	if signed {
+		c.put(&state[11+min32(e, 10)], v < 0)
+	}
+}
+
+// Finish terminates the range coder and returns the coded bytes.
+//
+// Unlike SentinalEnd, all of low is written out, rather than just
+// enough of it for the data to decode if followed by zeroes, so that
+// other data, such as a CRC, may follow.
+//
+// See: 3.8.1.1.1. Termination
+func (c *Encoder) Finish() []byte {
+	for i := 0; i < 3; i++ {
+		c.rng = 0xFF
+		c.renorm()
+	}
+
+	return c.buf
+}
+
+// SentinalEnd terminates the range coder in sentinal mode and returns
+// the coded bytes. The length of the returned buffer is the position
+// a Coder will report, less one, after its own SentinalEnd, which is
+// where any following data, such as Golomb-Rice codes, must start.
+//
+// See: 3.8.1.1.1. Termination
+//        * Sentinal Mode
+func (c *Encoder) SentinalEnd() []byte {
+	state := uint8(129)
+	c.put(&state, false)
+	return c.terminate()
+}
+
+// Flushes the range coder.
+func (c *Encoder) terminate() []byte {
+	c.rng = 0xFF
+	c.low += 0xFF
+	c.renorm()
+	c.rng = 0xFF
+	c.renorm()
+
+	return c.buf
+}
@@ -0,0 +1,117 @@
+package rangecoder
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newState() []uint8 {
+	state := make([]uint8, 32)
+	for i := range state {
+		state[i] = 128
+	}
+	return state
+}
+
+// A state transition table which differs from the default one in most
+// of its entries, as a coder_type 2 stream's may.
+func customTable() [256]uint8 {
+	table := DefaultStateTransition
+	for i := 1; i < 255; i++ {
+		v := int(table[i]) + i%5 - 2
+		if v < 1 {
+			v = 1
+		} else if v > 254 {
+			v = 254
+		}
+		table[i] = uint8(v)
+	}
+	return table
+}
+
+// Symbols put with an Encoder must read back the same from a Coder, and
+// after both ends' SentinalEnd, the Coder's position must be where the
+// Golomb-Rice coded data after them starts, as decodeSlice expects.
+func TestEncoderSymmetry(t *testing.T) {
+	type symbol struct {
+		kind byte // 'u', 's' or 'b'
+		v    int32
+	}
+	mixed := []symbol{{'b', 1}, {'u', 0}, {'s', -1}, {'u', 255}, {'s', 1 << 20}, {'b', 0}, {'s', -(1 << 30)}, {'u', 1<<31 - 1}}
+	var zeroes, large []symbol
+	for i := 0; i < 500; i++ {
+		zeroes = append(zeroes, symbol{'u', 0})
+		large = append(large, symbol{'s', int32(i*i*i) ^ -int32(i%2)}, symbol{'b', int32(i % 3 & 1)})
+	}
+
+	tables := []struct {
+		name  string
+		table [256]uint8
+	}{
+		{"default", DefaultStateTransition},
+		{"custom", customTable()},
+	}
+	tests := []struct {
+		name    string
+		symbols []symbol
+	}{
+		{"empty", nil},
+		{"mixed", mixed},
+		{"zeroes", zeroes},
+		{"large", large},
+	}
+	// Stands in for the Golomb-Rice coded data.
+	golomb := []byte{0xA5, 0x00, 0xFF, 0x5A}
+
+	for _, table := range tables {
+		for _, test := range tests {
+			name := table.name + " " + test.name
+
+			e := NewEncoder()
+			e.SetTable(table.table)
+			state := newState()
+			for _, s := range test.symbols {
+				switch s.kind {
+				case 'u':
+					e.PutUR(state, uint32(s.v))
+				case 's':
+					e.PutSR(state, s.v)
+				default:
+					e.PutBR(state, s.v != 0)
+				}
+			}
+			coded := e.SentinalEnd()
+			buf := append(append([]byte(nil), coded...), golomb...)
+
+			c := NewCoder(buf)
+			c.SetTable(table.table)
+			state = newState()
+			for i, s := range test.symbols {
+				var got int32
+				switch s.kind {
+				case 'u':
+					got = int32(c.UR(state))
+				case 's':
+					got = c.SR(state)
+				default:
+					if c.BR(state) {
+						got = 1
+					}
+				}
+				if got != s.v {
+					t.Fatalf("%s: symbol %d is %d, not %d", name, i, got, s.v)
+				}
+			}
+			c.SentinalEnd()
+			if c.Err() != nil {
+				t.Fatalf("%s: unexpected error: %s", name, c.Err().Error())
+			}
+
+			if pos := c.GetPos() - 1; pos != len(coded) {
+				t.Errorf("%s: Golomb-Rice data at %d, not %d", name, pos, len(coded))
+			} else if !bytes.Equal(buf[pos:], golomb) {
+				t.Errorf("%s: data after the range coder is %x", name, buf[pos:])
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package rangecoder
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Seeds symbols which exercise each part of the symbol coding: zero,
+// every exponent, and both signs.
+func fuzzSeedSymbols() []byte {
+	var buf []byte
+	for e := uint(0); e < 32; e++ {
+		var v [4]byte
+		binary.LittleEndian.PutUint32(v[:], uint32(1)<<e|1)
+		buf = append(buf, v[:]...)
+		binary.LittleEndian.PutUint32(v[:], -(uint32(1) << e))
+		buf = append(buf, v[:]...)
+	}
+	return append(buf, 0, 0, 0, 0)
+}
+
+// FuzzCoder decodes symbols from arbitrary data, which must not panic
+// or hang, and checks that symbols encoded from it decode back the same,
+// even with other data after them.
+func FuzzCoder(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00, 0x00})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add(fuzzSeedSymbols())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Decoding arbitrary data must be safe. Past the end of the
+		// buffer, the coder is fed zeroes, so cap the symbol count.
+		c := NewCoder(data)
+		state := newState()
+		for i := 0; i < 2*len(data)+2 && c.Err() == nil; i++ {
+			switch i % 3 {
+			case 0:
+				c.UR(state)
+			case 1:
+				c.SR(state)
+			default:
+				c.BR(state)
+			}
+		}
+		c.GetPos()
+
+		// Round trip, with every symbol type.
+		var values []int32
+		for len(data) >= 4 {
+			values = append(values, int32(binary.LittleEndian.Uint32(data)))
+			data = data[4:]
+		}
+
+		e := NewEncoder()
+		state = newState()
+		for i, v := range values {
+			switch i % 3 {
+			case 0:
+				e.PutUR(state, uint32(v))
+			case 1:
+				e.PutSR(state, v)
+			default:
+				e.PutBR(state, v&1 != 0)
+			}
+		}
+		// Whatever follows the coded data, such as the configuration
+		// record's CRC, must not change how it decodes.
+		buf := append(e.Finish(), 0xFF, 0xFF, 0xFF, 0xFF)
+
+		c = NewCoder(buf)
+		state = newState()
+		for i, v := range values {
+			var got int32
+			switch i % 3 {
+			case 0:
+				got = int32(c.UR(state))
+			case 1:
+				got = c.SR(state)
+			default:
+				got = 0
+				if c.BR(state) {
+					got = 1
+				}
+				v &= 1
+			}
+			if got != v {
+				t.Fatalf("symbol %d: got %d, want %d", i, got, v)
+			}
+		}
+		if c.Err() != nil {
+			t.Fatalf("unexpected error: %s", c.Err().Error())
+		}
+	})
+}
@@ -5,6 +5,10 @@ package rangecoder
 // Cross-references are to
 // https://tools.ietf.org/id/draft-ietf-cellar-ffv1-17
 
+import (
+	"fmt"
+)
+
 // Coder is an instance of a range coder, as defined in:
 //     Martin, G. Nigel N., "Range encoding: an algorithm for
 //     removing redundancy from a digitised message.", July 1979.
@@ -16,6 +20,7 @@ type Coder struct {
 	cur_byte   int32
 	zero_state [256]uint8
 	one_state  [256]uint8
+	err        error
 }
 
 // NewCoder creates a new range coder instance.
@@ -28,6 +33,13 @@ func NewCoder(buf []byte) *Coder {
 	// Figure 15.
 	ret.pos = 2
 	// Figure 14.
+	if len(buf) < 2 {
+		// Reading past the end gives zeroes, as in refill, and the
+		// encoder can legitimately leave off trailing zeroes.
+		var padded [2]byte
+		copy(padded[:], buf)
+		buf = padded[:]
+	}
 	ret.low = uint16(buf[0])<<8 | uint16(buf[1])
 	// Figure 13.
 	ret.rng = 0xFF00
@@ -107,7 +119,10 @@ func (c *Coder) symbol(state []uint8, signed bool) int32 {
 	for c.get(&state[1+min32(e, 9)]) {
 		e++
 		if e > 31 {
-			panic("WTF range coder!")
+			if c.err == nil {
+				c.err = fmt.Errorf("invalid range coded symbol: exponent too large")
+			}
+			return 0
 		}
 	}
 
@@ -148,6 +163,13 @@ func (c *Coder) SentinalEnd() {
 	c.get(&state)
 }
 
+// Err returns the first error hit while decoding, if any, such as a
+// symbol that cannot be valid.
+// Symbols read after an error are garbage, but reading them is safe.
+func (c *Coder) Err() error {
+	return c.err
+}
+
 // GetPos gets the current position in the bitstream.
 func (c *Coder) GetPos() int {
 	if c.rng < 0x100 {
@@ -26,19 +26,17 @@ type configRecord struct {
 	initial_state_delta     [][][]int16
 	ec                      uint8
 	intra                   uint8
+	flt                     bool
 }
 
 // Parses the configuration record from the codec private data.
 //
+// If 'max_context_count' is non-zero, quantization table sets with more
+// contexts than it are refused before their states are allocated.
+//
 // See: * 4.1. Parameters
 //      * 4.2. Configuration Record
-func parseConfigRecord(buf []byte, record *configRecord) error {
-	// Before we do anything, CRC check.
-	//
-	// See: 4.2.2. configuration_record_crc_parity
-	if crc32MPEG2(buf) != 0 {
-		return fmt.Errorf("failed CRC check for configuration record")
-	}
+func parseConfigRecord(buf []byte, record *configRecord, max_context_count int) error {
 	c := rangecoder.NewCoder(buf)
 
 	// 4. Bitstream
@@ -49,16 +47,158 @@ func parseConfigRecord(buf []byte, record *configRecord) error {
 
 	// 4.1.1. version
 	record.version = uint8(c.UR(state))
-	if record.version != 3 {
-		return fmt.Errorf("only FFV1 version 3 is supported")
+	if record.version < 2 {
+		return fmt.Errorf("FFV1 version %d has no configuration record", record.version)
+	} else if record.version > 4 {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, record.version)
 	}
 
-	// 4.1.2. micro_version
-	record.micro_version = uint8(c.UR(state))
-	if record.micro_version < 1 {
-		return fmt.Errorf("only FFV1 micro version >1 supported")
+	// Version 2 records have no micro_version, CRC, ec, or intra.
+	if record.version >= 3 {
+		// Before we do anything else, CRC check.
+		//
+		// See: 4.2.2. configuration_record_crc_parity
+		if crc32MPEG2(buf) != 0 {
+			return ErrRecordCRC
+		}
+
+		// 4.1.2. micro_version
+		record.micro_version = uint8(c.UR(state))
+		if record.micro_version < 1 {
+			return fmt.Errorf("%w: micro_version %d", ErrUnsupportedVersion, record.micro_version)
+		}
+	}
+
+	err := parseParameters(c, state, record)
+	if err != nil {
+		return err
+	}
+
+	// 4.1.11. num_h_slices
+	record.num_h_slices_minus1 = uint8(c.UR(state))
+	// 4.1.12. num_v_slices
+	record.num_v_slices_minus1 = uint8(c.UR(state))
+
+	// 4.1.13. quant_table_set_count
+	record.quant_table_set_count = uint8(c.UR(state))
+	if record.quant_table_set_count == 0 {
+		return fmt.Errorf("quant_table_set_count may not be zero")
+	} else if record.quant_table_set_count > maxQuantTables {
+		return fmt.Errorf("too many quant tables: %d > %d", record.quant_table_set_count, maxQuantTables)
+	}
+
+	for i := 0; i < int(record.quant_table_set_count); i++ {
+		err := parseQuantTableSet(c, record, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkContextCounts(record, max_context_count)
+	if err != nil {
+		return err
+	}
+
+	// Why on earth did they choose to do a variable length buffer in the
+	// *middle and start* of a 3D array?
+	allocateInitialStateDelta(record)
+	delta_states := newDeltaStates()
+	for i := 0; i < int(record.quant_table_set_count); i++ {
+		states_coded := c.BR(state)
+		if states_coded {
+			for j := 0; j < int(record.context_count[i]); j++ {
+				for k := 0; k < contextSize; k++ {
+					record.initial_state_delta[i][j][k] = int16(c.SR(delta_states[k]))
+				}
+			}
+		}
+	}
+
+	if record.version >= 3 {
+		// 4.1.16. ec
+		record.ec = uint8(c.UR(state))
+		// 4.1.17. intra
+		record.intra = uint8(c.UR(state))
+	}
+
+	// Float samples, coded as remapped integers.
+	if hasRemap(record) {
+		record.flt = c.UR(state) != 0
+		if record.flt && (record.colorspace_type != 1 || record.bits_per_raw_sample != 16) {
+			return fmt.Errorf("float samples are only supported for 16-bit RGB")
+		}
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	return nil
+}
+
+// Whether or not the record has the float flag, and slice headers have
+// the sample remapping mode, which was added in version 4.4.
+func hasRemap(record *configRecord) bool {
+	return record.version > 4 || (record.version == 4 && record.micro_version >= 4)
+}
+
+// Parses the in-band parameters at the start of a version 0 or 1
+// keyframe, which take the place of the configuration record.
+//
+// Versions 0 and 1 always use a single slice covering the whole
+// frame, and a single quantization table set for all planes.
+//
+// See: * 4.1. Parameters
+//      * 4.3. Frame
+func parseKeyframeHeader(c *rangecoder.Coder, record *configRecord, max_context_count int) error {
+	// 4. Bitstream
+	state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		state[i] = 128
+	}
+
+	// 4.1.1. version
+	record.version = uint8(c.UR(state))
+	if record.version > 1 {
+		return fmt.Errorf("invalid in-band version: %d", record.version)
+	}
+	record.micro_version = 0
+
+	err := parseParameters(c, state, record)
+	if err != nil {
+		return err
 	}
 
+	record.num_h_slices_minus1 = 0
+	record.num_v_slices_minus1 = 0
+	record.quant_table_set_count = 1
+	err = parseQuantTableSet(c, record, 0)
+	if err != nil {
+		return err
+	}
+	err = checkContextCounts(record, max_context_count)
+	if err != nil {
+		return err
+	}
+
+	// There are no coded initial states.
+	allocateInitialStateDelta(record)
+
+	record.ec = 0
+	record.intra = 0
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	return nil
+}
+
+// Parses the parameters common to the configuration record and the
+// version 0 and 1 keyframe header, from coder_type to extra_plane.
+//
+// See: 4.1. Parameters
+func parseParameters(c *rangecoder.Coder, state []uint8, record *configRecord) error {
 	// 4.1.3. coder_type
 	record.coder_type = uint8(c.UR(state))
 	if record.coder_type > 2 {
@@ -66,6 +206,9 @@ func parseConfigRecord(buf []byte, record *configRecord) error {
 	}
 
 	// 4.1.4. state_transition_delta
+	for i := 1; i < 256; i++ {
+		record.state_transition_delta[i] = 0
+	}
 	if record.coder_type > 1 {
 		for i := 1; i < 256; i++ {
 			record.state_transition_delta[i] = int16(c.SR(state))
@@ -79,10 +222,18 @@ func parseConfigRecord(buf []byte, record *configRecord) error {
 	}
 
 	// 4.1.7. bits_per_raw_sample
-	record.bits_per_raw_sample = uint8(c.UR(state))
+	//
+	// Version 0 does not code it at all.
+	record.bits_per_raw_sample = 0
+	if record.version > 0 {
+		record.bits_per_raw_sample = uint8(c.UR(state))
+	}
 	if record.bits_per_raw_sample == 0 {
 		record.bits_per_raw_sample = 8
 	}
+	if record.bits_per_raw_sample > 16 {
+		return fmt.Errorf("unsupported bits_per_raw_sample: %d", record.bits_per_raw_sample)
+	}
 	if record.coder_type == 0 && record.bits_per_raw_sample != 8 {
 		return fmt.Errorf("golomb-rice mode cannot have >8bit per sample")
 	}
@@ -97,102 +248,251 @@ func parseConfigRecord(buf []byte, record *configRecord) error {
 	record.log2_h_chroma_subsample = uint8(c.UR(state))
 	if record.colorspace_type == 1 && record.log2_h_chroma_subsample != 0 {
 		return fmt.Errorf("RGB cannot be subsampled")
+	} else if record.log2_h_chroma_subsample > maxChromaSubsample {
+		return fmt.Errorf("unsupported log2_h_chroma_subsample: %d", record.log2_h_chroma_subsample)
 	}
 
 	// 4.1.9. log2_v_chroma_subsample
 	record.log2_v_chroma_subsample = uint8(c.UR(state))
 	if record.colorspace_type == 1 && record.log2_v_chroma_subsample != 0 {
 		return fmt.Errorf("RGB cannot be subsampled")
+	} else if record.log2_v_chroma_subsample > maxChromaSubsample {
+		return fmt.Errorf("unsupported log2_v_chroma_subsample: %d", record.log2_v_chroma_subsample)
 	}
 
 	// 4.1.10. extra_plane
 	record.extra_plane = c.BR(state)
+
+	return nil
+}
+
+// Parses quantization table set i and derives its context count.
+//
+// See: 4.9.  Quantization Table Set
+func parseQuantTableSet(c *rangecoder.Coder, record *configRecord, i int) error {
+	scale := 1
+	for j := 0; j < maxContextInputs; j++ {
+		// Each table has its own state table.
+		quant_state := make([]byte, contextSize)
+		for qs := 0; qs < contextSize; qs++ {
+			quant_state[qs] = 128
+		}
+		v := 0
+		for k := 0; k < 128; {
+			len_minus1 := c.UR(quant_state)
+			if len_minus1 >= uint32(128-k) {
+				return fmt.Errorf("quant table %d of set %d overruns its half", j, i)
+			}
+			for a := 0; a < int(len_minus1+1); a++ {
+				record.quant_tables[i][j][k] = int16(scale * v)
+				k++
+			}
+			v++
+		}
+		for k := 1; k < 128; k++ {
+			record.quant_tables[i][j][256-k] = -record.quant_tables[i][j][k]
+		}
+		record.quant_tables[i][j][128] = -record.quant_tables[i][j][127]
+		scale *= 2*v - 1
+		if (scale+1)/2 > maxContextCount {
+			return fmt.Errorf("too many contexts in quant table set %d", i)
+		}
+	}
+	record.context_count[i] = int32((scale + 1) / 2)
+
+	return nil
+}
+
+// Checks the context count of each quantization table set against the
+// decoder's limit, if any.
+func checkContextCounts(record *configRecord, max_context_count int) error {
+	if max_context_count == 0 {
+		return nil
+	}
+	for i := 0; i < int(record.quant_table_set_count); i++ {
+		if int(record.context_count[i]) > max_context_count {
+			return fmt.Errorf("%w: quant table set %d has %d contexts, more than %d", ErrLimitExceeded, i, record.context_count[i], max_context_count)
+		}
+	}
+	return nil
+}
+
+// Makes the states initial_state_delta is coded with. Each of the
+// contextSize positions has its own, shared by every context of every
+// quantization table set, as FFmpeg does.
+//
+// See: 4.1.15. initial_state_delta
+func newDeltaStates() [][]uint8 {
+	ret := make([][]uint8, contextSize)
+	for k := range ret {
+		ret[k] = make([]uint8, contextSize)
+		for i := range ret[k] {
+			ret[k][i] = 128
+		}
+	}
+	return ret
+}
+
+// Allocates a zeroed initial_state_delta for every quantization table set.
+func allocateInitialStateDelta(record *configRecord) {
+	record.initial_state_delta = make([][][]int16, int(record.quant_table_set_count))
+	for i := 0; i < int(record.quant_table_set_count); i++ {
+		record.initial_state_delta[i] = make([][]int16, int(record.context_count[i]))
+		for j := 0; j < int(record.context_count[i]); j++ {
+			record.initial_state_delta[i][j] = make([]int16, contextSize)
+		}
+	}
+}
+
+// Initializes initial state for the range coder.
+//
+// See: 4.1.15. initial_state_delta
+func (d *Decoder) initializeStates() {
+	d.state_transition, d.initial_states = initialStates(&d.record)
+}
+
+// Derives the state transition table and initial context states
+// from a configuration record.
+//
+// See: * 4.1.4. state_transition_delta
+//      * 4.1.15. initial_state_delta
+func initialStates(record *configRecord) ([256]uint8, [][][]uint8) {
+	var state_transition [256]uint8
+	for i := 1; i < 256; i++ {
+		state_transition[i] = uint8(int16(rangecoder.DefaultStateTransition[i]) + record.state_transition_delta[i])
+	}
+
+	initial_states := make([][][]uint8, len(record.initial_state_delta))
+	for i := 0; i < len(record.initial_state_delta); i++ {
+		initial_states[i] = make([][]uint8, len(record.initial_state_delta[i]))
+		for j := 0; j < len(record.initial_state_delta[i]); j++ {
+			initial_states[i][j] = make([]uint8, len(record.initial_state_delta[i][j]))
+			for k := 0; k < len(record.initial_state_delta[i][j]); k++ {
+				pred := int16(128)
+				if j != 0 {
+					pred = int16(initial_states[i][j-1][k])
+				}
+				initial_states[i][j][k] = uint8((pred + record.initial_state_delta[i][j][k]) & 255)
+			}
+		}
+	}
+
+	return state_transition, initial_states
+}
+
+// Writes a configuration record in the same order parseConfigRecord
+// reads it, followed by its CRC parity.
+//
+// See: * 4.1. Parameters
+//      * 4.2. Configuration Record
+func writeConfigRecord(record *configRecord) []byte {
+	c := rangecoder.NewEncoder()
+
+	// 4. Bitstream
+	state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		state[i] = 128
+	}
+
+	// 4.1.1. version
+	c.PutUR(state, uint32(record.version))
+	// 4.1.2. micro_version
+	if record.version >= 3 {
+		c.PutUR(state, uint32(record.micro_version))
+	}
+	// 4.1.3. coder_type
+	c.PutUR(state, uint32(record.coder_type))
+
+	// 4.1.4. state_transition_delta
+	if record.coder_type > 1 {
+		for i := 1; i < 256; i++ {
+			c.PutSR(state, int32(record.state_transition_delta[i]))
+		}
+	}
+
+	// 4.1.5. colorspace_type
+	c.PutUR(state, uint32(record.colorspace_type))
+	// 4.1.7. bits_per_raw_sample
+	c.PutUR(state, uint32(record.bits_per_raw_sample))
+	// 4.1.6. chroma_planes
+	c.PutBR(state, record.chroma_planes)
+	// 4.1.8. log2_h_chroma_subsample
+	c.PutUR(state, uint32(record.log2_h_chroma_subsample))
+	// 4.1.9. log2_v_chroma_subsample
+	c.PutUR(state, uint32(record.log2_v_chroma_subsample))
+	// 4.1.10. extra_plane
+	c.PutBR(state, record.extra_plane)
 	// 4.1.11. num_h_slices
-	record.num_h_slices_minus1 = uint8(c.UR(state))
+	c.PutUR(state, uint32(record.num_h_slices_minus1))
 	// 4.1.12. num_v_slices
-	record.num_v_slices_minus1 = uint8(c.UR(state))
+	c.PutUR(state, uint32(record.num_v_slices_minus1))
 
 	// 4.1.13. quant_table_set_count
-	record.quant_table_set_count = uint8(c.UR(state))
-	if record.quant_table_set_count == 0 {
-		return fmt.Errorf("quant_table_set_count may not be zero")
-	} else if record.quant_table_set_count > maxQuantTables {
-		return fmt.Errorf("too many quant tables: %d > %d", record.quant_table_set_count, maxQuantTables)
-	}
+	c.PutUR(state, uint32(record.quant_table_set_count))
 
 	for i := 0; i < int(record.quant_table_set_count); i++ {
 		// 4.9.  Quantization Table Set
-		scale := 1
+		//
+		// Each table is coded as the run lengths of its (non-negative)
+		// first half.
 		for j := 0; j < maxContextInputs; j++ {
-			// Each table has its own state table.
 			quant_state := make([]byte, contextSize)
 			for qs := 0; qs < contextSize; qs++ {
 				quant_state[qs] = 128
 			}
-			v := 0
 			for k := 0; k < 128; {
-				len_minus1 := c.UR(quant_state)
-				for a := 0; a < int(len_minus1+1); a++ {
-					record.quant_tables[i][j][k] = int16(scale * v)
-					k++
+				len_minus1 := 0
+				for k+len_minus1+1 < 128 && record.quant_tables[i][j][k+len_minus1+1] == record.quant_tables[i][j][k] {
+					len_minus1++
 				}
-				v++
+				c.PutUR(quant_state, uint32(len_minus1))
+				k += len_minus1 + 1
 			}
-			for k := 1; k < 128; k++ {
-				record.quant_tables[i][j][256-k] = -record.quant_tables[i][j][k]
-			}
-			record.quant_tables[i][j][128] = -record.quant_tables[i][j][127]
-			scale *= 2*v - 1
 		}
-		record.context_count[i] = int32((scale + 1) / 2)
 	}
 
-	// Why on earth did they choose to do a variable length buffer in the
-	// *middle and start* of a 3D array?
-	record.initial_state_delta = make([][][]int16, int(record.quant_table_set_count))
+	delta_states := newDeltaStates()
 	for i := 0; i < int(record.quant_table_set_count); i++ {
-		record.initial_state_delta[i] = make([][]int16, int(record.context_count[i]))
-		for j := 0; j < int(record.context_count[i]); j++ {
-			record.initial_state_delta[i][j] = make([]int16, contextSize)
+		states_coded := false
+		if i < len(record.initial_state_delta) {
+			for j := 0; j < len(record.initial_state_delta[i]) && !states_coded; j++ {
+				for k := 0; k < len(record.initial_state_delta[i][j]); k++ {
+					if record.initial_state_delta[i][j][k] != 0 {
+						states_coded = true
+						break
+					}
+				}
+			}
 		}
-		states_coded := c.BR(state)
+		c.PutBR(state, states_coded)
 		if states_coded {
 			for j := 0; j < int(record.context_count[i]); j++ {
 				for k := 0; k < contextSize; k++ {
-					record.initial_state_delta[i][j][k] = int16(c.SR(state))
+					c.PutSR(delta_states[k], int32(record.initial_state_delta[i][j][k]))
 				}
 			}
 		}
 	}
 
+	if record.version < 3 {
+		return c.Finish()
+	}
+
 	// 4.1.16. ec
-	record.ec = uint8(c.UR(state))
+	c.PutUR(state, uint32(record.ec))
 	// 4.1.17. intra
-	record.intra = uint8(c.UR(state))
-
-	return nil
-}
+	c.PutUR(state, uint32(record.intra))
 
-// Initializes initial state for the range coder.
-//
-// See: 4.1.15. initial_state_delta
-func (d *Decoder) initializeStates() {
-	for i := 1; i < 256; i++ {
-		d.state_transition[i] = uint8(int16(rangecoder.DefaultStateTransition[i]) + d.record.state_transition_delta[i])
-	}
-
-	d.initial_states = make([][][]uint8, len(d.record.initial_state_delta))
-	for i := 0; i < len(d.record.initial_state_delta); i++ {
-		d.initial_states[i] = make([][]uint8, len(d.record.initial_state_delta[i]))
-		for j := 0; j < len(d.record.initial_state_delta[i]); j++ {
-			d.initial_states[i][j] = make([]uint8, len(d.record.initial_state_delta[i][j]))
-			for k := 0; k < len(d.record.initial_state_delta[i][j]); k++ {
-				pred := int16(128)
-				if j != 0 {
-					pred = int16(d.initial_states[i][j-1][k])
-				}
-				d.initial_states[i][j][k] = uint8((pred + d.record.initial_state_delta[i][j][k]) & 255)
-			}
+	if hasRemap(record) {
+		flt := uint32(0)
+		if record.flt {
+			flt = 1
 		}
+		c.PutUR(state, flt)
 	}
+
+	buf := c.Finish()
+
+	// 4.2.2. configuration_record_crc_parity
+	return appendCRCParity(buf)
 }
@@ -0,0 +1,330 @@
+package ffv1
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// A quantization table set with three levels in its first table, and
+// so two contexts.
+func testQuantTables() [maxContextInputs][256]int16 {
+	var tables [maxContextInputs][256]int16
+	for k := 1; k < 128; k++ {
+		tables[0][k] = 1
+		tables[0][256-k] = -1
+	}
+	tables[0][128] = -1
+	return tables
+}
+
+// Codes a version 3 configuration record with the quantization table
+// set above and the given initial state deltas, the way FFmpeg's
+// write_extradata does: each of the contextSize positions has its own
+// states, which are not reset between contexts.
+func referenceRecord(deltas [][]int16) []byte {
+	c := rangecoder.NewEncoder()
+	state := make([]uint8, contextSize)
+	for i := range state {
+		state[i] = 128
+	}
+
+	c.PutUR(state, 3) // version
+	c.PutUR(state, 4) // micro_version
+	c.PutUR(state, 1) // coder_type
+	c.PutUR(state, 0) // colorspace_type
+	c.PutUR(state, 8) // bits_per_raw_sample
+	c.PutBR(state, true)
+	c.PutUR(state, 1) // log2_h_chroma_subsample
+	c.PutUR(state, 1) // log2_v_chroma_subsample
+	c.PutBR(state, false)
+	c.PutUR(state, 0) // num_h_slices - 1
+	c.PutUR(state, 0) // num_v_slices - 1
+	c.PutUR(state, 1) // quant_table_set_count
+
+	for j := 0; j < maxContextInputs; j++ {
+		quant_state := make([]uint8, contextSize)
+		for i := range quant_state {
+			quant_state[i] = 128
+		}
+		if j == 0 {
+			c.PutUR(quant_state, 0)
+			c.PutUR(quant_state, 126)
+		} else {
+			c.PutUR(quant_state, 127)
+		}
+	}
+
+	var state2 [contextSize][contextSize]uint8
+	for k := range state2 {
+		for i := range state2[k] {
+			state2[k][i] = 128
+		}
+	}
+	c.PutBR(state, true)
+	for j := range deltas {
+		for k := range deltas[j] {
+			c.PutSR(state2[k][:], int32(deltas[j][k]))
+		}
+	}
+
+	c.PutUR(state, 0) // ec
+	c.PutUR(state, 1) // intra
+
+	return appendCRCParity(c.Finish())
+}
+
+func TestInitialStateDelta(t *testing.T) {
+	deltas := make([][]int16, 2)
+	for j := range deltas {
+		deltas[j] = make([]int16, contextSize)
+		for k := range deltas[j] {
+			deltas[j][k] = int16((k*7+j*13)%41 - 20)
+		}
+	}
+
+	r, err := ParseConfigRecord(referenceRecord(deltas))
+	if err != nil {
+		t.Fatalf("couldn't parse record: %s", err.Error())
+	}
+	if len(r.ContextCount) != 1 || r.ContextCount[0] != 2 {
+		t.Fatalf("context counts are %v, not [2]", r.ContextCount)
+	}
+	if !reflect.DeepEqual(r.InitialStateDelta, [][][]int16{deltas}) {
+		t.Fatalf("initial state deltas are %v, not %v", r.InitialStateDelta, deltas)
+	}
+
+	// Each context is predicted from the one before it.
+	states := r.InitialStates()
+	for k := 0; k < contextSize; k++ {
+		want0 := uint8(128 + deltas[0][k])
+		want1 := uint8(int16(want0) + deltas[1][k])
+		if states[0][0][k] != want0 || states[0][1][k] != want1 {
+			t.Fatalf("initial states at %d are %d, %d, not %d, %d", k, states[0][0][k], states[0][1][k], want0, want1)
+		}
+	}
+
+	buf, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatalf("couldn't marshal record: %s", err.Error())
+	}
+	r2, err := ParseConfigRecord(buf)
+	if err != nil {
+		t.Fatalf("couldn't parse marshalled record: %s", err.Error())
+	}
+	if !reflect.DeepEqual(r, r2) {
+		t.Fatalf("marshalled record parses to %+v, not %+v", r2, r)
+	}
+}
+
+func TestMarshalBinaryErrors(t *testing.T) {
+	valid := func() *ConfigRecord {
+		return &ConfigRecord{
+			Version:          3,
+			MicroVersion:     4,
+			CoderType:        1,
+			BitsPerRawSample: 8,
+			NumHSlices:       1,
+			NumVSlices:       1,
+			QuantTables:      [][maxContextInputs][256]int16{testQuantTables()},
+			ContextCount:     []int32{2},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *ConfigRecord)
+		err    string
+	}{
+		{"valid", func(r *ConfigRecord) {}, ""},
+		{"custom table", func(r *ConfigRecord) {
+			r.CoderType = 2
+			r.StateTransitionDelta[10] = 3
+		}, ""},
+		{"table without coder_type 2", func(r *ConfigRecord) {
+			r.StateTransitionDelta[10] = 3
+		}, "state_transition_delta requires coder_type 2"},
+		{"float before 4.4", func(r *ConfigRecord) {
+			r.ColorSpace = RGB
+			r.ChromaPlanes = true
+			r.BitsPerRawSample = 16
+			r.Float = true
+		}, "float samples require version 4.4"},
+		{"float in 4.4", func(r *ConfigRecord) {
+			r.Version = 4
+			r.ColorSpace = RGB
+			r.ChromaPlanes = true
+			r.BitsPerRawSample = 16
+			r.Float = true
+		}, ""},
+		{"context count", func(r *ConfigRecord) {
+			r.ContextCount[0] = 3
+		}, "context count 3 does not match"},
+		{"micro_version", func(r *ConfigRecord) {
+			r.MicroVersion = 0
+		}, "micro_version 0"},
+	}
+
+	for _, test := range tests {
+		r := valid()
+		test.modify(r)
+		buf, err := r.MarshalBinary()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+				continue
+			}
+			r2, err := ParseConfigRecord(buf)
+			if err != nil {
+				t.Errorf("%s: couldn't parse marshalled record: %s", test.name, err.Error())
+			} else if r2.Float != r.Float || r2.StateTransitionDelta != r.StateTransitionDelta {
+				t.Errorf("%s: marshalled record parses differently", test.name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+
+	r := valid()
+	r.MicroVersion = 0
+	_, err := r.MarshalBinary()
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("got error %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+// A decoder's Config must match the record it was created with, as
+// ParseConfigRecord reads it, and the states the decoder uses.
+func TestDecoderConfig(t *testing.T) {
+	var transition [256]uint8
+	for i := range transition {
+		transition[i] = rangecoder.DefaultStateTransition[i]
+	}
+	transition[30] += 2
+
+	deltas := make([][]int16, 2)
+	for j := range deltas {
+		deltas[j] = make([]int16, contextSize)
+		for k := range deltas[j] {
+			deltas[j][k] = int16((k*5+j*3)%23 - 11)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		opts   EncoderOptions
+		record []byte
+	}{
+		{"default", EncoderOptions{Width: 32, Height: 16, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}, nil},
+		{"inter with alpha", EncoderOptions{Width: 32, Height: 16, HasChroma: true, HasAlpha: true, SlicesH: 2, SlicesV: 2, GOPSize: 10}, nil},
+		{"ec and custom transitions", EncoderOptions{Width: 32, Height: 16, EC: true, StateTransition: &transition}, nil},
+		{"golomb", EncoderOptions{Width: 32, Height: 16, HasChroma: true, GolombRice: true, EC: true, SlicesH: 4}, nil},
+		{"initial states", EncoderOptions{Width: 32, Height: 16}, referenceRecord(deltas)},
+	}
+
+	for _, test := range tests {
+		record := test.record
+		if record == nil {
+			e, err := NewEncoder(test.opts)
+			if err != nil {
+				t.Fatalf("%s: couldn't create encoder: %s", test.name, err.Error())
+			}
+			record = e.Record()
+		}
+
+		want, err := ParseConfigRecord(record)
+		if err != nil {
+			t.Fatalf("%s: couldn't parse record: %s", test.name, err.Error())
+		}
+		d, err := NewDecoder(record, test.opts.Width, test.opts.Height)
+		if err != nil {
+			t.Fatalf("%s: couldn't create decoder: %s", test.name, err.Error())
+		}
+		got := d.Config()
+		if got == nil {
+			t.Fatalf("%s: no config", test.name)
+		}
+
+		if !reflect.DeepEqual(got.QuantTables, want.QuantTables) {
+			t.Errorf("%s: quant tables differ", test.name)
+		}
+		if !reflect.DeepEqual(got.ContextCount, want.ContextCount) {
+			t.Errorf("%s: context counts are %v, not %v", test.name, got.ContextCount, want.ContextCount)
+		}
+		if !reflect.DeepEqual(got.InitialStates(), d.initial_states) || !reflect.DeepEqual(want.InitialStates(), d.initial_states) {
+			t.Errorf("%s: initial states differ from the decoder's", test.name)
+		}
+		if got.EC != want.EC || got.Intra != want.Intra {
+			t.Errorf("%s: ec %d and intra %d, not %d and %d", test.name, got.EC, got.Intra, want.EC, want.Intra)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: config is %+v, not %+v", test.name, got, want)
+		}
+
+		// It is a copy.
+		got.QuantTables[0][0][1]++
+		got.InitialStateDelta[0][0][0]++
+		if again := d.Config(); !reflect.DeepEqual(again, want) {
+			t.Errorf("%s: config changed with the copy returned", test.name)
+		}
+	}
+}
+
+// Versions 0 and 1 have their parameters in keyframes, which Probe
+// reads, and Config only has them once one is decoded.
+func TestProbe(t *testing.T) {
+	opts := EncoderOptions{Width: 24, Height: 16, HasChroma: true, HasAlpha: true, ChromaSubsampleH: 1}
+	packets := encodeLegacy(t, opts, 1, 2)
+
+	r, err := Probe(nil, packets[0])
+	if err != nil {
+		t.Fatalf("couldn't probe: %s", err.Error())
+	}
+	if r.Version != 1 || r.BitsPerRawSample != 8 || !r.ChromaPlanes || !r.ExtraPlane || r.Log2HChromaSubsample != 1 || r.Log2VChromaSubsample != 0 {
+		t.Errorf("probed %+v", r)
+	}
+	if r.NumHSlices != 1 || r.NumVSlices != 1 || len(r.QuantTables) != 1 || r.EC != 0 || r.Intra != 0 {
+		t.Errorf("probed %d by %d slices, %d quant table sets, ec %d and intra %d", r.NumHSlices, r.NumVSlices, len(r.QuantTables), r.EC, r.Intra)
+	}
+	_, err = Probe(nil, packets[1])
+	if err == nil {
+		t.Errorf("no error probing an inter frame")
+	}
+
+	d, err := NewDecoder(nil, opts.Width, opts.Height)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+	if d.Config() != nil {
+		t.Fatalf("config before the first keyframe")
+	}
+	_, err = d.DecodeFrame(packets[0])
+	if err != nil {
+		t.Fatalf("couldn't decode: %s", err.Error())
+	}
+	if c := d.Config(); !reflect.DeepEqual(c, r) {
+		t.Errorf("config is %+v, not the probed %+v", c, r)
+	}
+
+	// With a configuration record, it is what ParseConfigRecord reads.
+	e, err := NewEncoder(opts)
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+	r, err = Probe(e.Record(), nil)
+	if err != nil {
+		t.Fatalf("couldn't probe: %s", err.Error())
+	}
+	want, err := ParseConfigRecord(e.Record())
+	if err != nil {
+		t.Fatalf("couldn't parse record: %s", err.Error())
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("probed %+v, not %+v", r, want)
+	}
+}
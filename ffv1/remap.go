@@ -0,0 +1,135 @@
+package ffv1
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// Parses the per-plane sample remapping tables of a slice.
+//
+// Each table lists which of the 65536 possible 16-bit float values are
+// used in the plane, as alternating runs of unused and used values,
+// starting with unused. A zero run switches to the other kind. The
+// coded sample values are the indexes of the used values, in order,
+// so the prediction works on a small, dense integer range.
+//
+// If remap is 2, positive values are ordered in reverse, so that the
+// order matches the value order.
+func parseRemap(c *rangecoder.Coder, record *configRecord, s *slice) error {
+	flip := 0
+	if s.header.remap == 2 {
+		flip = 0x7FFF
+	}
+
+	planes := 1
+	if record.chroma_planes {
+		planes += 2
+	}
+	if record.extra_plane {
+		planes++
+	}
+
+	s.fltmap = make([][]uint16, planes)
+	for p := 0; p < planes; p++ {
+		// 4. Bitstream
+		var state [2][]uint8
+		for lu := 0; lu < 2; lu++ {
+			state[lu] = make([]uint8, contextSize)
+			for i := 0; i < contextSize; i++ {
+				state[lu][i] = 128
+			}
+		}
+
+		fltmap := make([]uint16, 65536)
+		j := 0
+		lu := 0
+		for i := 0; i < 65536; i++ {
+			run := c.UR(state[lu])
+			if run > uint32(65536-i) {
+				return fmt.Errorf("invalid remap run: %d", run)
+			}
+
+			if lu == 1 {
+				// A run of used values, followed by an unused one.
+				for k := uint32(0); k < run; k++ {
+					fltmap[j] = uint16(i ^ remapFlip(i, flip))
+					j++
+					i++
+				}
+			} else {
+				// A run of unused values, followed by a used one.
+				i += int(run)
+				if i != 65536 {
+					fltmap[j] = uint16(i ^ remapFlip(i, flip))
+					j++
+				}
+			}
+
+			if run == 0 {
+				lu ^= 1
+			}
+		}
+
+		s.fltmap[p] = fltmap
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	return nil
+}
+
+// Negative values, which have the sign bit set, are never flipped.
+func remapFlip(i int, flip int) int {
+	if i&0x8000 != 0 {
+		return 0
+	}
+	return flip
+}
+
+// Maps the decoded samples of a slice back to 16-bit float values. A
+// slice without remapping tables codes the float values directly.
+func remapSlice(dst [][]uint16, src [][]uint16, fltmap [][]uint16, w int, h int, stride int, offset int) {
+	for p := 0; p < len(dst); p++ {
+		s := src[p][offset:]
+		d := dst[p][offset:]
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if fltmap != nil {
+					d[(y*stride)+x] = fltmap[p][s[(y*stride)+x]]
+				} else {
+					d[(y*stride)+x] = s[(y*stride)+x]
+				}
+			}
+		}
+	}
+}
+
+// Converts an IEEE 754 half-precision value to a float32.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1F
+	mant := uint32(h) & 0x3FF
+
+	switch {
+	case exp == 0x1F:
+		// Infinity or NaN
+		return math.Float32frombits(sign | 0x7F800000 | mant<<13)
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Subnormal, so normalize it.
+		shift := uint32(0)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			shift++
+		}
+		mant &= 0x3FF
+		return math.Float32frombits(sign | (113-shift)<<23 | mant<<13)
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+	}
+}
@@ -0,0 +1,217 @@
+package ffv1
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1/rangecoder"
+)
+
+// Half-precision values which must survive remapping and conversion
+// bit for bit, with their float32 bits.
+var halfValues = []struct {
+	name  string
+	half  uint16
+	float uint32
+}{
+	{"+0", 0x0000, 0x00000000},
+	{"-0", 0x8000, 0x80000000},
+	{"+Inf", 0x7C00, 0x7F800000},
+	{"-Inf", 0xFC00, 0xFF800000},
+	{"quiet NaN", 0x7E00, 0x7FC00000},
+	{"signalling NaN", 0x7C01, 0x7F802000},
+	{"negative NaN", 0xFE00, 0xFFC00000},
+	{"1", 0x3C00, 0x3F800000},
+	{"-2", 0xC000, 0xC0000000},
+	{"0.5", 0x3800, 0x3F000000},
+	{"largest", 0x7BFF, 0x477FE000},
+	{"smallest subnormal", 0x0001, 0x33800000},
+	{"largest subnormal", 0x03FF, 0x387FC000},
+	{"negative subnormal", 0x8200, 0xB8000000},
+}
+
+func TestHalfToFloat32(t *testing.T) {
+	for _, v := range halfValues {
+		if got := math.Float32bits(halfToFloat32(v.half)); got != v.float {
+			t.Errorf("%s: %#04x is %#08x, not %#08x", v.name, v.half, got, v.float)
+		}
+	}
+}
+
+// Makes the 16-bit float planes of frame n of a float test sequence.
+// Each plane holds all of halfValues, and a few hundred others, spread
+// over the slices, with some shared between planes.
+func floatTestPlanes(width int, height int, alpha bool, n int) [][]uint32 {
+	planes := 3
+	if alpha {
+		planes++
+	}
+
+	ret := make([][]uint32, planes)
+	for p := range ret {
+		ret[p] = make([]uint32, width*height)
+		for i := range ret[p] {
+			x, y := i%width, i/width
+			if (x+y)%3 == 0 {
+				ret[p][i] = uint32(halfValues[(i/3+p+n)%len(halfValues)].half)
+			} else {
+				ret[p][i] = uint32(x*397+y*1031+p*7919+n*13) & 0xFFFF
+			}
+		}
+	}
+	return ret
+}
+
+// Gives the position of a 16-bit float value in the order in which
+// remapping tables list them: by their bits, or with remap 2, from the
+// largest positive value down to the largest negative one.
+func remapOrder(v int, remap uint32) int {
+	if remap == 2 && v < 0x8000 {
+		return 0x7FFF - v
+	}
+	return v
+}
+
+// Codes the remapping tables of a slice, as parseRemap reads them, for
+// the float values it covers, and returns the planes with those values
+// replaced by their indexes in the tables.
+func (r *rgbStream) putRemap(c *rangecoder.Encoder, s *slice, planes [][]uint32) [][]uint32 {
+	ret := make([][]uint32, len(planes))
+	for p := range planes {
+		ret[p] = append([]uint32(nil), planes[p]...)
+
+		var used [65536]bool
+		for y := s.start_y; y < s.start_y+s.height; y++ {
+			for x := s.start_x; x < s.start_x+s.width; x++ {
+				v := int(planes[p][y*r.width+x])
+				used[remapOrder(v, s.header.remap)] = true
+			}
+		}
+
+		var state [2][]uint8
+		for lu := 0; lu < 2; lu++ {
+			state[lu] = make([]uint8, contextSize)
+			for i := range state[lu] {
+				state[lu][i] = 128
+			}
+		}
+
+		lu := 0
+		for i := 0; i < 65536; {
+			run := 0
+			for i+run < 65536 && used[i+run] == (lu == 1) {
+				run++
+			}
+			c.PutUR(state[lu], uint32(run))
+			// Runs of unused values are followed by a used one, and
+			// runs of used values by an unused one.
+			i += run + 1
+
+			if run == 0 {
+				lu ^= 1
+			}
+		}
+
+		var index [65536]uint32
+		j := uint32(0)
+		for i := range used {
+			if used[i] {
+				index[i] = j
+				j++
+			}
+		}
+		for y := s.start_y; y < s.start_y+s.height; y++ {
+			for x := s.start_x; x < s.start_x+s.width; x++ {
+				v := int(planes[p][y*r.width+x])
+				ret[p][y*r.width+x] = index[remapOrder(v, s.header.remap)]
+			}
+		}
+	}
+	return ret
+}
+
+// Remapping tables list the values used, in order.
+func TestParseRemap(t *testing.T) {
+	values := []uint32{0xC000, 0x0000, 0x7C00, 0x8000, 0x3C00, 0x0001, 0xFC00, 0xFFFF}
+	tests := []struct {
+		remap uint32
+		want  []uint16
+	}{
+		{1, []uint16{0x0000, 0x0001, 0x3C00, 0x7C00, 0x8000, 0xC000, 0xFC00, 0xFFFF}},
+		{2, []uint16{0x7C00, 0x3C00, 0x0001, 0x0000, 0x8000, 0xC000, 0xFC00, 0xFFFF}},
+	}
+
+	for _, test := range tests {
+		r := &rgbStream{width: uint32(len(values)), height: 1}
+		s := &slice{width: r.width, height: 1}
+		s.header.remap = test.remap
+		planes := [][]uint32{values, make([]uint32, len(values)), make([]uint32, len(values))}
+		for i := range values {
+			planes[1][i] = 0xC000
+			planes[2][i] = values[i%2]
+		}
+
+		c := rangecoder.NewEncoder()
+		r.putRemap(c, s, planes)
+		d := rangecoder.NewCoder(c.Finish())
+		record := &configRecord{chroma_planes: true}
+		err := parseRemap(d, record, s)
+		if err != nil {
+			t.Fatalf("remap %d: couldn't parse: %s", test.remap, err.Error())
+		}
+
+		for i, want := range test.want {
+			if got := s.fltmap[0][i]; got != want {
+				t.Errorf("remap %d: value %d is %#04x, not %#04x", test.remap, i, got, want)
+			}
+		}
+		// The other planes only use 0xC000, and 0x0000 or 0xC000.
+		if s.fltmap[1][0] != 0xC000 || s.fltmap[2][0] != 0x0000 || s.fltmap[2][1] != 0xC000 {
+			t.Errorf("remap %d: other planes are %#04x and %#04x, %#04x", test.remap, s.fltmap[1][0], s.fltmap[2][0], s.fltmap[2][1])
+		}
+	}
+}
+
+// Float samples decode to the same 16-bit values, and float32s, with
+// either remapping mode, or none, and through PCM and JPEG2000-RCT.
+func TestRemap(t *testing.T) {
+	// Per frame, three slices each.
+	frames := [][]sliceHeader{
+		{{remap: 1, slice_rct_by_coef: 1, slice_rct_ry_coef: 1}, {remap: 2, slice_rct_by_coef: 2, slice_rct_ry_coef: 1}, {remap: 0}},
+		{{remap: 2, slice_coding_mode: 1}, {remap: 0, slice_rct_by_coef: 0, slice_rct_ry_coef: 4}, {remap: 1, slice_rct_by_coef: 3}},
+		{{remap: 0, slice_coding_mode: 1}, {remap: 1, slice_coding_mode: 1}, {remap: 2, reset_contexts: true}},
+	}
+
+	for _, alpha := range []bool{false, true} {
+		r := newRGBStream(t, 24, 8, 16, alpha, 3)
+		r.record.micro_version = 4
+		r.record.flt = true
+		d, err := NewDecoder(writeConfigRecord(&r.record), r.width, r.height)
+		if err != nil {
+			t.Fatalf("alpha %t: couldn't create decoder: %s", alpha, err.Error())
+		}
+
+		for n, headers := range frames {
+			planes := floatTestPlanes(int(r.width), int(r.height), alpha, n)
+			out, err := d.DecodeFrame(r.encode(planes, n == 0, headers))
+			if err != nil {
+				t.Fatalf("alpha %t: frame %d: couldn't decode: %s", alpha, n, err.Error())
+			}
+			if !out.Float || len(out.BufFloat16) != len(planes) {
+				t.Fatalf("alpha %t: frame %d: float %t, with %d planes", alpha, n, out.Float, len(out.BufFloat16))
+			}
+
+			for p := range planes {
+				floats := out.PlaneFloat32(p)
+				for i, want := range planes[p] {
+					if got := out.BufFloat16[p][i]; uint32(got) != want {
+						t.Fatalf("alpha %t: frame %d: plane %d sample %d is %#04x, not %#04x", alpha, n, p, i, got, want)
+					}
+					if got, want := math.Float32bits(floats[i]), math.Float32bits(halfToFloat32(uint16(want))); got != want {
+						t.Fatalf("alpha %t: frame %d: plane %d float %d is %#08x, not %#08x", alpha, n, p, i, got, want)
+					}
+				}
+			}
+		}
+	}
+}
@@ -12,6 +12,12 @@ type internalFrame struct {
 	keyframe   bool
 	slice_info []sliceInfo
 	slices     []slice
+	// Range coder for slice 0, positioned after the in-band keyframe
+	// header, for versions which have one.
+	header_coder *rangecoder.Coder
+	// Slice positions and quantization table set indexes from the
+	// last version 2 keyframe header.
+	slice_layout []sliceHeader
 }
 
 type sliceInfo struct {
@@ -28,6 +34,17 @@ type slice struct {
 	height       uint32
 	state        [][][]uint8
 	golomb_state [][]golomb.State
+	fltmap       [][]uint16
+	// Set when the slice failed to decode, and its contexts are
+	// no longer usable until they are reset.
+	damaged bool
+	// Set once the slice header has been parsed, or set up for
+	// versions which do not code one.
+	has_header bool
+	// Coders positioned at the start of the slice content, between
+	// parsing the slice header and decoding the content.
+	coder        *rangecoder.Coder
+	golomb_coder *golomb.Coder
 }
 
 type sliceHeader struct {
@@ -39,13 +56,21 @@ type sliceHeader struct {
 	picture_structure     uint8
 	sar_num               uint32
 	sar_den               uint32
+	reset_contexts        bool
+	slice_coding_mode     uint32
+	slice_rct_by_coef     uint32
+	slice_rct_ry_coef     uint32
+	remap                 uint32
 }
 
 // Counts the number of slices in a frame, as described in
 // 9.1.1. Multi-threading Support and Independence of Slices.
 //
+// A frame can not have more slices than there are positions on the
+// slice grid, so counting stops after 'max_slices'.
+//
 // See: 4.8. Slice Footer
-func countSlices(buf []byte, header *internalFrame, ec bool) error {
+func countSlices(buf []byte, header *internalFrame, ec bool, max_slices int) error {
 	footerSize := 3
 	if ec {
 		footerSize += 5
@@ -57,7 +82,14 @@ func countSlices(buf []byte, header *internalFrame, ec bool) error {
 	endPos := len(buf)
 	header.slice_info = nil
 	for endPos > 0 {
+		if len(header.slice_info) >= max_slices {
+			return fmt.Errorf("more than %d slices in frame", max_slices)
+		}
+
 		var info sliceInfo
+		if endPos < footerSize {
+			return fmt.Errorf("%w slice footer", ErrTruncated)
+		}
 
 		// 4.8.1. slice_size
 		size := uint32(buf[endPos-footerSize]) << 16
@@ -66,16 +98,59 @@ func countSlices(buf []byte, header *internalFrame, ec bool) error {
 		info.size = size
 
 		// 4.8.2. error_status
-		info.error_status = uint8(buf[endPos-footerSize+3])
+		if ec {
+			info.error_status = uint8(buf[endPos-footerSize+3])
+		}
 
 		info.pos = endPos - int(size) - footerSize
-		header.slice_info = append([]sliceInfo{info}, header.slice_info...) //prepend
+		header.slice_info = append(header.slice_info, info)
 		endPos = info.pos
 	}
 
+	// They were found last to first.
+	for i, j := 0, len(header.slice_info)-1; i < j; i, j = i+1, j-1 {
+		header.slice_info[i], header.slice_info[j] = header.slice_info[j], header.slice_info[i]
+	}
+
 	if endPos < 0 {
 		return fmt.Errorf("invalid slice footer")
 	}
+	if len(header.slice_info) == 0 {
+		return fmt.Errorf("no slices in frame")
+	}
+
+	return nil
+}
+
+// Locates the slices in a version 2 frame. The slice count is known
+// from the last keyframe header. All slices but the first end with
+// their size, and the first slice takes up whatever is left at the
+// start of the frame.
+//
+// See: 4.8.1. slice_size
+func locateSlices(buf []byte, header *internalFrame, count int) error {
+	header.slice_info = make([]sliceInfo, count)
+
+	endPos := len(buf)
+	for i := count - 1; i > 0; i-- {
+		if endPos < 3 {
+			return fmt.Errorf("invalid slice footer")
+		}
+
+		// 4.8.1. slice_size
+		size := uint32(buf[endPos-3]) << 16
+		size |= uint32(buf[endPos-2]) << 8
+		size |= uint32(buf[endPos-1])
+
+		pos := endPos - int(size) - 3
+		if pos < 0 {
+			return fmt.Errorf("invalid slice footer")
+		}
+		header.slice_info[i] = sliceInfo{pos: pos, size: size}
+		endPos = pos
+	}
+
+	header.slice_info[0] = sliceInfo{pos: 0, size: uint32(endPos)}
 
 	return nil
 }
@@ -86,18 +161,35 @@ func countSlices(buf []byte, header *internalFrame, ec bool) error {
 //      * 3.8.1.3. Initial Values for the Context Model
 //      * 3.8.2.4. Initial Values for the VLC context state
 func (d *Decoder) parseFooters(buf []byte, header *internalFrame) error {
-	err := countSlices(buf, header, d.record.ec != 0)
-	if err != nil {
-		return fmt.Errorf("couldn't count slices: %s", err.Error())
+	if d.record.version < 2 {
+		// Versions 0 and 1 have no footers, and the whole frame
+		// is a single slice.
+		header.slice_info = []sliceInfo{{pos: 0, size: uint32(len(buf))}}
+	} else if d.record.version == 2 {
+		err := locateSlices(buf, header, len(header.slice_layout))
+		if err != nil {
+			return fmt.Errorf("couldn't locate slices: %w", err)
+		}
+	} else {
+		max_slices := (int(d.record.num_h_slices_minus1) + 1) * (int(d.record.num_v_slices_minus1) + 1)
+		err := countSlices(buf, header, d.record.ec != 0, max_slices)
+		if err != nil {
+			return fmt.Errorf("couldn't count slices: %w", err)
+		}
+	}
+
+	if d.options.MaxSlices != 0 && len(header.slice_info) > d.options.MaxSlices {
+		return fmt.Errorf("%w: %d slices, more than %d", ErrLimitExceeded, len(header.slice_info), d.options.MaxSlices)
 	}
 
 	slices := make([]slice, len(header.slice_info))
 	if !header.keyframe {
 		if len(slices) != len(header.slices) {
-			return fmt.Errorf("inter frames must have the same number of slices as the preceding intra frame")
+			return fmt.Errorf("%w: inter frames must have the same number of slices as the preceding intra frame", ErrStateMismatch)
 		}
 		for i := 0; i < len(slices); i++ {
 			slices[i].state = header.slices[i].state
+			slices[i].damaged = header.slices[i].damaged
 		}
 		if d.record.coder_type == 0 {
 			for i := 0; i < len(slices); i++ {
@@ -113,7 +205,7 @@ func (d *Decoder) parseFooters(buf []byte, header *internalFrame) error {
 // Parses a slice's header.
 //
 // See: 4.5. Slice Header
-func (d *Decoder) parseSliceHeader(c *rangecoder.Coder, s *slice) {
+func (d *Decoder) parseSliceHeader(c *rangecoder.Coder, s *slice) error {
 	// 4. Bitstream
 	slice_state := make([]uint8, contextSize)
 	for i := 0; i < contextSize; i++ {
@@ -130,18 +222,16 @@ func (d *Decoder) parseSliceHeader(c *rangecoder.Coder, s *slice) {
 	s.header.slice_height_minus1 = c.UR(slice_state)
 
 	// 4.5.5. quant_table_set_index_count
-	quant_table_set_index_count := 1
-	if d.record.chroma_planes {
-		quant_table_set_index_count++
-	}
-	if d.record.extra_plane {
-		quant_table_set_index_count++
-	}
+	quant_table_set_index_count := quantTableSetIndexCount(&d.record)
 
 	// 4.5.6. quant_table_set_index
 	s.header.quant_table_set_index = make([]uint8, quant_table_set_index_count)
 	for i := 0; i < quant_table_set_index_count; i++ {
-		s.header.quant_table_set_index[i] = uint8(c.UR(slice_state))
+		idx := c.UR(slice_state)
+		if idx >= uint32(d.record.quant_table_set_count) {
+			return fmt.Errorf("invalid quant_table_set_index: %d", idx)
+		}
+		s.header.quant_table_set_index[i] = uint8(idx)
 	}
 
 	// 4.5.7. picture_structure
@@ -155,16 +245,208 @@ func (d *Decoder) parseSliceHeader(c *rangecoder.Coder, s *slice) {
 	s.header.sar_num = c.UR(slice_state)
 	s.header.sar_den = c.UR(slice_state)
 
-	// Calculate bounaries for easy use elsewhere
-	//
-	// See: * 4.6.3. slice_pixel_height
-	//      * 4.6.4. slice_pixel_y
-	//      * 4.7.2. slice_pixel_width
-	//      * 4.7.3. slice_pixel_x
-	s.start_x = s.header.slice_x * d.width / (uint32(d.record.num_h_slices_minus1) + 1)
-	s.start_y = s.header.slice_y * d.height / (uint32(d.record.num_v_slices_minus1) + 1)
-	s.width = ((s.header.slice_x + s.header.slice_width_minus1 + 1) * d.width / (uint32(d.record.num_h_slices_minus1) + 1)) - s.start_x
-	s.height = ((s.header.slice_y + s.header.slice_height_minus1 + 1) * d.height / (uint32(d.record.num_v_slices_minus1) + 1)) - s.start_y
+	// These are only coded from version 4 on. The default
+	// coefficients give the same transform as earlier versions.
+	s.header.reset_contexts = false
+	s.header.slice_coding_mode = 0
+	s.header.slice_rct_by_coef = 1
+	s.header.slice_rct_ry_coef = 1
+	s.header.remap = 0
+	if d.record.version > 3 {
+		// 4.5.10. reset_contexts
+		s.header.reset_contexts = c.BR(slice_state)
+		// 4.5.11. slice_coding_mode
+		s.header.slice_coding_mode = c.UR(slice_state)
+		if s.header.slice_coding_mode > 1 {
+			return fmt.Errorf("invalid slice_coding_mode: %d", s.header.slice_coding_mode)
+		}
+		if s.header.slice_coding_mode != 1 && d.record.colorspace_type == 1 {
+			// 4.5.12. slice_rct_by_coef
+			s.header.slice_rct_by_coef = c.UR(slice_state)
+			// 4.5.13. slice_rct_ry_coef
+			s.header.slice_rct_ry_coef = c.UR(slice_state)
+			if uint64(s.header.slice_rct_by_coef)+uint64(s.header.slice_rct_ry_coef) > 4 {
+				return fmt.Errorf("invalid RCT coefficients: %d, %d", s.header.slice_rct_by_coef, s.header.slice_rct_ry_coef)
+			}
+		}
+	}
+
+	// Sample remapping mode, for float samples.
+	if hasRemap(&d.record) {
+		s.header.remap = c.UR(slice_state)
+		if s.header.remap > 2 || (!d.record.flt && s.header.remap != 0) {
+			return fmt.Errorf("invalid remap: %d", s.header.remap)
+		}
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	sliceBounds(&d.record, d.width, d.height, s)
+	s.has_header = true
+
+	return nil
+}
+
+// Sets up the slice header for versions which do not code one per
+// slice. Version 2 takes it from the last keyframe header. Versions
+// 0 and 1 have a single slice covering the frame, using quantization
+// table set 0 for every plane.
+func (d *Decoder) legacySliceHeader(header *internalFrame, slicenum int) {
+	s := &header.slices[slicenum]
+	if d.record.version == 2 {
+		s.header = header.slice_layout[slicenum]
+	} else {
+		s.header = sliceHeader{}
+		s.header.quant_table_set_index = make([]uint8, quantTableSetIndexCount(&d.record))
+	}
+	s.header.slice_rct_by_coef = 1
+	s.header.slice_rct_ry_coef = 1
+	sliceBounds(&d.record, d.width, d.height, s)
+	s.has_header = true
+}
+
+// Parses the slice layout coded in version 2 keyframe headers, which
+// takes the place of the per-slice headers of later versions.
+//
+// See: 4.3. Frame
+func (d *Decoder) parseSliceLayout(c *rangecoder.Coder, header *internalFrame) error {
+	// 4. Bitstream
+	state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		state[i] = 128
+	}
+
+	num_h_slices := uint32(d.record.num_h_slices_minus1) + 1
+	num_v_slices := uint32(d.record.num_v_slices_minus1) + 1
+
+	slice_count := c.UR(state)
+	if slice_count == 0 || slice_count > num_h_slices*num_v_slices {
+		return fmt.Errorf("invalid slice count: %d", slice_count)
+	}
+
+	quant_table_set_index_count := quantTableSetIndexCount(&d.record)
+
+	layout := make([]sliceHeader, slice_count)
+	for i := 0; i < len(layout); i++ {
+		h := &layout[i]
+		h.slice_x = c.UR(state)
+		h.slice_y = c.UR(state)
+		h.slice_width_minus1 = c.UR(state)
+		h.slice_height_minus1 = c.UR(state)
+
+		h.quant_table_set_index = make([]uint8, quant_table_set_index_count)
+		for j := 0; j < quant_table_set_index_count; j++ {
+			idx := c.UR(state)
+			if idx >= uint32(d.record.quant_table_set_count) {
+				return fmt.Errorf("invalid quant_table_set_index: %d", idx)
+			}
+			h.quant_table_set_index[j] = uint8(idx)
+		}
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	header.slice_layout = layout
+
+	return nil
+}
+
+// Calculates the number of quantization table set indexes, and thus
+// the number of sets of contexts, used by each slice. Before version 4,
+// a chroma index is always present, even without chroma planes.
+//
+// See: 4.5.5. quant_table_set_index_count
+func quantTableSetIndexCount(record *configRecord) int {
+	count := 1
+	if record.chroma_planes || record.version < 4 {
+		count++
+	}
+	if record.extra_plane {
+		count++
+	}
+	return count
+}
+
+// Checks that the slices of a frame tile the slice grid exactly once,
+// so that no two slices write to the same pixels, and none are left
+// out, before any slice content is decoded. Slices whose headers could
+// not be parsed are skipped, and gaps are only looked for if there are
+// none, as those slices may well cover them.
+//
+// See: 4.5. Slice Header
+func checkSliceGeometry(record *configRecord, slices []slice) error {
+	num_h_slices := uint64(record.num_h_slices_minus1) + 1
+	num_v_slices := uint64(record.num_v_slices_minus1) + 1
+
+	// The index of the slice covering each grid position, plus one.
+	owner := make([]int, num_h_slices*num_v_slices)
+	complete := true
+	for i := range slices {
+		if !slices[i].has_header {
+			complete = false
+			continue
+		}
+
+		h := &slices[i].header
+		x, y := uint64(h.slice_x), uint64(h.slice_y)
+		w, ht := uint64(h.slice_width_minus1)+1, uint64(h.slice_height_minus1)+1
+		geometryError := &GeometryError{
+			Index:    i,
+			X:        int(x),
+			Y:        int(y),
+			Width:    int(w),
+			Height:   int(ht),
+			Overlaps: -1,
+		}
+		if x+w > num_h_slices || y+ht > num_v_slices {
+			return geometryError
+		}
+
+		for gy := y; gy < y+ht; gy++ {
+			for gx := x; gx < x+w; gx++ {
+				pos := gy*num_h_slices + gx
+				if owner[pos] != 0 {
+					geometryError.Overlaps = owner[pos] - 1
+					return geometryError
+				}
+				owner[pos] = i + 1
+			}
+		}
+	}
+
+	if complete {
+		for pos, o := range owner {
+			if o == 0 {
+				return &GeometryError{
+					Index:    -1,
+					X:        pos % int(num_h_slices),
+					Y:        pos / int(num_h_slices),
+					Width:    1,
+					Height:   1,
+					Overlaps: -1,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Calculate bounaries for easy use elsewhere
+//
+// See: * 4.6.3. slice_pixel_height
+//      * 4.6.4. slice_pixel_y
+//      * 4.7.2. slice_pixel_width
+//      * 4.7.3. slice_pixel_x
+func sliceBounds(record *configRecord, width uint32, height uint32, s *slice) {
+	s.start_x = s.header.slice_x * width / (uint32(record.num_h_slices_minus1) + 1)
+	s.start_y = s.header.slice_y * height / (uint32(record.num_v_slices_minus1) + 1)
+	s.width = ((s.header.slice_x + s.header.slice_width_minus1 + 1) * width / (uint32(record.num_h_slices_minus1) + 1)) - s.start_x
+	s.height = ((s.header.slice_y + s.header.slice_height_minus1 + 1) * height / (uint32(record.num_v_slices_minus1) + 1)) - s.start_y
 }
 
 // Line decoding.
@@ -179,6 +461,12 @@ func (d *Decoder) parseSliceHeader(c *rangecoder.Coder, s *slice) {
 //
 // See: 4.7. Line
 func (d *Decoder) decodeLine(c *rangecoder.Coder, gc *golomb.Coder, s *slice, frame *Frame, w int, h int, stride int, offset int, y int, p int, qt int) {
+	// 4.5.11. slice_coding_mode
+	if s.header.slice_coding_mode == 1 {
+		d.decodeLinePCM(c, frame, w, stride, offset, y, p)
+		return
+	}
+
 	// Runs are horizontal and thus cannot run more than a line.
 	//
 	// See: 3.8.2.2.1. Run Length Coding
@@ -195,7 +483,7 @@ func (d *Decoder) decodeLine(c *rangecoder.Coder, gc *golomb.Coder, s *slice, fr
 		var buf32 []uint32
 		if d.record.bits_per_raw_sample == 8 && d.record.colorspace_type != 1 {
 			buf = frame.Buf[p][offset:]
-		} else if d.record.bits_per_raw_sample == 16 && d.record.colorspace_type == 1 {
+		} else if usesScratch32(&d.record) {
 			buf32 = frame.buf32[p][offset:]
 		} else {
 			buf16 = frame.Buf16[p][offset:]
@@ -213,7 +501,7 @@ func (d *Decoder) decodeLine(c *rangecoder.Coder, gc *golomb.Coder, s *slice, fr
 		var T, L, t, l, tr, tl int
 		if d.record.bits_per_raw_sample == 8 && d.record.colorspace_type != 1 {
 			T, L, t, l, tr, tl = deriveBorders(buf, x, y, w, h, stride)
-		} else if d.record.bits_per_raw_sample == 16 && d.record.colorspace_type == 1 {
+		} else if usesScratch32(&d.record) {
 			T, L, t, l, tr, tl = deriveBorders32(buf32, x, y, w, h, stride)
 		} else {
 			T, L, t, l, tr, tl = deriveBorders16(buf16, x, y, w, h, stride)
@@ -276,7 +564,7 @@ func (d *Decoder) decodeLine(c *rangecoder.Coder, gc *golomb.Coder, s *slice, fr
 
 		if d.record.bits_per_raw_sample == 8 && d.record.colorspace_type != 1 {
 			buf[(y*stride)+x] = byte(val)
-		} else if d.record.bits_per_raw_sample == 16 && d.record.colorspace_type == 1 {
+		} else if usesScratch32(&d.record) {
 			buf32[(y*stride)+x] = uint32(val)
 		} else {
 			buf16[(y*stride)+x] = uint16(val)
@@ -284,15 +572,102 @@ func (d *Decoder) decodeLine(c *rangecoder.Coder, gc *golomb.Coder, s *slice, fr
 	}
 }
 
+// PCM line decoding.
+//
+// Samples are stored as is, MSB first, each bit being range coded
+// with a fresh state. This is used even in Golomb-Rice mode. RGB
+// samples have no JPEG2000-RCT applied, so do not need the extra bit.
+//
+// See: 4.5.11. slice_coding_mode
+func (d *Decoder) decodeLinePCM(c *rangecoder.Coder, frame *Frame, w int, stride int, offset int, y int, p int) {
+	bits := int(d.record.bits_per_raw_sample)
+
+	for x := 0; x < w; x++ {
+		val := uint32(0)
+		for i := 0; i < bits; i++ {
+			state := []uint8{128}
+			val <<= 1
+			if c.BR(state) {
+				val |= 1
+			}
+		}
+
+		pos := offset + (y * stride) + x
+		if d.record.bits_per_raw_sample == 8 && d.record.colorspace_type != 1 {
+			frame.Buf[p][pos] = byte(val)
+		} else if usesScratch32(&d.record) {
+			frame.buf32[p][pos] = val
+		} else {
+			frame.Buf16[p][pos] = uint16(val)
+		}
+	}
+}
+
+// Calculates the dimensions and position of plane p within a slice,
+// as well as which quantization table set index it uses.
+//
+// Chroma positions are rounded down and sizes up, as FFmpeg does, so
+// where a luma slice boundary is not a multiple of the subsampling, a
+// chroma row or column is coded by both slices either side of it. See
+// planeOwnedSize.
+//
+// See: * 4.6.2. plane_pixel_height
+//      * 4.7.1. plane_pixel_width
+func planeLayout(record *configRecord, frame_width uint32, s *slice, p int) (int, int, int, int, int, int) {
+	chroma_planes := 0
+	if record.chroma_planes {
+		chroma_planes = 2
+	}
+
+	if p == 0 || p == 1+chroma_planes {
+		// The alpha plane always uses the last index.
+		quant_table := 0
+		if p != 0 {
+			quant_table = quantTableSetIndexCount(record) - 1
+		}
+		return int(s.width), int(s.height), int(frame_width), int(s.start_x), int(s.start_y), quant_table
+	}
+
+	// This is, of course, silly, but I want to do it "by the spec".
+	plane_pixel_width := int(math.Ceil(float64(s.width) / float64(uint32(1)<<record.log2_h_chroma_subsample)))
+	plane_pixel_height := int(math.Ceil(float64(s.height) / float64(uint32(1)<<record.log2_v_chroma_subsample)))
+	plane_pixel_stride := int(math.Ceil(float64(frame_width) / float64(uint32(1)<<record.log2_h_chroma_subsample)))
+	start_x := int(s.start_x >> record.log2_h_chroma_subsample)
+	start_y := int(s.start_y >> record.log2_v_chroma_subsample)
+
+	return plane_pixel_width, plane_pixel_height, plane_pixel_stride, start_x, start_y, 1
+}
+
+// Calculates the dimensions of the part of plane p a slice writes to,
+// starting from the position planeLayout gives. For chroma planes, it
+// ends where the next slice starts, or at the edge of the plane, so
+// that slices never overlap. It may be smaller or, at the edge of the
+// plane, larger than what is coded.
+func planeOwnedSize(record *configRecord, frame_width uint32, frame_height uint32, s *slice, p int) (int, int) {
+	if p == 0 || p == 3 || !record.chroma_planes {
+		return int(s.width), int(s.height)
+	}
+
+	chroma_width, chroma_height := chromaSize(record, frame_width, frame_height)
+	end_x := (s.start_x + s.width) >> record.log2_h_chroma_subsample
+	if s.start_x+s.width >= frame_width {
+		end_x = chroma_width
+	}
+	end_y := (s.start_y + s.height) >> record.log2_v_chroma_subsample
+	if s.start_y+s.height >= frame_height {
+		end_y = chroma_height
+	}
+
+	return int(end_x - s.start_x>>record.log2_h_chroma_subsample), int(end_y - s.start_y>>record.log2_v_chroma_subsample)
+}
+
 // Decoding happens here.
 //
 // See: * 4.6. Slice Content
-func (d *Decoder) decodeSliceContent(c *rangecoder.Coder, gc *golomb.Coder, si *sliceInfo, s *slice, frame *Frame) {
+func (d *Decoder) decodeSliceContent(c *rangecoder.Coder, gc *golomb.Coder, si *sliceInfo, s *slice, frame *Frame) error {
 	// 4.6.1. primary_color_count
 	primary_color_count := 1
-	chroma_planes := 0
 	if d.record.chroma_planes {
-		chroma_planes = 2
 		primary_color_count += 2
 	}
 	if d.record.extra_plane {
@@ -306,34 +681,20 @@ func (d *Decoder) decodeSliceContent(c *rangecoder.Coder, gc *golomb.Coder, si *
 		//
 		// See: 3.7.1. YCbCr
 		for p := 0; p < primary_color_count; p++ {
-			var plane_pixel_height int
-			var plane_pixel_width int
-			var plane_pixel_stride int
-			var start_x int
-			var start_y int
-			var quant_table int
-
-			// See: * 4.6.2. plane_pixel_height
-			//      * 4.7.1. plane_pixel_width
-			if p == 0 || p == 1+chroma_planes {
-				plane_pixel_height = int(s.height)
-				plane_pixel_width = int(s.width)
-				plane_pixel_stride = int(d.width)
-				start_x = int(s.start_x)
-				start_y = int(s.start_y)
-				if p == 0 {
-					quant_table = 0
-				} else {
-					quant_table = chroma_planes
-				}
-			} else {
-				// This is, of course, silly, but I want to do it "by the spec".
-				plane_pixel_height = int(math.Ceil(float64(s.height) / float64(uint32(1)<<d.record.log2_v_chroma_subsample)))
-				plane_pixel_width = int(math.Ceil(float64(s.width) / float64(uint32(1)<<d.record.log2_h_chroma_subsample)))
-				plane_pixel_stride = int(math.Ceil(float64(d.width) / float64(uint32(1)<<d.record.log2_h_chroma_subsample)))
-				start_x = int(math.Ceil(float64(s.start_x) / float64(uint32(1)<<d.record.log2_v_chroma_subsample)))
-				start_y = int(math.Ceil(float64(s.start_y) / float64(uint32(1)<<d.record.log2_h_chroma_subsample)))
-				quant_table = 1
+			plane_pixel_width, plane_pixel_height, plane_pixel_stride, start_x, start_y, quant_table := planeLayout(&d.record, d.width, s, p)
+			owned_width, owned_height := planeOwnedSize(&d.record, d.width, d.height, s, p)
+			offset := start_y*plane_pixel_stride + start_x
+			if !planeFits(frame, p, start_x, offset, owned_width, owned_height, plane_pixel_stride) {
+				return fmt.Errorf("slice does not fit in plane %d", p)
+			}
+
+			// Anything coded past the part of the plane this slice owns
+			// is decoded to the side, and dropped, as the next slice
+			// codes it too.
+			target, target_offset, target_stride := frame, offset, plane_pixel_stride
+			if plane_pixel_width > owned_width || plane_pixel_height > owned_height {
+				target = scratchPlane(frame, p, plane_pixel_width*plane_pixel_height)
+				target_offset, target_stride = 0, plane_pixel_width
 			}
 
 			// 3.8.2.2.1. Run Length Coding
@@ -342,9 +703,14 @@ func (d *Decoder) decodeSliceContent(c *rangecoder.Coder, gc *golomb.Coder, si *
 			}
 
 			for y := 0; y < plane_pixel_height; y++ {
-				offset := start_y*plane_pixel_stride + start_x
-				d.decodeLine(c, gc, s, frame, plane_pixel_width, plane_pixel_height, plane_pixel_stride, offset, y, p, quant_table)
+				d.decodeLine(c, gc, s, target, plane_pixel_width, plane_pixel_height, target_stride, target_offset, y, p, quant_table)
+			}
+
+			w, h := minInt(plane_pixel_width, owned_width), minInt(plane_pixel_height, owned_height)
+			if target != frame {
+				copyPlaneRect(frame, target, p, offset, plane_pixel_stride, w, h, target_stride)
 			}
+			extendPlaneRect(frame, p, offset, plane_pixel_stride, w, h, owned_width, owned_height)
 		}
 	} else {
 		// RGB (JPEG2000-RCT) Mode
@@ -356,6 +722,11 @@ func (d *Decoder) decodeSliceContent(c *rangecoder.Coder, gc *golomb.Coder, si *
 			gc.NewPlane(uint32(s.width))
 		}
 		offset := int(s.start_y*d.width + s.start_x)
+		for p := 0; p < primary_color_count; p++ {
+			if !planeFits(frame, p, int(s.start_x), offset, int(s.width), int(s.height), int(d.width)) {
+				return fmt.Errorf("slice does not fit in plane %d", p)
+			}
+		}
 		for y := 0; y < int(s.height); y++ {
 			// RGB *must* have chroma planes, so this is safe.
 			d.decodeLine(c, gc, s, frame, int(s.width), int(s.height), int(d.width), offset, y, 0, 0)
@@ -366,18 +737,156 @@ func (d *Decoder) decodeSliceContent(c *rangecoder.Coder, gc *golomb.Coder, si *
 			}
 		}
 
+		by := int32(s.header.slice_rct_by_coef)
+		ry := int32(s.header.slice_rct_ry_coef)
+
 		// Convert to RGB all at once, cache locality be damned.
-		if d.record.bits_per_raw_sample == 8 {
-			rct8(frame.Buf, frame.Buf16, int(s.width), int(s.height), int(d.width), offset)
+		//
+		// PCM slices have no JPEG2000-RCT applied.
+		//
+		// See: 4.5.11. slice_coding_mode
+		if s.header.slice_coding_mode == 1 {
+			if d.record.bits_per_raw_sample == 8 {
+				pcm8(frame.Buf, frame.Buf16, int(s.width), int(s.height), int(d.width), offset)
+			} else if d.record.bits_per_raw_sample >= 9 && d.record.bits_per_raw_sample <= 15 && !d.record.extra_plane {
+				pcmMid(frame.Buf16, int(s.width), int(s.height), int(d.width), offset)
+			} else {
+				pcm16(frame.Buf16, frame.buf32, int(s.width), int(s.height), int(d.width), offset)
+			}
+		} else if d.record.bits_per_raw_sample == 8 {
+			rct8(frame.Buf, frame.Buf16, int(s.width), int(s.height), int(d.width), offset, by, ry)
 		} else if d.record.bits_per_raw_sample >= 9 && d.record.bits_per_raw_sample <= 15 && !d.record.extra_plane {
 			// See: 3.7.2. RGB
-			rctMid(frame.Buf16, int(s.width), int(s.height), int(d.width), offset, uint(d.record.bits_per_raw_sample))
+			rctMid(frame.Buf16, int(s.width), int(s.height), int(d.width), offset, uint(d.record.bits_per_raw_sample), by, ry)
+		} else {
+			rct16(frame.Buf16, frame.buf32, int(s.width), int(s.height), int(d.width), offset, uint(d.record.bits_per_raw_sample), by, ry)
+		}
+
+		// The samples were predicted and transformed in the remapped
+		// integer domain.
+		if d.record.flt {
+			remapSlice(frame.BufFloat16, frame.Buf16, s.fltmap, int(s.width), int(s.height), int(d.width), offset)
+		}
+	}
+
+	return nil
+}
+
+// Checks that a w by h area at 'offset' fits within plane p.
+func planeFits(frame *Frame, p int, x int, offset int, w int, h int, stride int) bool {
+	if w == 0 || h == 0 {
+		return true
+	}
+	size := 0
+	if frame.Buf != nil {
+		size = len(frame.Buf[p])
+	} else if frame.buf32 != nil {
+		size = len(frame.buf32[p])
+	} else {
+		size = len(frame.Buf16[p])
+	}
+	return x+w <= stride && offset+(h-1)*stride+w <= size
+}
+
+// Makes a frame with only plane p, of the same type as frame's, to
+// decode to the side.
+func scratchPlane(frame *Frame, p int, size int) *Frame {
+	ret := new(Frame)
+	if frame.Buf != nil {
+		ret.Buf = make([][]byte, p+1)
+		ret.Buf[p] = make([]byte, size)
+	} else {
+		ret.Buf16 = make([][]uint16, p+1)
+		ret.Buf16[p] = make([]uint16, size)
+	}
+	return ret
+}
+
+// Copies a w by h area of plane p of src, at the start of it, to dst.
+func copyPlaneRect(dst *Frame, src *Frame, p int, offset int, stride int, w int, h int, src_stride int) {
+	for y := 0; y < h; y++ {
+		if dst.Buf != nil {
+			copy(dst.Buf[p][offset+y*stride:offset+y*stride+w], src.Buf[p][y*src_stride:])
 		} else {
-			rct16(frame.Buf16, frame.buf32, int(s.width), int(s.height), int(d.width), offset)
+			copy(dst.Buf16[p][offset+y*stride:offset+y*stride+w], src.Buf16[p][y*src_stride:])
 		}
 	}
 }
 
+// Extends a decoded w by h area of plane p to the owned_width by
+// owned_height area a slice owns, by repeating its last column and row.
+// Only the slices at the edges of the plane can own more than they
+// code, when the luma slice boundary before them is not a multiple of
+// the subsampling.
+func extendPlaneRect(frame *Frame, p int, offset int, stride int, w int, h int, owned_width int, owned_height int) {
+	if w == 0 || h == 0 {
+		return
+	}
+	for y := 0; y < owned_height; y++ {
+		src := offset + minInt(y, h-1)*stride
+		dst := offset + y*stride
+		for x := 0; x < owned_width; x++ {
+			if x < w && y < h {
+				continue
+			}
+			if frame.Buf != nil {
+				frame.Buf[p][dst+x] = frame.Buf[p][src+minInt(x, w-1)]
+			} else {
+				frame.Buf16[p][dst+x] = frame.Buf16[p][src+minInt(x, w-1)]
+			}
+		}
+	}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Reads the keyframe bit and, on keyframes, the in-band parameters
+// of versions 0 and 1, or the slice layout of version 2, leaving the
+// range coder positioned at the start of the slice content.
+//
+// See: 4.3. Frame
+func (d *Decoder) parseFrameHeader(buf []byte, header *internalFrame) error {
+	c := rangecoder.NewCoder(buf)
+
+	// 4. Bitstream
+	state := make([]uint8, contextSize)
+	for i := 0; i < contextSize; i++ {
+		state[i] = 128
+	}
+
+	if c.BR(state) {
+		if d.record.version == 2 {
+			err := d.parseSliceLayout(c, header)
+			if err != nil {
+				return err
+			}
+		} else {
+			record := d.record
+			err := parseKeyframeHeader(c, &record, d.options.MaxContextCount)
+			if err != nil {
+				return err
+			}
+			d.record = record
+			d.initializeStates()
+		}
+	} else if d.record.quant_table_set_count == 0 || (d.record.version == 2 && len(header.slice_layout) == 0) {
+		return fmt.Errorf("inter frame without a preceding keyframe")
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	header.header_coder = c
+
+	return nil
+}
+
 // Determines whether a given frame is a keyframe.
 //
 // See: 4.3. Frame
@@ -393,23 +902,46 @@ func isKeyframe(buf []byte) bool {
 	return c.BR(state)
 }
 
+// Checks that the contexts a slice carries over from the previous frame
+// are the ones its quant_table_set_index refers to, so that none of the
+// contexts derived from the quantization tables are out of range.
+func sliceStatesMatch(s *slice, record *configRecord) bool {
+	if len(s.state) != len(s.header.quant_table_set_index) {
+		return false
+	}
+	for i, qt := range s.header.quant_table_set_index {
+		if len(s.state[i]) != int(record.context_count[qt]) {
+			return false
+		}
+		if record.coder_type == 0 && (i >= len(s.golomb_state) || len(s.golomb_state[i]) != int(record.context_count[qt])) {
+			return false
+		}
+	}
+	return true
+}
+
 // Resets the range coder and Golomb-Rice coder states.
-func (d *Decoder) resetSliceStates(s *slice) {
+//
+// There is one set of contexts per quant_table_set_index, initialized
+// from the quantization table set it refers to, so the slice header
+// must have been parsed first.
+func resetSliceStates(s *slice, record *configRecord, initial_states [][][]uint8) {
 	// Range coder states
-	s.state = make([][][]uint8, len(d.initial_states))
-	for i := 0; i < len(d.initial_states); i++ {
-		s.state[i] = make([][]uint8, len(d.initial_states[i]))
-		for j := 0; j < len(d.initial_states[i]); j++ {
-			s.state[i][j] = make([]uint8, len(d.initial_states[i][j]))
-			copy(s.state[i][j], d.initial_states[i][j])
+	s.state = make([][][]uint8, len(s.header.quant_table_set_index))
+	for i := 0; i < len(s.header.quant_table_set_index); i++ {
+		qt := s.header.quant_table_set_index[i]
+		s.state[i] = make([][]uint8, len(initial_states[qt]))
+		for j := 0; j < len(initial_states[qt]); j++ {
+			s.state[i][j] = make([]uint8, len(initial_states[qt][j]))
+			copy(s.state[i][j], initial_states[qt][j])
 		}
 	}
 
 	// Golomb-Rice Code states
-	if d.record.coder_type == 0 {
-		s.golomb_state = make([][]golomb.State, d.record.quant_table_set_count)
+	if record.coder_type == 0 {
+		s.golomb_state = make([][]golomb.State, len(s.header.quant_table_set_index))
 		for i := 0; i < len(s.golomb_state); i++ {
-			s.golomb_state[i] = make([]golomb.State, d.record.context_count[i])
+			s.golomb_state[i] = make([]golomb.State, record.context_count[s.header.quant_table_set_index[i]])
 			for j := 0; j < len(s.golomb_state[i]); j++ {
 				s.golomb_state[i][j] = golomb.NewState()
 			}
@@ -417,64 +949,142 @@ func (d *Decoder) resetSliceStates(s *slice) {
 	}
 }
 
-func (d *Decoder) decodeSlice(buf []byte, header *internalFrame, slicenum int, frame *Frame) error {
+// Checks a slice's integrity and parses its header, resetting its
+// contexts if need be, and leaves its coders positioned at the start
+// of the slice content, ready for decodeSlice.
+//
+// This is done for every slice before any slice content is decoded, so
+// that the slice geometry can be checked first.
+func (d *Decoder) startSlice(buf []byte, header *internalFrame, slicenum int) error {
 	// Before we do anything, let's try and check the integrity
 	//
 	// See: * 4.8.2. error_status
 	//      * 4.8.3. slice_crc_parity
 	if d.record.ec == 1 {
 		if header.slice_info[slicenum].error_status != 0 {
-			return fmt.Errorf("error_status is non-zero: %d", header.slice_info[slicenum].error_status)
+			return ErrSliceErrorStatus{Value: header.slice_info[slicenum].error_status}
 		}
 
 		sliceBuf := buf[header.slice_info[slicenum].pos:]
 		sliceBuf = sliceBuf[:header.slice_info[slicenum].size+8] // 8 bytes for footer size
 		if crc32MPEG2(sliceBuf) != 0 {
-			return fmt.Errorf("CRC mismatch")
+			return ErrSliceCRC
 		}
 	}
 
-	// If this is a keyframe, refresh states.
+	// The range coder is used in closed mode, so it must not see
+	// the footer, or anything after it.
 	//
-	// See: * 3.8.1.3. Initial Values for the Context Model
-	//      * 3.8.2.4. Initial Values for the VLC context state
-	if header.keyframe {
-		d.resetSliceStates(&header.slices[slicenum])
-	}
+	// See: 3.8.1.1.1. Termination
+	sliceBuf := buf[header.slice_info[slicenum].pos:]
+	sliceBuf = sliceBuf[:header.slice_info[slicenum].size]
 
-	c := rangecoder.NewCoder(buf[header.slice_info[slicenum].pos:])
+	var c *rangecoder.Coder
+	if slicenum == 0 && header.header_coder != nil {
+		// The keyframe bit and header have already been read.
+		c = header.header_coder
+	} else {
+		c = rangecoder.NewCoder(sliceBuf)
 
-	// 4. Bitstream
-	state := make([]uint8, contextSize)
-	for i := 0; i < contextSize; i++ {
-		state[i] = 128
-	}
+		// 4. Bitstream
+		state := make([]uint8, contextSize)
+		for i := 0; i < contextSize; i++ {
+			state[i] = 128
+		}
 
-	// Skip keyframe bit on slice 0
-	if slicenum == 0 {
-		c.BR(state)
+		// Skip keyframe bit on slice 0
+		if slicenum == 0 {
+			c.BR(state)
+		}
 	}
 
 	if d.record.coder_type == 2 { // Custom state transition table
 		c.SetTable(d.state_transition)
 	}
 
-	d.parseSliceHeader(c, &header.slices[slicenum])
+	if d.record.version >= 3 {
+		err := d.parseSliceHeader(c, &header.slices[slicenum])
+		if err != nil {
+			return fmt.Errorf("invalid slice header: %w", err)
+		}
+	} else {
+		d.legacySliceHeader(header, slicenum)
+	}
+
+	// If this is a keyframe, or the slice asks for it, refresh states.
+	//
+	// See: * 3.8.1.3. Initial Values for the Context Model
+	//      * 3.8.2.4. Initial Values for the VLC context state
+	//      * 4.5.10. reset_contexts
+	if header.keyframe || header.slices[slicenum].header.reset_contexts {
+		resetSliceStates(&header.slices[slicenum], &d.record, d.initial_states)
+		header.slices[slicenum].damaged = false
+	} else if header.slices[slicenum].damaged {
+		return fmt.Errorf("slice contexts were lost in an earlier frame")
+	} else if !sliceStatesMatch(&header.slices[slicenum], &d.record) {
+		return fmt.Errorf("%w: slice contexts do not match its quant_table_set_index", ErrStateMismatch)
+	}
+
+	header.slices[slicenum].fltmap = nil
+	if header.slices[slicenum].header.remap != 0 {
+		err := parseRemap(c, &d.record, &header.slices[slicenum])
+		if err != nil {
+			return fmt.Errorf("invalid remap table: %w", err)
+		}
+	}
 
 	var gc *golomb.Coder
 	if d.record.coder_type == 0 {
 		// We're switching to Golomb-Rice mode now so we need the bitstream
-		// position.
+		// position. Older streams do not end the range coder in sentinal
+		// mode.
 		//
 		// See: 3.8.1.1.1. Termination
-		c.SentinalEnd()
+		if d.record.version > 3 || (d.record.version == 3 && d.record.micro_version > 1) {
+			c.SentinalEnd()
+		}
 		offset := c.GetPos() - 1
-		gc = golomb.NewCoder(buf[header.slice_info[slicenum].pos+offset:])
+		// Only the first slice of a version 2 frame has any range
+		// coded data before the Golomb-Rice coded data.
+		if d.record.version == 2 && slicenum != 0 {
+			offset = 0
+		}
+		if offset < 0 || offset > len(sliceBuf) || c.Err() != nil {
+			return fmt.Errorf("%w slice", ErrTruncated)
+		}
+		gc = golomb.NewCoder(sliceBuf[offset:])
 	}
 
+	header.slices[slicenum].coder = c
+	header.slices[slicenum].golomb_coder = gc
+
+	return nil
+}
+
+// Decodes a slice's content, once startSlice has parsed its header.
+func (d *Decoder) decodeSlice(header *internalFrame, slicenum int, frame *Frame) error {
+	s := &header.slices[slicenum]
+	c, gc := s.coder, s.golomb_coder
+	// They hold on to the packet.
+	s.coder, s.golomb_coder = nil, nil
+
 	// Don't worry, I fully understand how non-idiomatic and
 	// ugly passing both c and gc is.
-	d.decodeSliceContent(c, gc, &header.slice_info[slicenum], &header.slices[slicenum], frame)
+	err := d.decodeSliceContent(c, gc, &header.slice_info[slicenum], s, frame)
+	if err != nil {
+		return err
+	}
+
+	// The coders carry on with garbage after an error, so only need
+	// checking once they are done.
+	if c.Err() != nil {
+		return fmt.Errorf("invalid slice content: %w", c.Err())
+	}
+	if gc != nil && gc.Err() == golomb.ErrTruncated {
+		return fmt.Errorf("%w slice content", ErrTruncated)
+	} else if gc != nil && gc.Err() != nil {
+		return fmt.Errorf("invalid slice content: %w", gc.Err())
+	}
 
 	return nil
 }
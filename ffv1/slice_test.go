@@ -0,0 +1,199 @@
+package ffv1
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/internal/testpattern"
+)
+
+// Makes frame n of the synthetic sequence, as described in testpattern,
+// for the given encoder settings. It matches ffv1test.Frame, which the
+// tests of this package can not import.
+func testFrame(opts EncoderOptions, n int) *Frame {
+	frame := &Frame{
+		Width:            opts.Width,
+		Height:           opts.Height,
+		BitDepth:         8,
+		HasChroma:        opts.HasChroma,
+		HasAlpha:         opts.HasAlpha,
+		ChromaSubsampleH: opts.ChromaSubsampleH,
+		ChromaSubsampleV: opts.ChromaSubsampleV,
+	}
+	if !opts.HasChroma {
+		frame.ChromaSubsampleH, frame.ChromaSubsampleV = 0, 0
+	}
+	frame.Buf = testpattern.Planes(opts.Width, opts.Height, opts.HasChroma, opts.HasAlpha, frame.ChromaSubsampleH, frame.ChromaSubsampleV, n)
+
+	return frame
+}
+
+// Encodes 'count' frames of the synthetic sequence with the given
+// settings, returning the configuration record and the packets.
+func encodeSequence(tb testing.TB, opts EncoderOptions, count int) ([]byte, [][]byte) {
+	tb.Helper()
+
+	e, err := NewEncoder(opts)
+	if err != nil {
+		tb.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+
+	var packets [][]byte
+	for n := 0; n < count; n++ {
+		packet, err := e.EncodeFrame(testFrame(opts, n))
+		if err != nil {
+			tb.Fatalf("couldn't encode frame %d: %s", n, err.Error())
+		}
+		packets = append(packets, packet)
+	}
+
+	return e.Record(), packets
+}
+
+// Encodes 'count' frames with the given settings, decodes them again,
+// and checks they are unchanged.
+func testRoundTrip(t *testing.T, opts EncoderOptions, count int) {
+	t.Helper()
+
+	e, err := NewEncoder(opts)
+	if err != nil {
+		t.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+	d, err := NewDecoder(e.Record(), opts.Width, opts.Height)
+	if err != nil {
+		t.Fatalf("couldn't create decoder: %s", err.Error())
+	}
+
+	for n := 0; n < count; n++ {
+		in := testFrame(opts, n)
+		packet, err := e.EncodeFrame(in)
+		if err != nil {
+			t.Fatalf("frame %d: couldn't encode: %s", n, err.Error())
+		}
+		out, err := d.DecodeFrame(packet)
+		if err != nil {
+			t.Fatalf("frame %d: couldn't decode: %s", n, err.Error())
+		}
+		if len(out.Buf) != len(in.Buf) {
+			t.Fatalf("frame %d: %d planes, not %d", n, len(out.Buf), len(in.Buf))
+		}
+		for p := range in.Buf {
+			if !bytes.Equal(out.Buf[p], in.Buf[p]) {
+				t.Fatalf("frame %d: plane %d differs", n, p)
+			}
+		}
+	}
+}
+
+// Luma slice boundaries which are not a multiple of the chroma
+// subsampling make the chroma slices either side of them both code the
+// row or column between them.
+func TestChromaSliceBoundaries(t *testing.T) {
+	tests := []struct {
+		name    string
+		width   uint32
+		height  uint32
+		h       uint8
+		v       uint8
+		slicesH int
+		slicesV int
+	}{
+		{"420 three rows", 48, 32, 1, 1, 1, 3},
+		{"420 three columns", 48, 32, 1, 1, 3, 1},
+		{"420 odd size", 49, 33, 1, 1, 3, 3},
+		{"422 odd columns", 50, 16, 1, 0, 3, 2},
+		{"410 five rows", 40, 44, 2, 2, 2, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testRoundTrip(t, EncoderOptions{
+				Width:            test.width,
+				Height:           test.height,
+				HasChroma:        true,
+				ChromaSubsampleH: test.h,
+				ChromaSubsampleV: test.v,
+				SlicesH:          test.slicesH,
+				SlicesV:          test.slicesV,
+				GOPSize:          2,
+			}, 2)
+		})
+	}
+}
+
+func TestPlaneFits(t *testing.T) {
+	frame := &Frame{Buf: [][]byte{make([]byte, 16*8)}}
+
+	tests := []struct {
+		x      int
+		y      int
+		w      int
+		h      int
+		expect bool
+	}{
+		{0, 0, 16, 8, true},
+		{8, 4, 8, 4, true},
+		{8, 4, 9, 4, false},
+		{0, 4, 16, 5, false},
+		{20, 20, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		got := planeFits(frame, 0, test.x, test.y*16+test.x, test.w, test.h, 16)
+		if got != test.expect {
+			t.Errorf("%dx%d at %d,%d: got %v, expected %v", test.w, test.h, test.x, test.y, got, test.expect)
+		}
+	}
+}
+
+func TestCheckSliceGeometry(t *testing.T) {
+	// A 3x2 slice grid.
+	record := &configRecord{num_h_slices_minus1: 2, num_v_slices_minus1: 1}
+	sl := func(x, y, w, h uint32) slice {
+		var s slice
+		s.has_header = true
+		s.header.slice_x = x
+		s.header.slice_y = y
+		s.header.slice_width_minus1 = w - 1
+		s.header.slice_height_minus1 = h - 1
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		slices []slice
+		err    *GeometryError
+	}{
+		{"grid", []slice{sl(0, 0, 1, 1), sl(1, 0, 1, 1), sl(2, 0, 1, 1), sl(0, 1, 1, 1), sl(1, 1, 1, 1), sl(2, 1, 1, 1)}, nil},
+		{"wide slices", []slice{sl(0, 0, 3, 1), sl(0, 1, 2, 1), sl(2, 1, 1, 1)}, nil},
+		{"out of order", []slice{sl(0, 1, 3, 1), sl(0, 0, 3, 1)}, nil},
+		{"overlap", []slice{sl(0, 0, 2, 2), sl(1, 1, 2, 1), sl(2, 0, 1, 1)},
+			&GeometryError{Index: 1, X: 1, Y: 1, Width: 2, Height: 1, Overlaps: 0}},
+		{"repeated", []slice{sl(0, 0, 3, 2), sl(0, 0, 3, 2)},
+			&GeometryError{Index: 1, X: 0, Y: 0, Width: 3, Height: 2, Overlaps: 0}},
+		{"gap", []slice{sl(0, 0, 3, 1), sl(0, 1, 1, 1), sl(2, 1, 1, 1)},
+			&GeometryError{Index: -1, X: 1, Y: 1, Width: 1, Height: 1, Overlaps: -1}},
+		{"too wide", []slice{sl(0, 0, 3, 1), sl(1, 1, 3, 1)},
+			&GeometryError{Index: 1, X: 1, Y: 1, Width: 3, Height: 1, Overlaps: -1}},
+		{"outside", []slice{sl(0, 0, 3, 2), sl(0, 2, 1, 1)},
+			&GeometryError{Index: 1, X: 0, Y: 2, Width: 1, Height: 1, Overlaps: -1}},
+		// Gaps can't be told from slices whose headers are missing.
+		{"missing header", []slice{sl(0, 0, 3, 1), {}}, nil},
+	}
+
+	for _, test := range tests {
+		err := checkSliceGeometry(record, test.slices)
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			}
+			continue
+		}
+		geometryErr, ok := err.(*GeometryError)
+		if !ok {
+			t.Errorf("%s: got error %v, not a *GeometryError", test.name, err)
+		} else if *geometryErr != *test.err {
+			t.Errorf("%s: got %+v, not %+v", test.name, *geometryErr, *test.err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package y4m implements a YUV4MPEG2 writer for decoded FFV1 frames.
+package y4m
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+// Options contains the stream metadata which is not part of a frame.
+type Options struct {
+	// Frame rate, as a fraction. If zero, 25:1 is used.
+	FrameRateNum uint32
+	FrameRateDen uint32
+	// Sample aspect ratio, as a fraction. If zero, 0:0, meaning
+	// unknown, is used.
+	SARNum uint32
+	SARDen uint32
+	// Interlacing mode: 'p' for progressive, 't' for top field first,
+	// 'b' for bottom field first, 'm' for mixed, or '?' for unknown.
+	// If zero, 'p' is used.
+	Interlacing byte
+}
+
+// Writer writes frames to a YUV4MPEG2 stream.
+//
+// The stream header is written along with the first frame, as the
+// colourspace tag depends on it. All later frames must have the same
+// format.
+type Writer struct {
+	w       io.Writer
+	opts    Options
+	started bool
+	// The format of the first frame. Only the format is kept, as the
+	// caller may reuse the frame's image data afterwards.
+	format  format
+	scratch []byte
+}
+
+// What must stay the same in every frame of a stream.
+type format struct {
+	width            uint32
+	height           uint32
+	bitDepth         uint8
+	colorSpace       int
+	hasChroma        bool
+	hasAlpha         bool
+	chromaSubsampleH uint8
+	chromaSubsampleV uint8
+	float            bool
+}
+
+func formatOf(frame *ffv1.Frame) format {
+	return format{
+		width:            frame.Width,
+		height:           frame.Height,
+		bitDepth:         frame.BitDepth,
+		colorSpace:       frame.ColorSpace,
+		hasChroma:        frame.HasChroma,
+		hasAlpha:         frame.HasAlpha,
+		chromaSubsampleH: frame.ChromaSubsampleH,
+		chromaSubsampleV: frame.ChromaSubsampleV,
+		float:            frame.Float,
+	}
+}
+
+// NewWriter creates a new YUV4MPEG2 writer, writing to w. If 'opts'
+// is nil, the defaults are used.
+func NewWriter(w io.Writer, opts *Options) *Writer {
+	ret := new(Writer)
+
+	ret.w = w
+	if opts != nil {
+		ret.opts = *opts
+	}
+	if ret.opts.FrameRateNum == 0 || ret.opts.FrameRateDen == 0 {
+		ret.opts.FrameRateNum = 25
+		ret.opts.FrameRateDen = 1
+	}
+	if ret.opts.SARNum == 0 || ret.opts.SARDen == 0 {
+		ret.opts.SARNum = 0
+		ret.opts.SARDen = 0
+	}
+	if ret.opts.Interlacing == 0 {
+		ret.opts.Interlacing = 'p'
+	}
+
+	return ret
+}
+
+// ColorspaceTag returns the YUV4MPEG2 'C' tag value for a frame's
+// format, such as "420jpeg", "422p10", "444alpha" or "mono".
+//
+// YUV4MPEG2 can not hold RGB, float, or high bit depth alpha, nor
+// every chroma subsampling or bit depth, so an error is returned for
+// those. The bit depths it can hold are 8, 9, 10, 12, 14 and 16.
+func ColorspaceTag(frame *ffv1.Frame) (string, error) {
+	if frame.Float {
+		return "", fmt.Errorf("float frames are not supported")
+	}
+	if frame.ColorSpace != ffv1.YCbCr {
+		return "", fmt.Errorf("RGB frames are not supported")
+	}
+	switch frame.BitDepth {
+	case 8, 9, 10, 12, 14, 16:
+	default:
+		return "", fmt.Errorf("unsupported bit depth: %d", frame.BitDepth)
+	}
+
+	depth := ""
+	if frame.BitDepth != 8 {
+		depth = fmt.Sprintf("p%d", frame.BitDepth)
+	}
+
+	if !frame.HasChroma {
+		if frame.HasAlpha {
+			return "", fmt.Errorf("luma with alpha is not supported")
+		}
+		if frame.BitDepth == 8 {
+			return "mono", nil
+		}
+		return fmt.Sprintf("mono%d", frame.BitDepth), nil
+	}
+
+	if frame.HasAlpha {
+		if frame.BitDepth != 8 || frame.ChromaSubsampleH != 0 || frame.ChromaSubsampleV != 0 {
+			return "", fmt.Errorf("alpha is only supported for 8-bit 4:4:4")
+		}
+		return "444alpha", nil
+	}
+
+	switch {
+	case frame.ChromaSubsampleH == 1 && frame.ChromaSubsampleV == 1:
+		if depth == "" {
+			return "420jpeg", nil
+		}
+		return "420" + depth, nil
+	case frame.ChromaSubsampleH == 1 && frame.ChromaSubsampleV == 0:
+		return "422" + depth, nil
+	case frame.ChromaSubsampleH == 0 && frame.ChromaSubsampleV == 0:
+		return "444" + depth, nil
+	case frame.ChromaSubsampleH == 2 && frame.ChromaSubsampleV == 0 && depth == "":
+		return "411", nil
+	}
+
+	return "", fmt.Errorf("unsupported chroma subsampling: %d, %d", frame.ChromaSubsampleH, frame.ChromaSubsampleV)
+}
+
+// WriteFrame writes a frame, preceded by the stream header if it is
+// the first frame. Samples above 8 bits are written little endian.
+func (w *Writer) WriteFrame(frame *ffv1.Frame) error {
+	if !w.started {
+		tag, err := ColorspaceTag(frame)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w.w, "YUV4MPEG2 W%d H%d F%d:%d I%c A%d:%d C%s\n",
+			frame.Width, frame.Height, w.opts.FrameRateNum, w.opts.FrameRateDen,
+			w.opts.Interlacing, w.opts.SARNum, w.opts.SARDen, tag)
+		if err != nil {
+			return err
+		}
+
+		w.started = true
+		w.format = formatOf(frame)
+	} else if formatOf(frame) != w.format {
+		return fmt.Errorf("frame format does not match the first frame")
+	}
+
+	_, err := io.WriteString(w.w, "FRAME\n")
+	if err != nil {
+		return err
+	}
+
+	if frame.BitDepth == 8 {
+		for _, plane := range frame.Buf {
+			_, err = w.w.Write(plane)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, plane := range frame.Buf16 {
+		if cap(w.scratch) < len(plane)*2 {
+			w.scratch = make([]byte, len(plane)*2)
+		}
+		buf := w.scratch[:len(plane)*2]
+		for i, v := range plane {
+			binary.LittleEndian.PutUint16(buf[i*2:], v)
+		}
+		_, err = w.w.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
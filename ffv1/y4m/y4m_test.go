@@ -0,0 +1,117 @@
+package y4m
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+)
+
+func TestColorspaceTag(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame ffv1.Frame
+		tag   string
+	}{
+		{"420", ffv1.Frame{BitDepth: 8, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}, "420jpeg"},
+		{"420 10-bit", ffv1.Frame{BitDepth: 10, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}, "420p10"},
+		{"422 12-bit", ffv1.Frame{BitDepth: 12, HasChroma: true, ChromaSubsampleH: 1}, "422p12"},
+		{"444", ffv1.Frame{BitDepth: 8, HasChroma: true}, "444"},
+		{"411", ffv1.Frame{BitDepth: 8, HasChroma: true, ChromaSubsampleH: 2}, "411"},
+		{"444 alpha", ffv1.Frame{BitDepth: 8, HasChroma: true, HasAlpha: true}, "444alpha"},
+		{"mono", ffv1.Frame{BitDepth: 8}, "mono"},
+		{"mono 16-bit", ffv1.Frame{BitDepth: 16}, "mono16"},
+		{"420 9-bit", ffv1.Frame{BitDepth: 9, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}, "420p9"},
+		{"444 14-bit", ffv1.Frame{BitDepth: 14, HasChroma: true}, "444p14"},
+		{"mono 10-bit", ffv1.Frame{BitDepth: 10}, "mono10"},
+		{"420 11-bit", ffv1.Frame{BitDepth: 11, HasChroma: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}, ""},
+		{"422 13-bit", ffv1.Frame{BitDepth: 13, HasChroma: true, ChromaSubsampleH: 1}, ""},
+		{"444 15-bit", ffv1.Frame{BitDepth: 15, HasChroma: true}, ""},
+		{"mono 11-bit", ffv1.Frame{BitDepth: 11}, ""},
+		{"mono 15-bit", ffv1.Frame{BitDepth: 15}, ""},
+		{"410", ffv1.Frame{BitDepth: 8, HasChroma: true, ChromaSubsampleH: 2, ChromaSubsampleV: 2}, ""},
+		{"411 10-bit", ffv1.Frame{BitDepth: 10, HasChroma: true, ChromaSubsampleH: 2}, ""},
+		{"420 alpha", ffv1.Frame{BitDepth: 8, HasChroma: true, HasAlpha: true, ChromaSubsampleH: 1, ChromaSubsampleV: 1}, ""},
+		{"444 alpha 10-bit", ffv1.Frame{BitDepth: 10, HasChroma: true, HasAlpha: true}, ""},
+		{"luma alpha", ffv1.Frame{BitDepth: 8, HasAlpha: true}, ""},
+		{"RGB", ffv1.Frame{BitDepth: 8, ColorSpace: ffv1.RGB, HasChroma: true}, ""},
+		{"float", ffv1.Frame{BitDepth: 16, HasChroma: true, Float: true}, ""},
+	}
+
+	for _, test := range tests {
+		tag, err := ColorspaceTag(&test.frame)
+		if test.tag == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, not an error", test.name, tag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		} else if tag != test.tag {
+			t.Errorf("%s: got %q, not %q", test.name, tag, test.tag)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	frame := &ffv1.Frame{
+		Width:            2,
+		Height:           2,
+		BitDepth:         10,
+		HasChroma:        true,
+		ChromaSubsampleH: 1,
+		ChromaSubsampleV: 1,
+		Buf16:            [][]uint16{{0x001, 0x102, 0x203, 0x3FF}, {0x200}, {0x100}},
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out, &Options{FrameRateNum: 30000, FrameRateDen: 1001, Interlacing: 't'})
+	err := w.WriteFrame(frame)
+	if err != nil {
+		t.Fatalf("couldn't write frame: %s", err.Error())
+	}
+
+	// The caller may reuse the frame, and its image data.
+	frame.Buf16[0][0] = 0x3FE
+	err = w.WriteFrame(frame)
+	if err != nil {
+		t.Fatalf("couldn't write second frame: %s", err.Error())
+	}
+
+	want := "YUV4MPEG2 W2 H2 F30000:1001 It A0:0 C420p10\n" +
+		"FRAME\n\x01\x00\x02\x01\x03\x02\xFF\x03\x00\x02\x00\x01" +
+		"FRAME\n\xFE\x03\x02\x01\x03\x02\xFF\x03\x00\x02\x00\x01"
+	if out.String() != want {
+		t.Errorf("wrote %q, not %q", out.String(), want)
+	}
+
+	other := *frame
+	other.Width = 4
+	err = w.WriteFrame(&other)
+	if err == nil {
+		t.Errorf("no error for a frame of another size")
+	}
+	if out.Len() != len(want) {
+		t.Errorf("wrote %d more bytes for a frame of another size", out.Len()-len(want))
+	}
+}
+
+func TestWriterDefaults(t *testing.T) {
+	frame := &ffv1.Frame{
+		Width:    2,
+		Height:   1,
+		BitDepth: 8,
+		Buf:      [][]byte{{1, 2}},
+	}
+
+	var out bytes.Buffer
+	err := NewWriter(&out, nil).WriteFrame(frame)
+	if err != nil {
+		t.Fatalf("couldn't write frame: %s", err.Error())
+	}
+	want := "YUV4MPEG2 W2 H1 F25:1 Ip A0:0 Cmono\nFRAME\n\x01\x02"
+	if out.String() != want {
+		t.Errorf("wrote %q, not %q", out.String(), want)
+	}
+}
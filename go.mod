@@ -1,3 +1,3 @@
 module github.com/dwbuiten/go-ffv1
 
-go 1.12
+go 1.18
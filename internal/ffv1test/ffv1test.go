@@ -0,0 +1,77 @@
+// Package ffv1test has helpers for tests which need FFV1 streams, such
+// as those of the container packages and of ffv1dec.
+package ffv1test
+
+import (
+	"testing"
+
+	"github.com/dwbuiten/go-ffv1/ffv1"
+	"github.com/dwbuiten/go-ffv1/internal/testpattern"
+)
+
+// The size of the stream Essence encodes.
+const (
+	Width  = 16
+	Height = 8
+)
+
+// Options are the encoder settings of the stream Essence encodes: 4:2:0
+// with a keyframe every other frame.
+var Options = ffv1.EncoderOptions{
+	Width:            Width,
+	Height:           Height,
+	HasChroma:        true,
+	ChromaSubsampleH: 1,
+	ChromaSubsampleV: 1,
+	GOPSize:          2,
+}
+
+// Frame makes frame n of the synthetic sequence, as described in
+// testpattern, for the given encoder settings.
+func Frame(opts ffv1.EncoderOptions, n int) *ffv1.Frame {
+	frame := &ffv1.Frame{
+		Width:            opts.Width,
+		Height:           opts.Height,
+		BitDepth:         8,
+		HasChroma:        opts.HasChroma,
+		HasAlpha:         opts.HasAlpha,
+		ChromaSubsampleH: opts.ChromaSubsampleH,
+		ChromaSubsampleV: opts.ChromaSubsampleV,
+	}
+	if !opts.HasChroma {
+		frame.ChromaSubsampleH, frame.ChromaSubsampleV = 0, 0
+	}
+	frame.Buf = testpattern.Planes(opts.Width, opts.Height, opts.HasChroma, opts.HasAlpha, frame.ChromaSubsampleH, frame.ChromaSubsampleV, n)
+
+	return frame
+}
+
+// Encode encodes 'count' frames of the synthetic sequence with the given
+// settings, returning the configuration record and the packets.
+func Encode(tb testing.TB, opts ffv1.EncoderOptions, count int) ([]byte, [][]byte) {
+	tb.Helper()
+
+	e, err := ffv1.NewEncoder(opts)
+	if err != nil {
+		tb.Fatalf("couldn't create encoder: %s", err.Error())
+	}
+
+	var packets [][]byte
+	for n := 0; n < count; n++ {
+		packet, err := e.EncodeFrame(Frame(opts, n))
+		if err != nil {
+			tb.Fatalf("couldn't encode frame %d: %s", n, err.Error())
+		}
+		packets = append(packets, packet)
+	}
+
+	return e.Record(), packets
+}
+
+// Essence encodes 'count' frames with Options, for tests which only
+// need a valid stream to put in a container.
+func Essence(tb testing.TB, count int) ([]byte, [][]byte) {
+	tb.Helper()
+
+	return Encode(tb, Options, count)
+}
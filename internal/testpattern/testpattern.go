@@ -0,0 +1,35 @@
+// Package testpattern makes the synthetic pictures tests encode and
+// check decoded frames against.
+//
+// It does not depend on the ffv1 package, so that the ffv1 package's
+// own tests can use it. Tests outside of it should use ffv1test.
+package testpattern
+
+// Planes makes the 8-bit planes of frame n of a synthetic sequence: a
+// moving gradient, with some texture. There is a luma plane, then, if
+// chroma is set, two chroma planes, subsampled by log2h and log2v,
+// rounding up, then, if alpha is set, an alpha plane.
+func Planes(width uint32, height uint32, chroma bool, alpha bool, log2h uint8, log2v uint8, n int) [][]byte {
+	widths := []int{int(width)}
+	heights := []int{int(height)}
+	if chroma {
+		chromaWidth := (int(width) + (1 << log2h) - 1) >> log2h
+		chromaHeight := (int(height) + (1 << log2v) - 1) >> log2v
+		widths = append(widths, chromaWidth, chromaWidth)
+		heights = append(heights, chromaHeight, chromaHeight)
+	}
+	if alpha {
+		widths = append(widths, int(width))
+		heights = append(heights, int(height))
+	}
+
+	ret := make([][]byte, len(widths))
+	for p := range widths {
+		ret[p] = make([]byte, widths[p]*heights[p])
+		for i := range ret[p] {
+			x, y := i%widths[p], i/widths[p]
+			ret[p][i] = byte(x*3 + y + n*5 + p*40 + (i*i)%7)
+		}
+	}
+	return ret
+}